@@ -2,7 +2,10 @@ package main
 
 import (
 	"arbokcore/core/database"
+	"arbokcore/core/files"
+	"arbokcore/pkg/blobstore"
 	"arbokcore/pkg/config"
+	"arbokcore/pkg/squirtle"
 	"context"
 	"errors"
 	"os"
@@ -15,6 +18,7 @@ import (
 const (
 	EnvDirCmd = "envdir"
 	Direction = "dir"
+	BlobRoot  = "root"
 )
 
 type MigrateCmd struct{}
@@ -47,6 +51,92 @@ func (mc MigrateCmd) Run(c *cli.Context) error {
 	return nil
 }
 
+// BlobURIMigrateCmd rewrites the chunk urls stored as local paths to
+// blob uris. root is the directory the paths were written under, if
+// the store has been moved since.
+type BlobURIMigrateCmd struct{}
+
+func (bc BlobURIMigrateCmd) Run(c *cli.Context) error {
+	cfg := config.Load(c.String(EnvDirCmd))
+
+	root := c.String(BlobRoot)
+	if root == "" {
+		root = cfg.BlobDir
+	}
+
+	conn := database.ConnectSqlite(cfg.DbName)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dbconn := conn.Connect(ctx)
+
+	ctx = context.Background()
+
+	qs := squirtle.LoadAll("./config/querystore.yaml")
+
+	metadataQueryStore, err := qs.HydrateQueryStore("file_metadatas")
+	if err != nil {
+		return err
+	}
+
+	localFs, err := blobstore.NewLocalFS(root)
+	if err != nil {
+		return err
+	}
+
+	report, err := files.MigrateBlobURIs(
+		ctx,
+		files.NewMetadataRepository(dbconn, metadataQueryStore),
+		localFs,
+	)
+	if err != nil {
+		return err
+	}
+
+	log.Info().
+		Int("scanned", report.Scanned).
+		Int("rewritten", report.Rewritten).
+		Int("skipped", report.Skipped).
+		Int("failed", report.Failed).
+		Msg("blob uri migration done")
+
+	return nil
+}
+
+// RewrapCmd wraps the data key of every encrypted chunk with the active
+// master key, so a retired master key can be dropped from the keyring.
+type RewrapCmd struct{}
+
+func (rc RewrapCmd) Run(c *cli.Context) error {
+	cfg := config.Load(c.String(EnvDirCmd))
+
+	storage, err := database.NewBlobStorage(cfg)
+	if err != nil {
+		return err
+	}
+
+	encrypted, ok := blobstore.EncryptedOf(storage)
+	if !ok {
+		return errors.New("blob encryption is not configured, set blob_key_id")
+	}
+
+	report, err := encrypted.Rewrap(context.Background())
+	if err != nil {
+		return err
+	}
+
+	log.Info().
+		Int("scanned", report.Scanned).
+		Int("rewrapped", report.Rewrapped).
+		Int("current", report.Current).
+		Int("plaintext", report.Plaintext).
+		Int("failed", report.Failed).
+		Msg("blob key rewrap done")
+
+	return nil
+}
+
 func main() {
 	// var envDir string
 
@@ -56,6 +146,8 @@ func main() {
 	// log.Info().Str("env_file", envDir).Msg("using env file from")
 
 	migrateCmd := MigrateCmd{}
+	blobURIMigrateCmd := BlobURIMigrateCmd{}
+	rewrapCmd := RewrapCmd{}
 
 	app := &cli.App{
 		Name:  "arbok",
@@ -76,6 +168,19 @@ func main() {
 				},
 				Action: migrateCmd.Run,
 			},
+			{
+				Name:  "migrate-blob-uris",
+				Usage: "arbok migrate-blob-uris [-root dir]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: BlobRoot},
+				},
+				Action: blobURIMigrateCmd.Run,
+			},
+			{
+				Name:   "rewrap-blob-keys",
+				Usage:  "arbok rewrap-blob-keys",
+				Action: rewrapCmd.Run,
+			},
 		},
 	}
 
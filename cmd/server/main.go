@@ -2,12 +2,16 @@ package main
 
 import (
 	"arbokcore/core/database"
+	"arbokcore/core/devices"
 	"arbokcore/core/files"
+	"arbokcore/core/notifiers"
+	"arbokcore/core/shares"
 	"arbokcore/core/tokens"
-	"arbokcore/pkg/blobstore"
+	"arbokcore/core/users"
 	"arbokcore/pkg/config"
 	"arbokcore/pkg/queuer"
 	"arbokcore/pkg/squirtle"
+	"arbokcore/pkg/urlsigner"
 	"arbokcore/web/middlewares"
 	"arbokcore/web/routes"
 	"context"
@@ -56,7 +60,22 @@ func main() {
 
 	tokensRepo := tokens.NewTokensRepository(dbconn, tokensQs)
 
-	authsvc := middlewares.NewAuthMiddleWareService(tokensRepo)
+	authsvc := middlewares.NewAuthMiddleWareService(tokensRepo, cfg.AuthTestMode)
+
+	devicesQs, err := qs.HydrateQueryStore("devices")
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to initialize devices query store")
+	}
+
+	devicesRepo := devices.NewDevicesRepository(dbconn, devicesQs, tokensQs)
+	deviceSvc := devices.NewDeviceService(devicesRepo)
+
+	usersQs, err := qs.HydrateQueryStore("users")
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to initialize users query store")
+	}
+
+	userSvc := users.NewUserService(dbconn, usersQs, tokensRepo, deviceSvc)
 
 	metadataQueryStore, err := qs.HydrateQueryStore("file_metadatas")
 	if err != nil {
@@ -80,9 +99,6 @@ func main() {
 		20*time.Second,
 	)
 
-	filesrepo := files.NewMetadataRepository(dbconn, metadataQueryStore)
-	filesvc := files.NewMetadataService(filesrepo, metadataTokenRepo, metadataQ)
-
 	chunkQs, err := qs.HydrateQueryStore("user_files")
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to load user files query")
@@ -90,18 +106,72 @@ func main() {
 
 	chunkRepo := files.NewUserFileRespository(dbconn, chunkQs)
 
-	localFs, err := blobstore.NewLocalFS("./tmp/arbokdata")
+	filesrepo := files.NewMetadataRepository(dbconn, metadataQueryStore)
+	filesvc := files.NewMetadataService(filesrepo, metadataTokenRepo, chunkRepo, metadataQ)
+
+	storage, err := database.NewBlobStorage(cfg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to initialize blob storage")
+	}
+
+	chunkSvc := files.NewFileChunkService(chunkRepo, storage)
+
+	notifierQ := queuer.NewRedisQ(
+		redisConn,
+		database.MetadataUpdateClientsNotifierQueue,
+		1*time.Second,
+	)
+	notifier := notifiers.NewMedataUpdateStatus(notifierQ)
+
+	versionSvc := files.NewVersionService(filesrepo, chunkRepo, notifier)
+	trashSvc := files.NewTrashService(filesrepo, storage, notifier)
+	downloadSvc := files.NewDownloadHandler(redisConn, storage)
+
+	sharesQs, err := qs.HydrateQueryStore("file_shares")
 	if err != nil {
-		log.Fatal().Err(err).Msg("failed initialized file system")
+		log.Fatal().Err(err).Msg("failed to load file shares query")
 	}
 
-	chunkSvc := files.NewFileChunkService(chunkRepo, localFs)
-	downloadSvc := files.NewDownloadHandler(redisConn)
+	sharesRepo := shares.NewSharesRepository(dbconn, sharesQs)
+	shareSvc := shares.NewShareService(sharesRepo, userSvc)
+
+	linksQs, err := qs.HydrateQueryStore("share_links")
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load share links query")
+	}
+
+	linksRepo := shares.NewLinksRepository(dbconn, linksQs)
+	linkSvc := shares.NewLinkService(linksRepo, shareSvc)
+
+	signingKey := []byte(cfg.BlobURLSecret)
+	if len(signingKey) == 0 {
+		log.Warn().Msg("blob_url_secret not set, signed chunk urls only work on this server until it restarts")
+
+		key, err := tokens.GenerateToken(32)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to generate url signing key")
+		}
 
-	metadataHandler := &routes.MetadataHandler{FileSvc: filesvc, Downloader: downloadSvc}
-	chunkHandler := &routes.ChunkHandler{ChunkSvc: chunkSvc}
+		signingKey = []byte(key)
+	}
 
-	shareHandler := &routes.ShareHandler{}
+	metadataHandler := &routes.MetadataHandler{
+		FileSvc:    filesvc,
+		Downloader: downloadSvc,
+		Shares:     shareSvc,
+		Links:      linkSvc,
+		Versions:   versionSvc,
+		Signer:     urlsigner.New(signingKey),
+	}
+	chunkHandler := &routes.ChunkHandler{
+		ChunkSvc: chunkSvc,
+		Uploads:  files.NewUploadService(filesrepo, chunkRepo, metadataTokenRepo, storage),
+	}
+
+	shareHandler := &routes.ShareHandler{ShareSvc: shareSvc, LinkSvc: linkSvc}
+	authHandler := &routes.AuthHandler{UserSvc: userSvc}
+	deviceHandler := &routes.DeviceHandler{DeviceSvc: deviceSvc}
+	trashHandler := &routes.TrashHandler{TrashSvc: trashSvc, Shares: shareSvc}
 
 	// Echo instance
 	e := echo.New()
@@ -137,13 +207,37 @@ func main() {
 
 	router.GET("/ping", hello)
 
-	sseHandler := routes.NewSSEHandler(cfg)
+	e.POST("/auth/signup", authHandler.Signup)
+	e.POST("/auth/login", authHandler.Login)
+	e.POST("/auth/refresh", authHandler.Refresh)
+
+	e.POST("/auth/logout",
+		authHandler.Logout,
+		authsvc.ValidateAccessToken,
+	)
+
+	sseHandler := routes.NewSSEHandler(cfg, devicesRepo)
 
 	e.GET("/subscribe/devices",
 		sseHandler.EstablishConnection,
 		authsvc.ValidateAccessToken,
 	)
 
+	e.POST("/my/devices",
+		deviceHandler.RegisterDevice,
+		authsvc.ValidateAccessToken,
+	)
+
+	e.GET("/my/devices",
+		deviceHandler.ListDevices,
+		authsvc.ValidateAccessToken,
+	)
+
+	e.DELETE("/my/devices/:deviceID",
+		deviceHandler.RemoveDevice,
+		authsvc.ValidateAccessToken,
+	)
+
 	e.GET("/my/files/:fileID",
 		metadataHandler.GetFileChunks,
 		authsvc.ValidateAccessToken,
@@ -154,6 +248,31 @@ func main() {
 		authsvc.ValidateAccessToken,
 	)
 
+	e.DELETE("/my/files/:fileID",
+		trashHandler.TrashFile,
+		authsvc.ValidateAccessToken,
+	)
+
+	e.GET("/my/trash",
+		trashHandler.ListTrash,
+		authsvc.ValidateAccessToken,
+	)
+
+	e.POST("/my/trash/:fileID/restore",
+		trashHandler.RestoreFile,
+		authsvc.ValidateAccessToken,
+	)
+
+	e.DELETE("/my/trash/:fileID",
+		trashHandler.PurgeFile,
+		authsvc.ValidateAccessToken,
+	)
+
+	e.GET("/my/storage",
+		metadataHandler.StorageUsage,
+		authsvc.ValidateAccessToken,
+	)
+
 	e.POST("/my/files",
 		metadataHandler.PostFileMetadata,
 		authsvc.ValidateAccessToken)
@@ -173,23 +292,101 @@ func main() {
 		authsvc.ValidateStreamToken,
 	)
 
+	e.GET("/my/files/:fileID/upload",
+		chunkHandler.UploadStatus,
+		authsvc.ValidateStreamToken,
+	)
+
+	e.DELETE("/my/files/:fileID/upload",
+		chunkHandler.AbortUpload,
+		authsvc.ValidateStreamToken,
+	)
+
 	e.PUT("/my/files/:fileID/share",
 		shareHandler.ShareFile,
 		authsvc.ValidateAccessToken,
 	)
 
+	e.GET("/my/files/:fileID/shares",
+		shareHandler.ListShares,
+		authsvc.ValidateAccessToken,
+	)
+
+	e.DELETE("/my/files/:fileID/shares/:userID",
+		shareHandler.RevokeShare,
+		authsvc.ValidateAccessToken,
+	)
+
+	e.GET("/my/shared",
+		shareHandler.ListSharedWithMe,
+		authsvc.ValidateAccessToken,
+	)
+
+	e.POST("/my/files/:fileID/links",
+		shareHandler.CreateLink,
+		authsvc.ValidateAccessToken,
+	)
+
+	e.GET("/my/files/:fileID/links",
+		shareHandler.ListLinks,
+		authsvc.ValidateAccessToken,
+	)
+
+	e.DELETE("/my/files/:fileID/links/:linkID",
+		shareHandler.RevokeLink,
+		authsvc.ValidateAccessToken,
+	)
+
+	e.GET("/my/files/:fileID/versions",
+		metadataHandler.ListVersions,
+		authsvc.ValidateAccessToken,
+	)
+
+	e.GET("/my/files/:fileID/versions/:versionID/download",
+		metadataHandler.DownloadVersion,
+		authsvc.ValidateAccessToken,
+	)
+
+	e.POST("/my/files/:fileID/versions/:versionID/restore",
+		metadataHandler.RestoreVersion,
+		authsvc.ValidateAccessToken,
+	)
+
+	// Tokens in download urls are deprecated, they put the access token
+	// in logs and history. Clients fetch the signed chunk urls of the
+	// manifest, the old links only work while url_token_downloads is set.
+	downloadAuth := []echo.MiddlewareFunc{authsvc.ValidateAccessToken}
+	if cfg.URLTokenDownloads {
+		log.Warn().Msg("url_token_downloads is deprecated, use the signed chunk urls of manifests")
+		downloadAuth = append([]echo.MiddlewareFunc{authsvc.AddTokenFromUrlToHeader}, downloadAuth...)
+	}
+
 	e.GET("/my/files/:fileID/download",
 		metadataHandler.DownloadFile,
-		authsvc.AddTokenFromUrlToHeader,
-		authsvc.ValidateAccessToken,
+		downloadAuth...,
 	)
 
 	e.GET("/my/files/:fileID/v2/download",
 		metadataHandler.DownloadFileV2,
-		authsvc.AddTokenFromUrlToHeader,
+		downloadAuth...,
+	)
+
+	e.GET("/my/files/:fileID/manifest",
+		metadataHandler.FileManifest,
+		authsvc.ValidateAccessToken,
+	)
+
+	e.GET("/my/files/:fileID/compression",
+		metadataHandler.FileCompression,
 		authsvc.ValidateAccessToken,
 	)
 
+	// Signed chunk urls of manifests, the signature is the only credential
+	e.GET("/blobs/chunks/:fileID/:chunkID", metadataHandler.DownloadChunk)
+
+	// Public share links, the link token is the only credential
+	e.GET("/links/:linkToken/download", metadataHandler.DownloadSharedLink)
+
 	srv := &http.Server{
 		Addr:    fmt.Sprintf(":%s", port),
 		Handler: e,
@@ -15,6 +15,10 @@ const (
 	EnvCmd         = "env"
 	SuperviseCmd   = "supervise"
 	SupervisorName = "name"
+
+	TrashSupervisor  = "trash"
+	UploadSupervisor = "uploads"
+	BlobGCSupervisor = "blobs"
 )
 
 type ReconcileRunner struct{}
@@ -46,6 +50,18 @@ func (s *SuperviseRunner) Run(c *cli.Context) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	if supervisor == TrashSupervisor {
+		return workers.TrashPurger(ctx, cfg)
+	}
+
+	if supervisor == UploadSupervisor {
+		return workers.UploadReaper(ctx, cfg)
+	}
+
+	if supervisor == BlobGCSupervisor {
+		return workers.BlobGarbageCollector(ctx, cfg)
+	}
+
 	return workers.MetdataSupervisor(ctx, cfg)
 }
 
@@ -40,6 +40,7 @@ type MetadataRequest struct {
 	FileType string `json:"fileType"`
 	Digest   string `json:"digest"`
 	Chunks   int    `json:"chunks"`
+	Chunking string `json:"chunking"`
 }
 
 type FileChunkRequest struct {
@@ -47,6 +48,7 @@ type FileChunkRequest struct {
 	NextChunkID string            `form:"nextChunkID"`
 	ChunkDigest string            `form:"chunkDigest"`
 	ChunkSize   int               `form:"chunkSize"`
+	ChunkOffset string            `form:"chunkOffset"`
 	FileDigest  string            `form:"fileDigest"` // Validate this against versio in file_metadatas.file_id = req.FileID
 	Data        io.ReadSeekCloser `form:"-"`
 	FileID      string            `form:"-"`
@@ -58,8 +60,42 @@ type FileUpdateMetadataRequest struct {
 	FileID       string `json:"fileID"`
 	Digest       string `json:"digest"`
 	Chunks       int64  `json:"chunks"`
+	Chunking     string `json:"chunking"`
 	FileSize     int64  `json:"fileSize"`
 	FileType     string `json:"fileType"`
 	UploadStatus string `json:"-"`
 	UserID       string `json:"-"`
+	DeviceID     string `json:"-"`
+
+	// The hashes of every chunk of the new version, in order. Sizes
+	// are only sent for content defined chunks.
+	ChunkHashes      []string `json:"chunkHashes"`
+	ChunkSizes       []int64  `json:"chunkSizes"`
+	ReuseFromAccount bool     `json:"reuseFromAccount"`
+}
+
+type AuthRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	DeviceID string `json:"deviceID"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+type DeviceRequest struct {
+	DeviceName string `json:"deviceName"`
+	Platform   string `json:"platform"`
+}
+
+type ShareRequest struct {
+	Email      string `json:"email"`
+	Permission string `json:"permission"`
+}
+
+type ShareLinkRequest struct {
+	Password     string `json:"password"`
+	ExpiresIn    int64  `json:"expiresIn"` // seconds, 0 never expires
+	MaxDownloads int64  `json:"maxDownloads"`
 }
@@ -0,0 +1,34 @@
+package database
+
+import (
+	"arbokcore/pkg/blobstore"
+	"arbokcore/pkg/config"
+	"strings"
+)
+
+// NewBlobStorage builds the blob storage the app is configured with
+func NewBlobStorage(cfg config.AppConfig) (blobstore.BlobStorage, error) {
+	codecs := []string{}
+
+	if cfg.BlobCompression != "" {
+		for _, codec := range strings.Split(cfg.BlobCompression, ",") {
+			codecs = append(codecs, strings.TrimSpace(codec))
+		}
+	}
+
+	return blobstore.New(blobstore.Options{
+		Backend: cfg.BlobBackend,
+		Dir:     cfg.BlobDir,
+		S3: blobstore.S3Config{
+			Bucket:    cfg.S3Bucket,
+			Prefix:    cfg.S3Prefix,
+			Region:    cfg.S3Region,
+			Endpoint:  cfg.S3Endpoint,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+		},
+		KeyID:       cfg.BlobKeyID,
+		MasterKeys:  cfg.BlobMasterKeys,
+		Compression: codecs,
+	})
+}
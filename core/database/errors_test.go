@@ -0,0 +1,36 @@
+package database
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_IsUniqueViolation(t *testing.T) {
+	db, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE users (id TEXT PRIMARY KEY, email TEXT NOT NULL)")
+	require.NoError(t, err)
+
+	_, err = db.Exec("CREATE UNIQUE INDEX idx_users_email ON users (email)")
+	require.NoError(t, err)
+
+	_, err = db.Exec("INSERT INTO users VALUES ('u1', 'a@b.c')")
+	require.NoError(t, err)
+
+	_, err = db.Exec("INSERT INTO users VALUES ('u2', 'a@b.c')")
+	require.True(t, IsUniqueViolation(err))
+
+	_, err = db.Exec("INSERT INTO users VALUES ('u1', 'd@e.f')")
+	require.True(t, IsUniqueViolation(err))
+
+	_, err = db.Exec("INSERT INTO users VALUES (NULL)")
+	require.False(t, IsUniqueViolation(err))
+
+	require.False(t, IsUniqueViolation(errors.New("unique")))
+	require.False(t, IsUniqueViolation(nil))
+}
@@ -0,0 +1,42 @@
+package devices
+
+import (
+	"arbokcore/core/database"
+	"errors"
+
+	"github.com/rs/zerolog/log"
+)
+
+type Device struct {
+	ID       string `db:"id" json:"deviceID"`
+	UserID   string `db:"user_id" json:"userID"`
+	Name     string `db:"device_name" json:"deviceName"`
+	Platform string `db:"platform" json:"platform"`
+
+	database.Timestamp
+}
+
+const (
+	MaxDeviceNameLen = 100
+	MaxPlatformLen   = 50
+)
+
+var (
+	ErrIDGenerationFailed = errors.New("id_gen_failed")
+)
+
+func NewDevice(userID, name, platform string) (*Device, error) {
+	id, err := database.NewID()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to generate id")
+		return nil, ErrIDGenerationFailed
+	}
+
+	return &Device{
+		ID:        id,
+		UserID:    userID,
+		Name:      name,
+		Platform:  platform,
+		Timestamp: database.NewTimestamp(),
+	}, nil
+}
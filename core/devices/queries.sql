@@ -0,0 +1,53 @@
+--sql:CreateDevice
+
+INSERT INTO devices (
+	id
+	,user_id
+	,device_name
+	,platform
+	,created_at
+	,updated_at
+) VALUES (
+	:id
+	,:user_id
+	,:device_name
+	,:platform
+	,:created_at
+	,:updated_at
+);
+
+
+--sql:GetDevicesForUser
+
+SELECT
+	id
+	,user_id
+	,device_name
+	,COALESCE(platform, '') AS platform
+	,created_at
+	,updated_at
+FROM devices
+WHERE user_id = :user_id
+ORDER BY created_at ASC;
+
+
+--sql:GetDeviceForUser
+
+SELECT
+	id
+	,user_id
+	,device_name
+	,COALESCE(platform, '') AS platform
+	,created_at
+	,updated_at
+FROM devices
+WHERE id = :id
+AND user_id = :user_id
+LIMIT 1;
+
+
+--sql:DeleteDevice
+
+DELETE FROM devices
+WHERE id = :id
+AND user_id = :user_id;
@@ -0,0 +1,260 @@
+package devices
+
+import (
+	"arbokcore/core/database"
+	"arbokcore/core/tokens"
+	"arbokcore/pkg/rho"
+	"arbokcore/pkg/squirtle"
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	CreateDeviceStmt      = "CreateDevice"
+	GetDevicesForUserStmt = "GetDevicesForUser"
+	GetDeviceForUserStmt  = "GetDeviceForUser"
+	DeleteDeviceStmt      = "DeleteDevice"
+)
+
+var (
+	ErrorStmtNotFound     = errors.New("stmt_not_found:6001:500")
+	ErrDeviceNotFound     = errors.New("device_not_found:6002:404")
+	ErrDeviceCreateFailed = errors.New("device_create_failed:6003:500")
+	ErrDeviceFetchFailed  = errors.New("device_fetch_failed:6004:500")
+	ErrDeviceDeleteFailed = errors.New("device_delete_failed:6005:500")
+)
+
+// DevicesRepository also needs the tokens queries, because
+// registering or removing a device changes which tokens are bound to it
+type DevicesRepository struct {
+	conn         *sqlx.DB
+	querier      squirtle.QueryMapper
+	tokenQuerier squirtle.QueryMapper
+}
+
+func NewDevicesRepository(
+	conn *sqlx.DB,
+	querier squirtle.QueryMapper,
+	tokenQuerier squirtle.QueryMapper,
+) *DevicesRepository {
+
+	return &DevicesRepository{
+		conn:         conn,
+		querier:      querier,
+		tokenQuerier: tokenQuerier,
+	}
+}
+
+// Create inserts the device and binds the live tokens of
+// the token family to it, in a transaction
+func (slf *DevicesRepository) Create(
+	ctx context.Context,
+	device *Device,
+	familyID string,
+) error {
+
+	createStmt, ok := slf.querier.GetQuery(CreateDeviceStmt)
+	if !ok {
+		return ErrorStmtNotFound
+	}
+
+	bindStmt, ok := slf.tokenQuerier.GetQuery(tokens.BindDeviceToFamilyStmt)
+	if !ok {
+		return ErrorStmtNotFound
+	}
+
+	tx, err := slf.conn.BeginTxx(ctx, nil)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to init transaction")
+		return ErrDeviceCreateFailed
+	}
+
+	_, err = tx.NamedExecContext(ctx, createStmt, device)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to create device")
+		tx.Rollback()
+		return ErrDeviceCreateFailed
+	}
+
+	_, err = tx.NamedExecContext(ctx, bindStmt, map[string]any{
+		"device_id":  device.ID,
+		"family_id":  familyID,
+		"updated_at": database.Now(),
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to bind tokens to device")
+		tx.Rollback()
+		return ErrDeviceCreateFailed
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Error().Err(err).Msg("failed to commit device")
+		return ErrDeviceCreateFailed
+	}
+
+	return nil
+}
+
+func (slf *DevicesRepository) ListByUserID(ctx context.Context, userID string) ([]*Device, error) {
+	stmt, ok := slf.querier.GetQuery(GetDevicesForUserStmt)
+	if !ok {
+		return nil, ErrorStmtNotFound
+	}
+
+	nstmt, err := slf.conn.PrepareNamedContext(ctx, stmt)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to prepare named stmt")
+		return nil, ErrDeviceFetchFailed
+	}
+	defer nstmt.Close()
+
+	devices := []*Device{}
+
+	err = nstmt.SelectContext(ctx, &devices, map[string]any{"user_id": userID})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to fetch devices")
+		return nil, ErrDeviceFetchFailed
+	}
+
+	return devices, nil
+}
+
+// ListDeviceIDs is used by the notifiers to fan out to every device of the user
+func (slf *DevicesRepository) ListDeviceIDs(ctx context.Context, userID string) ([]string, error) {
+	devices, err := slf.ListByUserID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return rho.Map(devices, func(device *Device, _ int) string {
+		return device.ID
+	}), nil
+}
+
+func (slf *DevicesRepository) FindByID(ctx context.Context, userID, deviceID string) (*Device, error) {
+	stmt, ok := slf.querier.GetQuery(GetDeviceForUserStmt)
+	if !ok {
+		return nil, ErrorStmtNotFound
+	}
+
+	nstmt, err := slf.conn.PrepareNamedContext(ctx, stmt)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to prepare named stmt")
+		return nil, ErrDeviceFetchFailed
+	}
+	defer nstmt.Close()
+
+	device := &Device{}
+
+	err = nstmt.GetContext(ctx, device, map[string]any{
+		"id":      deviceID,
+		"user_id": userID,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrDeviceNotFound
+	}
+
+	if err != nil {
+		log.Error().Err(err).Msg("failed to fetch device")
+		return nil, ErrDeviceFetchFailed
+	}
+
+	return device, nil
+}
+
+// Delete removes the device and revokes every token bound to it
+func (slf *DevicesRepository) Delete(ctx context.Context, userID, deviceID string) error {
+	deleteStmt, ok := slf.querier.GetQuery(DeleteDeviceStmt)
+	if !ok {
+		return ErrorStmtNotFound
+	}
+
+	revokeStmt, ok := slf.tokenQuerier.GetQuery(tokens.RevokeDeviceTokensStmt)
+	if !ok {
+		return ErrorStmtNotFound
+	}
+
+	tx, err := slf.conn.BeginTxx(ctx, nil)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to init transaction")
+		return ErrDeviceDeleteFailed
+	}
+
+	result, err := tx.NamedExecContext(ctx, deleteStmt, map[string]any{
+		"id":      deviceID,
+		"user_id": userID,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to delete device")
+		tx.Rollback()
+		return ErrDeviceDeleteFailed
+	}
+
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		tx.Rollback()
+		return ErrDeviceNotFound
+	}
+
+	_, err = tx.NamedExecContext(ctx, revokeStmt, map[string]any{
+		"device_id":  deviceID,
+		"user_id":    userID,
+		"revoked_at": database.Now(),
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to revoke device tokens")
+		tx.Rollback()
+		return ErrDeviceDeleteFailed
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Error().Err(err).Msg("failed to commit device delete")
+		return ErrDeviceDeleteFailed
+	}
+
+	return nil
+}
+
+type DeviceService struct {
+	repo *DevicesRepository
+}
+
+func NewDeviceService(repo *DevicesRepository) *DeviceService {
+	return &DeviceService{repo: repo}
+}
+
+// Register creates a device for the user and binds
+// the session the request was made with to it
+func (slf *DeviceService) Register(
+	ctx context.Context,
+	token *tokens.Token,
+	name string,
+	platform string,
+) (*Device, error) {
+
+	device, err := NewDevice(token.ResourceID, name, platform)
+	if err != nil {
+		return nil, ErrDeviceCreateFailed
+	}
+
+	if err := slf.repo.Create(ctx, device, token.FamilyID); err != nil {
+		return nil, err
+	}
+
+	return device, nil
+}
+
+func (slf *DeviceService) List(ctx context.Context, userID string) ([]*Device, error) {
+	return slf.repo.ListByUserID(ctx, userID)
+}
+
+func (slf *DeviceService) Find(ctx context.Context, userID, deviceID string) (*Device, error) {
+	return slf.repo.FindByID(ctx, userID, deviceID)
+}
+
+func (slf *DeviceService) Remove(ctx context.Context, userID, deviceID string) error {
+	return slf.repo.Delete(ctx, userID, deviceID)
+}
@@ -1,64 +1,182 @@
 package files
 
 import (
-	"bytes"
+	"arbokcore/pkg/blobstore"
 	"context"
+	"errors"
 	"io"
-	"os"
+	"strconv"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog/log"
 )
 
-type DownloadHandler struct {
-	cacher *redis.Client
-}
+// Downloads read the chunks one at a time, so a download only holds one
+// chunk in memory no matter the file size. The chunks are laid out by their
+// offsets, so a byte range of the file maps to the chunks it covers, and
+// only those are read. Chunks are fetched and read through the BlobStorage.
+
+var ErrChunkMissing = errors.New("file_corrupted:2065:500")
 
-func NewDownloadHandler(client *redis.Client) *DownloadHandler {
-	return &DownloadHandler{cacher: client}
+type ChunkSpan struct {
+	ChunkID int64
+	Url     string
+	Hash    string
+	Offset  int64
+	Size    int64
+
+	// The size the chunk takes in the store, once compressed or sealed,
+	// 0 when it is stored as it is
+	StoredSize int64
 }
 
-func (dh *DownloadHandler) Download(ctx context.Context, fileSize int64, filePaths []string) (*bytes.Buffer, error) {
+// BuildChunkSpans lays out the chunks of the file in order. Chunks stored
+// before offsets were recorded are fixed size chunks, their offset comes
+// from the chunk id. The chunks have to cover the file without gaps.
+func BuildChunkSpans(info *FileInfoResponse) ([]*ChunkSpan, error) {
+	spans := []*ChunkSpan{}
+	offset := int64(0)
+
+	for i := 0; i < info.NChunks; i++ {
+		chunk, ok := info.Chunks[strconv.Itoa(i)]
+		if !ok || chunk.ChunkBlobUrl == "" {
+			return nil, ErrChunkMissing
+		}
+
+		span := &ChunkSpan{
+			ChunkID: int64(i),
+			Url:     chunk.ChunkBlobUrl,
+			Hash:    chunk.ChunkHash,
+			Offset:  int64(i) * FrontendChunkSize,
+		}
 
-	var buffer = bytes.NewBuffer(make([]byte, 0, fileSize))
+		if chunk.ChunkOffset != nil {
+			span.Offset = *chunk.ChunkOffset
+		}
 
-	for _, filePath := range filePaths {
-		data, err := dh.cacher.Get(ctx, filePath).Bytes()
-		if err == nil {
-			w, err := io.Copy(buffer, bytes.NewBuffer(data))
-			if err != nil {
-				return nil, err
-			}
+		span.Size = min(FrontendChunkSize, info.Size-span.Offset)
+		if chunk.ChunkSize != nil {
+			span.Size = *chunk.ChunkSize
+		}
 
-			log.Info().Int64("bytes", w).Msg("written chunks")
-			continue
+		if chunk.ChunkStoredSize != nil && *chunk.ChunkStoredSize != span.Size {
+			span.StoredSize = *chunk.ChunkStoredSize
 		}
 
-		//TODO: replace with interface, so s3/os all have same interface
-		file, err := os.Open(filePath)
-		if err != nil {
-			log.Error().Err(err).Msg("failed to read intentend file")
-			return nil, err
+		if span.Offset != offset || span.Size < 0 {
+			return nil, ErrChunkMissing
 		}
 
-		defer file.Close()
+		spans = append(spans, span)
+		offset += span.Size
+	}
+
+	if offset != info.Size {
+		return nil, ErrChunkMissing
+	}
+
+	return spans, nil
+}
+
+type DownloadHandler struct {
+	cacher  *redis.Client
+	storage blobstore.BlobStorage
+}
+
+func NewDownloadHandler(client *redis.Client, storage blobstore.BlobStorage) *DownloadHandler {
+	return &DownloadHandler{cacher: client, storage: storage}
+}
+
+// FileOpener opens the chunks of the spans as one file
+type FileOpener func(ctx context.Context, spans []*ChunkSpan) (io.ReadSeekCloser, error)
+
+// fetch looks the chunks up before anything is sent, a missing chunk
+// or one with another size than recorded fails the download up front.
+// The storage only knows the size a chunk takes in the store, the chunk
+// is then read with the size of the span.
+func (dh *DownloadHandler) fetch(ctx context.Context, spans []*ChunkSpan) ([]*blobstore.ChunkedFile, error) {
+	chunkPaths := []string{}
+	for _, span := range spans {
+		chunkPaths = append(chunkPaths, span.Url)
+	}
 
-		fileDataBuffer := new(bytes.Buffer)
-		teeReader := io.TeeReader(file, fileDataBuffer)
+	chunks, err := dh.storage.FetchChunks(ctx, chunkPaths)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to fetch file chunks")
+		return nil, ErrChunkMissing
+	}
 
-		w, err := io.Copy(buffer, teeReader)
-		if err != nil {
-			log.Error().Err(err).Msg("failed to copy file chunk into buffer")
-			return nil, err
+	for i, chunk := range chunks {
+		expected := spans[i].Size
+		if spans[i].StoredSize != 0 {
+			expected = spans[i].StoredSize
 		}
 
-		log.Info().Int64("bytes", w).Msg("written chunks")
-		err = dh.cacher.SetEx(ctx, filePath, fileDataBuffer.Bytes(), 2*time.Hour).Err()
-		if err != nil {
-			log.Error().Err(err).Msg("failed to set data in cache")
+		if chunk.Size() != expected {
+			log.Error().
+				Str("blob", chunk.Path()).
+				Int64("expected", expected).
+				Int64("found", chunk.Size()).
+				Msg("chunk size mismatch")
+
+			return nil, ErrChunkMissing
 		}
+
+		chunk.WithSize(spans[i].Size)
+	}
+
+	return chunks, nil
+}
+
+// Open reads the chunks from the storage
+func (dh *DownloadHandler) Open(ctx context.Context, spans []*ChunkSpan) (io.ReadSeekCloser, error) {
+	chunks, err := dh.fetch(ctx, spans)
+	if err != nil {
+		return nil, err
+	}
+
+	return dh.storage.BuildFile(ctx, chunks)
+}
+
+// OpenCached is Open with the chunks cached in redis for a while. The
+// cache would hold the chunks in plaintext, so encrypted chunks skip it.
+func (dh *DownloadHandler) OpenCached(ctx context.Context, spans []*ChunkSpan) (io.ReadSeekCloser, error) {
+	if _, ok := blobstore.EncryptedOf(dh.storage); ok {
+		return dh.Open(ctx, spans)
+	}
+
+	chunks, err := dh.fetch(ctx, spans)
+	if err != nil {
+		return nil, err
+	}
+
+	return blobstore.NewChunkChain(ctx, chunks, dh.openCachedChunk), nil
+}
+
+func (dh *DownloadHandler) openCachedChunk(ctx context.Context, chunkPath string) (io.ReadCloser, error) {
+	data, err := dh.cacher.Get(ctx, chunkPath).Bytes()
+	if err == nil {
+		return blobstore.NewBytesBlob(data), nil
+	}
+
+	chunk, err := dh.storage.OpenChunk(ctx, chunkPath)
+	if err != nil {
+		return nil, err
+	}
+	defer chunk.Close()
+
+	// Only this chunk is held, to be put in the cache
+	data, err = io.ReadAll(chunk)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read file chunk")
+		return nil, err
+	}
+
+	err = dh.cacher.SetEx(ctx, chunkPath, data, 2*time.Hour).Err()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to set data in cache")
 	}
 
-	return buffer, nil
+	return blobstore.NewBytesBlob(data), nil
 }
@@ -0,0 +1,200 @@
+package files
+
+import (
+	"arbokcore/pkg/blobstore"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func int64Ptr(v int64) *int64 {
+	return &v
+}
+
+func Test_BuildChunkSpans(t *testing.T) {
+	t.Run("chunks with offsets", func(t *testing.T) {
+		info := &FileInfoResponse{Size: 9, NChunks: 2, Chunks: map[string]*FilesWithChunks{
+			"0": {ChunkBlobUrl: "/c0", ChunkHash: "h0", ChunkOffset: int64Ptr(0), ChunkSize: int64Ptr(3)},
+			"1": {ChunkBlobUrl: "/c1", ChunkHash: "h1", ChunkOffset: int64Ptr(3), ChunkSize: int64Ptr(6)},
+		}}
+
+		spans, err := BuildChunkSpans(info)
+		require.NoError(t, err)
+
+		require.Equal(t, []*ChunkSpan{
+			{ChunkID: 0, Url: "/c0", Hash: "h0", Offset: 0, Size: 3},
+			{ChunkID: 1, Url: "/c1", Hash: "h1", Offset: 3, Size: 6},
+		}, spans)
+	})
+
+	t.Run("older fixed chunks are laid out by id", func(t *testing.T) {
+		info := &FileInfoResponse{Size: FrontendChunkSize + 10, NChunks: 2, Chunks: map[string]*FilesWithChunks{
+			"0": {ChunkBlobUrl: "/c0"},
+			"1": {ChunkBlobUrl: "/c1"},
+		}}
+
+		spans, err := BuildChunkSpans(info)
+		require.NoError(t, err)
+
+		require.Equal(t, []*ChunkSpan{
+			{ChunkID: 0, Url: "/c0", Offset: 0, Size: FrontendChunkSize},
+			{ChunkID: 1, Url: "/c1", Offset: FrontendChunkSize, Size: 10},
+		}, spans)
+	})
+
+	t.Run("chunks stored in another size", func(t *testing.T) {
+		info := &FileInfoResponse{Size: 9, NChunks: 2, Chunks: map[string]*FilesWithChunks{
+			"0": {ChunkBlobUrl: "/c0", ChunkOffset: int64Ptr(0), ChunkSize: int64Ptr(3), ChunkStoredSize: int64Ptr(3)},
+			"1": {ChunkBlobUrl: "/c1", ChunkOffset: int64Ptr(3), ChunkSize: int64Ptr(6), ChunkStoredSize: int64Ptr(130)},
+		}}
+
+		spans, err := BuildChunkSpans(info)
+		require.NoError(t, err)
+
+		require.Equal(t, []*ChunkSpan{
+			{ChunkID: 0, Url: "/c0", Offset: 0, Size: 3},
+			{ChunkID: 1, Url: "/c1", Offset: 3, Size: 6, StoredSize: 130},
+		}, spans)
+	})
+
+	t.Run("missing chunk", func(t *testing.T) {
+		info := &FileInfoResponse{Size: 6, NChunks: 2, Chunks: map[string]*FilesWithChunks{
+			"0": {ChunkBlobUrl: "/c0", ChunkOffset: int64Ptr(0), ChunkSize: int64Ptr(3)},
+			"1": {ChunkBlobUrl: "", ChunkOffset: int64Ptr(3), ChunkSize: int64Ptr(3)},
+		}}
+
+		_, err := BuildChunkSpans(info)
+		require.ErrorIs(t, err, ErrChunkMissing)
+	})
+
+	t.Run("chunks not covering the file", func(t *testing.T) {
+		info := &FileInfoResponse{Size: 10, NChunks: 2, Chunks: map[string]*FilesWithChunks{
+			"0": {ChunkBlobUrl: "/c0", ChunkOffset: int64Ptr(0), ChunkSize: int64Ptr(3)},
+			"1": {ChunkBlobUrl: "/c1", ChunkOffset: int64Ptr(4), ChunkSize: int64Ptr(6)},
+		}}
+
+		_, err := BuildChunkSpans(info)
+		require.ErrorIs(t, err, ErrChunkMissing)
+	})
+}
+
+func Test_DownloadOpen(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	storage, err := blobstore.NewLocalFS(dir)
+	require.NoError(t, err)
+
+	spans := []*ChunkSpan{}
+	offset := int64(0)
+
+	for i, data := range []string{"first ", "second ", "third"} {
+		path := filepath.Join(dir, "File1", strconv.Itoa(i))
+		require.NoError(t, blobstore.EnsureDir(filepath.Dir(path)))
+		require.NoError(t, os.WriteFile(path, []byte(data), 0o644))
+
+		spans = append(spans, &ChunkSpan{Url: path, Offset: offset, Size: int64(len(data))})
+		offset += int64(len(data))
+	}
+
+	// Open doesn't touch the cache
+	downloader := NewDownloadHandler(nil, storage)
+
+	t.Run("reads the file through the storage", func(t *testing.T) {
+		file, err := downloader.Open(ctx, spans)
+		require.NoError(t, err)
+		defer file.Close()
+
+		data, err := io.ReadAll(file)
+		require.NoError(t, err)
+		require.Equal(t, "first second third", string(data))
+	})
+
+	t.Run("missing chunk", func(t *testing.T) {
+		missing := []*ChunkSpan{spans[0], {Url: filepath.Join(dir, "gone"), Offset: 6, Size: 7}}
+
+		_, err := downloader.Open(ctx, missing)
+		require.ErrorIs(t, err, ErrChunkMissing)
+	})
+
+	t.Run("chunk size differs from the record", func(t *testing.T) {
+		short := []*ChunkSpan{{Url: spans[0].Url, Offset: 0, Size: 10}}
+
+		_, err := downloader.Open(ctx, short)
+		require.ErrorIs(t, err, ErrChunkMissing)
+	})
+}
+
+func Test_DownloadOpenCompressed(t *testing.T) {
+	ctx := context.Background()
+
+	localFs, err := blobstore.NewLocalFS(t.TempDir())
+	require.NoError(t, err)
+
+	storage, err := blobstore.NewCompressed(localFs, []string{blobstore.CodecZstd})
+	require.NoError(t, err)
+
+	logs := []byte(strings.Repeat("GET /my/files 200\n", 200))
+	chunk := blobstore.NewChunkedFile(blobstore.NewBytesBlob(logs), 0, nil)
+
+	uri, err := storage.UpdateChunk(ctx, "File1", chunk)
+	require.NoError(t, err)
+
+	downloader := NewDownloadHandler(nil, storage)
+
+	t.Run("read with the recorded size", func(t *testing.T) {
+		span := &ChunkSpan{Url: uri, Size: int64(len(logs)), StoredSize: chunk.StoredSize()}
+
+		file, err := downloader.Open(ctx, []*ChunkSpan{span})
+		require.NoError(t, err)
+		defer file.Close()
+
+		data, err := io.ReadAll(file)
+		require.NoError(t, err)
+		require.Equal(t, logs, data)
+	})
+
+	t.Run("stored size differs from the record", func(t *testing.T) {
+		span := &ChunkSpan{Url: uri, Size: int64(len(logs)), StoredSize: chunk.StoredSize() + 1}
+
+		_, err := downloader.Open(ctx, []*ChunkSpan{span})
+		require.ErrorIs(t, err, ErrChunkMissing)
+	})
+}
+
+func Test_DownloadOpenCachedEncrypted(t *testing.T) {
+	ctx := context.Background()
+
+	localFs, err := blobstore.NewLocalFS(t.TempDir())
+	require.NoError(t, err)
+
+	keys, err := blobstore.NewKeyring("k1", map[string][]byte{"k1": []byte(strings.Repeat("k", 32))})
+	require.NoError(t, err)
+
+	storage := blobstore.NewEncrypted(localFs, keys)
+
+	plain := []byte("a chunk nobody should find in redis")
+	chunk := blobstore.NewChunkedFile(blobstore.NewBytesBlob(plain), 0, nil)
+
+	uri, err := storage.UpdateChunk(ctx, "File1", chunk)
+	require.NoError(t, err)
+
+	// Without a redis client, reading through the cache would fail
+	downloader := NewDownloadHandler(nil, storage)
+
+	span := &ChunkSpan{Url: uri, Size: int64(len(plain)), StoredSize: chunk.StoredSize()}
+
+	file, err := downloader.OpenCached(ctx, []*ChunkSpan{span})
+	require.NoError(t, err)
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	require.NoError(t, err)
+	require.Equal(t, plain, data)
+}
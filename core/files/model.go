@@ -2,6 +2,8 @@ package files
 
 import (
 	"arbokcore/core/database"
+	"arbokcore/pkg/chunker"
+	"errors"
 	"time"
 )
 
@@ -13,6 +15,13 @@ const (
 
 const FrontendChunkSize int64 = 4 * 1024 * 1024
 
+// Chunking schemes. Fixed chunks are FrontendChunkSize slices of the file,
+// content defined chunks are cut by pkg/chunker with its default options.
+const (
+	ChunkingFixed = "fixed"
+	ChunkingCDC   = "cdc"
+)
+
 type FileMetadata struct {
 	ID          string     `db:"id"`
 	UserID      string     `db:"user_id"`
@@ -25,10 +34,48 @@ type FileMetadata struct {
 	UploadStaus string     `db:"upload_status"`
 	PrevID      *string    `db:"prev_id"`
 	EndDate     *time.Time `db:"end_date"`
+	DeviceID    string     `db:"device_id"`
+	Chunking    string     `db:"chunking"`
+
+	// Every chunk of the version was linked or uploaded explicitly,
+	// none are left for the changelog to fill in from the previous one
+	ExplicitChunks bool `db:"explicit_chunks"`
 
 	database.Timestamp
 }
 
+// FileVersion is one row of the prev_id chain of a file, the current
+// version has current_flag set and the older ones have an end_date.
+type FileVersion struct {
+	ID           string     `db:"id" json:"versionID"`
+	PrevID       *string    `db:"prev_id" json:"prevID"`
+	Filename     string     `db:"file_name" json:"fileName"`
+	FileSize     int64      `db:"file_size" json:"fileSize"`
+	FileType     string     `db:"file_type" json:"fileType"`
+	FileHash     string     `db:"file_hash" json:"fileHash"`
+	NChunks      int        `db:"chunks" json:"chunks"`
+	CurrentFlag  bool       `db:"current_flag" json:"currentFlag"`
+	UploadStatus string     `db:"upload_status" json:"uploadStatus"`
+	DeviceID     string     `db:"device_id" json:"deviceID,omitempty"`
+	Chunking     string     `db:"chunking" json:"chunking"`
+	CreatedAt    time.Time  `db:"created_at" json:"createdAt"`
+	EndDate      *time.Time `db:"end_date" json:"endDate"`
+}
+
+type TrashedFile struct {
+	ID        string    `db:"id" json:"fileID"`
+	Filename  string    `db:"file_name" json:"fileName"`
+	FileSize  int64     `db:"file_size" json:"fileSize"`
+	FileType  string    `db:"file_type" json:"fileType"`
+	FileHash  string    `db:"file_hash" json:"fileHash"`
+	DeletedAt time.Time `db:"deleted_at" json:"deletedAt"`
+}
+
+type TrashedLineage struct {
+	LineageID string `db:"lineage_id"`
+	OwnerID   string `db:"owner_id"`
+}
+
 type CacheMetadata struct {
 	UserID   string  `json:"userID" db:"user_id"`
 	PrevID   *string `json:"prevID" db:"prev_id"`
@@ -43,10 +90,37 @@ type UserFile struct {
 	ChunkBlobUrl string `db:"chunk_blob_url"`
 	ChunkHash    string `db:"chunk_hash"`
 	NextChunkID  *int64 `db:"next_chunk_id"`
+	ChunkOffset  *int64 `db:"chunk_offset"`
+	ChunkSize    *int64 `db:"chunk_size"`
 
 	database.Timestamp
 }
 
+// Blob is a chunk stored once by its hash, ref_count is the number of
+// user_files rows pointing at it and is kept by triggers on user_files.
+// Size is the size of the chunk, StoredSize the size it takes in the store,
+// once compressed and encrypted.
+type Blob struct {
+	Hash       string `db:"hash"`
+	BlobUrl    string `db:"blob_url"`
+	Size       int64  `db:"size"`
+	Codec      string `db:"codec"`
+	StoredSize int64  `db:"stored_size"`
+	RefCount   int64  `db:"ref_count"`
+
+	database.Timestamp
+}
+
+// StorageUsage compares the size of every completed version of the files
+// of a user with the size of the blobs they take up once deduplicated.
+type StorageUsage struct {
+	Versions      int64 `db:"versions" json:"versions"`
+	LogicalBytes  int64 `db:"logical_bytes" json:"logicalBytes"`
+	Blobs         int64 `db:"blobs" json:"blobs"`
+	PhysicalBytes int64 `db:"physical_bytes" json:"physicalBytes"`
+	SavedBytes    int64 `db:"-" json:"savedBytes"`
+}
+
 type FilesWithChunks struct {
 	ID          string `db:"id" json:"fileID"`
 	UserID      string `db:"user_id" json:"-"`
@@ -55,14 +129,22 @@ type FilesWithChunks struct {
 	FileType    string `db:"file_type" json:"fileType"`
 	FileHash    string `db:"file_hash" json:"fileHash"`
 	NChunks     int    `db:"chunks" json:"chunks"` // In MB
+	Chunking    string `db:"chunking" json:"chunking"`
 	CurrentFlag bool   `db:"current_flag" json:"currentFlag"`
 
+	ExplicitChunks bool `db:"explicit_chunks" json:"-"`
+
 	UploadStaus  string `db:"upload_status" json:"uploadStatus"`
 	FileID       string `db:"file_id" json:"-"`
 	ChunkID      int64  `db:"chunk_id" json:"chunkID"`
 	ChunkBlobUrl string `db:"chunk_blob_url" json:"chunkBlobUrl"`
 	ChunkHash    string `db:"chunk_hash" json:"chunkHash"`
 	NextChunkID  *int64 `db:"next_chunk_id" json:"nextChunkID"`
+	ChunkOffset  *int64 `db:"chunk_offset" json:"chunkOffset"`
+	ChunkSize    *int64 `db:"chunk_size" json:"chunkSize"`
+
+	// The size the chunk takes in the store, from its blob
+	ChunkStoredSize *int64 `db:"chunk_stored_size" json:"-"`
 	// Version      string `db:"version" json:"version"`
 	PrevID  *string    `db:"prev_id" json:"prevID"`
 	EndDate *time.Time `db:"end_date"`
@@ -80,3 +162,35 @@ func CalculateChunks(fileSize int64) int {
 	return int(n_chunks)
 
 }
+
+var ErrInvalidChunking = errors.New("invalid_chunking:2061:422")
+
+// NormalizeChunking checks the chunking scheme sent by the
+// client, the older clients don't send one and use fixed chunks
+func NormalizeChunking(scheme string) (string, error) {
+	switch scheme {
+	case "", ChunkingFixed:
+		return ChunkingFixed, nil
+	case ChunkingCDC:
+		return ChunkingCDC, nil
+	}
+
+	return "", ErrInvalidChunking
+}
+
+// ValidChunkCount checks the number of chunks announced for the file. With
+// fixed chunks it follows from the size, content defined chunks only have
+// bounds, every chunk but the last is between the min and max size.
+func ValidChunkCount(scheme string, fileSize int64, nChunks int) bool {
+	if scheme != ChunkingCDC {
+		return CalculateChunks(fileSize) == nChunks
+	}
+
+	minSize := int64(chunker.DefaultOptions.MinSize)
+	maxSize := int64(chunker.DefaultOptions.MaxSize)
+
+	lower := (fileSize + maxSize - 1) / maxSize
+	upper := fileSize/minSize + 1
+
+	return int64(nChunks) >= lower && int64(nChunks) <= upper
+}
@@ -25,3 +25,35 @@ func Test_CalculateChunks(t *testing.T) {
 		assert.Equal(t, 3, CalculateChunks(int64(chunkSize)))
 	})
 }
+
+func Test_ValidChunkCount(t *testing.T) {
+	t.Run("fixed chunks follow the file size", func(t *testing.T) {
+		fileSize := int64(9 * 1024 * 1024)
+
+		assert.True(t, ValidChunkCount(ChunkingFixed, fileSize, 3))
+		assert.False(t, ValidChunkCount(ChunkingFixed, fileSize, 4))
+	})
+
+	t.Run("content defined chunks are within bounds", func(t *testing.T) {
+		fileSize := int64(40 * 1024 * 1024)
+
+		assert.False(t, ValidChunkCount(ChunkingCDC, fileSize, 2))
+		assert.True(t, ValidChunkCount(ChunkingCDC, fileSize, 3))
+		assert.True(t, ValidChunkCount(ChunkingCDC, fileSize, 11))
+		assert.True(t, ValidChunkCount(ChunkingCDC, fileSize, 41))
+		assert.False(t, ValidChunkCount(ChunkingCDC, fileSize, 42))
+	})
+}
+
+func Test_NormalizeChunking(t *testing.T) {
+	scheme, err := NormalizeChunking("")
+	assert.NoError(t, err)
+	assert.Equal(t, ChunkingFixed, scheme)
+
+	scheme, err = NormalizeChunking(ChunkingCDC)
+	assert.NoError(t, err)
+	assert.Equal(t, ChunkingCDC, scheme)
+
+	_, err = NormalizeChunking("rabin")
+	assert.ErrorIs(t, err, ErrInvalidChunking)
+}
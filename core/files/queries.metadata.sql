@@ -14,6 +14,9 @@ INSERT INTO file_metadatas (
 	,created_at
 	,updated_at
 	,end_date
+	,device_id
+	,chunking
+	,explicit_chunks
 ) VALUES (
 	:id
 	,:prev_id
@@ -28,6 +31,9 @@ INSERT INTO file_metadatas (
 	,:created_at
 	,:updated_at
 	,:end_date
+	,:device_id
+	,:chunking
+	,:explicit_chunks
 );
 
 --sql:GetMetadataForUser
@@ -46,6 +52,7 @@ FROM file_metadatas
 WHERE
 	user_id = :user_id
 AND current_flag = 1
+AND deleted_at IS NULL
 ORDER BY created_at DESC
 LIMIT %d OFFSET %d;
 
@@ -74,6 +81,7 @@ ON
 WHERE
 	fm.user_id = :user_id
 AND fm.current_flag = 1
+AND fm.deleted_at IS NULL
 ORDER BY fm.created_at DESC
 LIMIT %d OFFSET %d;
 
@@ -112,6 +120,8 @@ SELECT
 	,created_at
 	,updated_at
 	,end_date
+	,COALESCE(device_id, '') AS device_id
+	,chunking
 FROM file_metadatas
 WHERE %s;
 
@@ -127,6 +137,8 @@ SELECT
 	,fm.file_type
 	,fm.file_hash
 	,fm.chunks
+	,fm.chunking
+	,fm.explicit_chunks
 	,fm.current_flag
 	,fm.created_at
 	,fm.end_date
@@ -134,11 +146,382 @@ SELECT
 	,ufs.next_chunk_id
 	,ufs.chunk_blob_url
 	,ufs.chunk_hash
+	,ufs.chunk_offset
+	,ufs.chunk_size
+	,COALESCE(b.stored_size, b.size, ufs.chunk_size) AS chunk_stored_size
 	,ufs.created_at
 	,ufs.updated_at
 FROM file_metadatas fm
 JOIN user_files ufs
 ON
 	ufs.file_id = fm.id
+LEFT JOIN blobs b
+ON
+	b.blob_url = ufs.chunk_blob_url
 WHERE fm.id IN (?)
 ORDER BY fm.created_at DESC
+
+
+--sql:GetFileVersions
+
+WITH RECURSIVE ancestors(id, prev_id) AS (
+	SELECT id, prev_id
+	FROM file_metadatas
+	WHERE id = :file_id
+
+	UNION
+
+	SELECT fm.id, fm.prev_id
+	FROM file_metadatas fm
+	JOIN ancestors a
+	ON
+		fm.id = a.prev_id
+),
+versions(id) AS (
+	SELECT id
+	FROM ancestors
+	WHERE prev_id IS NULL
+
+	UNION
+
+	SELECT fm.id
+	FROM file_metadatas fm
+	JOIN versions v
+	ON
+		fm.prev_id = v.id
+)
+SELECT
+	fm.id
+	,fm.prev_id
+	,fm.file_name
+	,fm.file_size
+	,fm.file_type
+	,fm.file_hash
+	,fm.chunks
+	,fm.current_flag
+	,fm.upload_status
+	,COALESCE(fm.device_id, '') AS device_id
+	,fm.chunking
+	,fm.created_at
+	,fm.end_date
+FROM versions v
+JOIN file_metadatas fm
+ON
+	fm.id = v.id
+ORDER BY fm.created_at DESC;
+
+
+--sql:TrashLineage
+
+UPDATE file_metadatas
+SET
+	deleted_at = :deleted_at
+WHERE id IN (
+	WITH RECURSIVE versions(id) AS (
+		SELECT :lineage_id
+
+		UNION
+
+		SELECT fm.id
+		FROM file_metadatas fm
+		JOIN versions v
+		ON
+			fm.prev_id = v.id
+	)
+	SELECT id FROM versions
+)
+AND deleted_at IS NULL;
+
+
+--sql:IsLineageTrashed
+
+WITH RECURSIVE lineage(id, prev_id, deleted_at) AS (
+	SELECT id, prev_id, deleted_at
+	FROM file_metadatas
+	WHERE id = :file_id
+
+	UNION ALL
+
+	SELECT fm.id, fm.prev_id, fm.deleted_at
+	FROM file_metadatas fm
+	JOIN lineage l
+	ON
+		fm.id = l.prev_id
+)
+SELECT deleted_at IS NOT NULL
+FROM lineage
+WHERE prev_id IS NULL
+LIMIT 1;
+
+
+--sql:RestoreLineage
+
+UPDATE file_metadatas
+SET
+	deleted_at = NULL
+WHERE id IN (
+	WITH RECURSIVE versions(id) AS (
+		SELECT :lineage_id
+
+		UNION
+
+		SELECT fm.id
+		FROM file_metadatas fm
+		JOIN versions v
+		ON
+			fm.prev_id = v.id
+	)
+	SELECT id FROM versions
+)
+AND deleted_at IS NOT NULL;
+
+
+--sql:GetTrashForUser
+
+SELECT
+	id
+	,file_name
+	,file_size
+	,file_type
+	,file_hash
+	,deleted_at
+FROM file_metadatas
+WHERE
+	user_id = :user_id
+AND current_flag = 1
+AND deleted_at IS NOT NULL
+ORDER BY deleted_at DESC;
+
+
+--sql:GetExpiredTrash
+
+SELECT
+	id AS lineage_id
+	,user_id AS owner_id
+FROM file_metadatas
+WHERE
+	prev_id IS NULL
+AND deleted_at IS NOT NULL
+AND deleted_at < :before
+ORDER BY deleted_at
+LIMIT :limit OFFSET :offset;
+
+
+--sql:GetLineageBlobs
+
+SELECT DISTINCT
+	chunk_blob_url
+FROM user_files
+WHERE file_id IN (
+	WITH RECURSIVE versions(id) AS (
+		SELECT :lineage_id
+
+		UNION
+
+		SELECT fm.id
+		FROM file_metadatas fm
+		JOIN versions v
+		ON
+			fm.prev_id = v.id
+	)
+	SELECT id FROM versions
+);
+
+
+--sql:DeleteLineageChunks
+
+DELETE FROM user_files
+WHERE file_id IN (
+	WITH RECURSIVE versions(id) AS (
+		SELECT :lineage_id
+
+		UNION
+
+		SELECT fm.id
+		FROM file_metadatas fm
+		JOIN versions v
+		ON
+			fm.prev_id = v.id
+	)
+	SELECT id FROM versions
+);
+
+
+--sql:DeleteLineageMetadata
+
+DELETE FROM file_metadatas
+WHERE id IN (
+	WITH RECURSIVE versions(id) AS (
+		SELECT :lineage_id
+
+		UNION
+
+		SELECT fm.id
+		FROM file_metadatas fm
+		JOIN versions v
+		ON
+			fm.prev_id = v.id
+	)
+	SELECT id FROM versions
+);
+
+
+--sql:DeleteLineageShares
+
+DELETE FROM file_shares
+WHERE lineage_id = :lineage_id;
+
+
+--sql:DeleteLineageLinks
+
+DELETE FROM share_links
+WHERE lineage_id = :lineage_id;
+
+
+--sql:CountBlobUses
+
+SELECT
+	(SELECT COUNT(1) FROM blobs WHERE blob_url = :blob_url)
+	+ (SELECT COUNT(1) FROM user_files WHERE chunk_blob_url = :blob_url);
+
+
+--sql:MarkUploadFailed
+
+UPDATE file_metadatas
+SET
+	upload_status = 'failed'
+	,updated_at = :updated_at
+WHERE id = :id
+AND upload_status = 'uploading';
+
+
+--sql:GetFileBlobs
+
+SELECT DISTINCT
+	chunk_blob_url
+FROM user_files
+WHERE file_id = :file_id
+AND chunk_blob_url != '';
+
+
+--sql:DeleteFileChunks
+
+DELETE FROM user_files
+WHERE file_id = :file_id;
+
+
+--sql:GetStaleUploads
+
+SELECT
+	id
+FROM file_metadatas
+WHERE
+	upload_status = 'uploading'
+AND created_at < :before
+ORDER BY created_at
+LIMIT :limit OFFSET :offset;
+
+
+--sql:DeleteUnusedBlob
+
+DELETE FROM blobs
+WHERE blob_url = :blob_url
+AND ref_count <= 0
+AND NOT EXISTS (
+	SELECT 1 FROM user_files WHERE chunk_blob_url = :blob_url
+);
+
+
+--sql:GetStorageUsage
+
+WITH versions AS (
+	SELECT
+		id
+		,file_size
+	FROM file_metadatas
+	WHERE user_id = :user_id
+	AND upload_status = 'completed'
+),
+stored AS (
+	SELECT
+		ufs.chunk_blob_url
+		,MAX(COALESCE(b.stored_size, b.size, ufs.chunk_size, 0)) AS size
+	FROM user_files ufs
+	JOIN versions v
+	ON
+		v.id = ufs.file_id
+	LEFT JOIN blobs b
+	ON
+		b.blob_url = ufs.chunk_blob_url
+	WHERE ufs.chunk_blob_url != ''
+	GROUP BY ufs.chunk_blob_url
+)
+SELECT
+	(SELECT COUNT(1) FROM versions) AS versions
+	,(SELECT COALESCE(SUM(file_size), 0) FROM versions) AS logical_bytes
+	,(SELECT COUNT(1) FROM stored) AS blobs
+	,(SELECT COALESCE(SUM(size), 0) FROM stored) AS physical_bytes;
+
+
+--sql:GetReferencedBlobs
+
+SELECT DISTINCT
+	chunk_blob_url
+FROM user_files
+WHERE chunk_blob_url != '';
+
+
+--sql:GetLegacyBlobUrls
+
+SELECT
+	chunk_blob_url
+FROM user_files
+WHERE chunk_blob_url != ''
+AND chunk_blob_url NOT LIKE :uri_pattern
+UNION
+SELECT
+	blob_url
+FROM blobs
+WHERE blob_url NOT LIKE :uri_pattern;
+
+
+--sql:RewriteBlobRecordUrl
+
+UPDATE blobs
+SET
+	blob_url = :to_url
+	,updated_at = CURRENT_TIMESTAMP
+WHERE blob_url = :from_url;
+
+
+--sql:RewriteChunkBlobUrl
+
+UPDATE user_files
+SET chunk_blob_url = :to_url
+WHERE chunk_blob_url = :from_url;
+
+
+--sql:RecountBlobReferences
+
+UPDATE blobs
+SET ref_count = (
+	SELECT COUNT(1)
+	FROM user_files
+	WHERE chunk_blob_url = :to_url
+)
+WHERE blob_url = :to_url;
+
+
+--sql:GetBlobsByUrl
+
+SELECT
+	hash
+	,blob_url
+	,size
+	,codec
+	,COALESCE(stored_size, size) AS stored_size
+	,ref_count
+	,created_at
+	,updated_at
+FROM blobs
+WHERE blob_url IN (?);
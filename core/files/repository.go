@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/rs/zerolog/log"
@@ -25,6 +26,33 @@ const (
 	UpdateCurrentFlagStmt  = "UpdateCurrentFlag"
 	FindByHashStmt         = "FindByHash"
 	SelectFilesForUserStmt = "SelectFilesForUser"
+	GetFileVersionsStmt    = "GetFileVersions"
+
+	TrashLineageStmt          = "TrashLineage"
+	RestoreLineageStmt        = "RestoreLineage"
+	IsLineageTrashedStmt      = "IsLineageTrashed"
+	GetTrashForUserStmt       = "GetTrashForUser"
+	GetExpiredTrashStmt       = "GetExpiredTrash"
+	GetLineageBlobsStmt       = "GetLineageBlobs"
+	DeleteLineageChunksStmt   = "DeleteLineageChunks"
+	DeleteLineageMetadataStmt = "DeleteLineageMetadata"
+	DeleteLineageSharesStmt   = "DeleteLineageShares"
+	DeleteLineageLinksStmt    = "DeleteLineageLinks"
+	CountBlobUsesStmt         = "CountBlobUses"
+	DeleteUnusedBlobStmt      = "DeleteUnusedBlob"
+	GetStorageUsageStmt       = "GetStorageUsage"
+	GetReferencedBlobsStmt    = "GetReferencedBlobs"
+
+	GetLegacyBlobUrlsStmt     = "GetLegacyBlobUrls"
+	RewriteBlobRecordUrlStmt  = "RewriteBlobRecordUrl"
+	RewriteChunkBlobUrlStmt   = "RewriteChunkBlobUrl"
+	RecountBlobReferencesStmt = "RecountBlobReferences"
+	GetBlobsByUrlStmt         = "GetBlobsByUrl"
+
+	MarkUploadFailedStmt = "MarkUploadFailed"
+	GetFileBlobsStmt     = "GetFileBlobs"
+	DeleteFileChunksStmt = "DeleteFileChunks"
+	GetStaleUploadsStmt  = "GetStaleUploads"
 
 	InsertFileChunk = "InsertFileChunk"
 	GetChunksByFile = "GetChunksByFile"
@@ -49,7 +77,9 @@ type MetadataRequest struct {
 	Digest       string `json:"digest"`
 	UploadStatus string `json:"-"`
 	Chunks       int    `json:"chunks"`
+	Chunking     string `json:"chunking"`
 	AccessToken  string `json:"-"`
+	DeviceID     string `json:"-"`
 }
 
 func (slf *MetadataRepository) Create(
@@ -297,6 +327,454 @@ func (mr *MetadataRepository) Update(
 	return tx.Commit()
 }
 
+var ErrVersionMoved = errors.New("current_version_moved")
+
+// RestoreVersion appends the version and its chunks to the lineage, as the
+// current version, in a transaction. The current_flag is only taken off
+// metadata.PrevID if it is still the current version of the file, otherwise
+// nothing is written and ErrVersionMoved is returned.
+func (mr *MetadataRepository) RestoreVersion(
+	ctx context.Context,
+	chunkRepo *UserFileRepository,
+	metadata *FileMetadata,
+	chunks []*UserFile,
+) error {
+
+	flagTmpl, ok := mr.querier.GetQuery(UpdateCurrentFlagStmt)
+	if !ok {
+		return ErrorStmtNotFound
+	}
+
+	createStmt, ok := mr.querier.GetQuery(CreateFileMetadataStmt)
+	if !ok {
+		return ErrorStmtNotFound
+	}
+
+	chunkStmt, ok := chunkRepo.querier.GetQuery(CreateFileChunkStmt)
+	if !ok {
+		return ErrorStmtNotFound
+	}
+
+	tx, err := mr.conn.BeginTxx(ctx, nil)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to init transaction")
+		return err
+	}
+
+	result, err := tx.NamedExecContext(ctx, fmt.Sprintf(flagTmpl, "AND current_flag = 1"), map[string]any{
+		"current_flag":  0,
+		"end_date":      database.Now(),
+		"id":            metadata.PrevID,
+		"upload_status": StatusCompleted,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to unmark current version")
+		tx.Rollback()
+		return err
+	}
+
+	if affected, err := result.RowsAffected(); err != nil || affected != 1 {
+		tx.Rollback()
+		return ErrVersionMoved
+	}
+
+	if _, err := tx.NamedExecContext(ctx, createStmt, metadata); err != nil {
+		log.Error().Err(err).Msg("failed to create restored version")
+		tx.Rollback()
+		return err
+	}
+
+	for _, chunk := range chunks {
+		if _, err := tx.NamedExecContext(ctx, chunkStmt, chunk); err != nil {
+			log.Error().Err(err).Msg("failed to copy version chunks")
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ListVersions returns every version in the lineage of the file, newest first
+func (mr *MetadataRepository) ListVersions(ctx context.Context, fileID string) ([]*FileVersion, error) {
+	versions := []*FileVersion{}
+
+	err := mr.selectAll(ctx, GetFileVersionsStmt, &versions, map[string]any{"file_id": fileID})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to fetch file versions")
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+func (mr *MetadataRepository) selectAll(ctx context.Context, stmtKey string, dest any, args map[string]any) error {
+	stmt, ok := mr.querier.GetQuery(stmtKey)
+	if !ok {
+		return ErrorStmtNotFound
+	}
+
+	nstmt, err := mr.conn.PrepareNamedContext(ctx, stmt)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to prepare named stmt")
+		return err
+	}
+	defer nstmt.Close()
+
+	return nstmt.SelectContext(ctx, dest, args)
+}
+
+// exec returns the number of rows changed by the statement
+func (mr *MetadataRepository) exec(ctx context.Context, stmtKey string, args map[string]any) (int64, error) {
+	stmt, ok := mr.querier.GetQuery(stmtKey)
+	if !ok {
+		return 0, ErrorStmtNotFound
+	}
+
+	result, err := mr.conn.NamedExecContext(ctx, stmt, args)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// TrashLineage marks every version of the file as deleted
+func (mr *MetadataRepository) TrashLineage(ctx context.Context, lineageID string) (int64, error) {
+	return mr.exec(ctx, TrashLineageStmt, map[string]any{
+		"lineage_id": lineageID,
+		"deleted_at": database.Now(),
+	})
+}
+
+// LineageTrashed tells whether the lineage of the file is in the trash,
+// by its root, as the shares do
+func (mr *MetadataRepository) LineageTrashed(ctx context.Context, fileID string) (bool, error) {
+	trashed := []bool{}
+
+	err := mr.selectAll(ctx, IsLineageTrashedStmt, &trashed, map[string]any{
+		"file_id": fileID,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return len(trashed) > 0 && trashed[0], nil
+}
+
+func (mr *MetadataRepository) RestoreLineage(ctx context.Context, lineageID string) (int64, error) {
+	return mr.exec(ctx, RestoreLineageStmt, map[string]any{
+		"lineage_id": lineageID,
+	})
+}
+
+func (mr *MetadataRepository) ListTrash(ctx context.Context, userID string) ([]*TrashedFile, error) {
+	trashed := []*TrashedFile{}
+
+	err := mr.selectAll(ctx, GetTrashForUserStmt, &trashed, map[string]any{"user_id": userID})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list trash")
+		return nil, err
+	}
+
+	return trashed, nil
+}
+
+func (mr *MetadataRepository) ListExpiredTrash(
+	ctx context.Context,
+	before time.Time,
+	limit int,
+	offset int,
+) ([]*TrashedLineage, error) {
+
+	lineages := []*TrashedLineage{}
+
+	err := mr.selectAll(ctx, GetExpiredTrashStmt, &lineages, map[string]any{
+		"before": before,
+		"limit":  limit,
+		"offset": offset,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list expired trash")
+		return nil, err
+	}
+
+	return lineages, nil
+}
+
+// PurgeLineage deletes every version of the file, its chunks, shares and
+// links in a transaction. It returns the blobs the chunks pointed to, which
+// the caller has to remove from the storage once nothing references them.
+func (mr *MetadataRepository) PurgeLineage(ctx context.Context, lineageID string) ([]string, error) {
+	blobsStmt, ok := mr.querier.GetQuery(GetLineageBlobsStmt)
+	if !ok {
+		return nil, ErrorStmtNotFound
+	}
+
+	deleteStmts := []string{}
+
+	for _, stmtKey := range []string{
+		DeleteLineageChunksStmt,
+		DeleteLineageSharesStmt,
+		DeleteLineageLinksStmt,
+		DeleteLineageMetadataStmt,
+	} {
+		stmt, ok := mr.querier.GetQuery(stmtKey)
+		if !ok {
+			return nil, ErrorStmtNotFound
+		}
+
+		deleteStmts = append(deleteStmts, stmt)
+	}
+
+	args := map[string]any{"lineage_id": lineageID}
+
+	tx, err := mr.conn.BeginTxx(ctx, nil)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to init transaction")
+		return nil, err
+	}
+
+	query, queryArgs, err := tx.BindNamed(blobsStmt, args)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	blobs := []string{}
+
+	if err := tx.SelectContext(ctx, &blobs, query, queryArgs...); err != nil {
+		log.Error().Err(err).Msg("failed to fetch lineage blobs")
+		tx.Rollback()
+		return nil, err
+	}
+
+	for _, stmt := range deleteStmts {
+		if _, err := tx.NamedExecContext(ctx, stmt, args); err != nil {
+			log.Error().Err(err).Msg("failed to purge lineage")
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Error().Err(err).Msg("failed to commit purge")
+		return nil, err
+	}
+
+	return blobs, nil
+}
+
+// DeleteUnusedBlob drops the record of the blob if nothing points at it,
+// the check and the delete are one statement. It reports whether the blob
+// can be removed from the storage, which is when its record was deleted,
+// or when it never had one and no chunk points at it. Blobs stored before
+// content addressing don't have a record.
+func (mr *MetadataRepository) DeleteUnusedBlob(ctx context.Context, blobURL string) (bool, error) {
+	deleteStmt, ok := mr.querier.GetQuery(DeleteUnusedBlobStmt)
+	if !ok {
+		return false, ErrorStmtNotFound
+	}
+
+	usesStmt, ok := mr.querier.GetQuery(CountBlobUsesStmt)
+	if !ok {
+		return false, ErrorStmtNotFound
+	}
+
+	args := map[string]any{"blob_url": blobURL}
+
+	tx, err := mr.conn.BeginTxx(ctx, nil)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to init transaction")
+		return false, err
+	}
+
+	result, err := tx.NamedExecContext(ctx, deleteStmt, args)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	if deleted > 0 {
+		return true, tx.Commit()
+	}
+
+	query, queryArgs, err := tx.BindNamed(usesStmt, args)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	var uses int64
+
+	if err := tx.GetContext(ctx, &uses, query, queryArgs...); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	return uses == 0, tx.Commit()
+}
+
+// ListReferencedBlobs returns every blob a chunk of any file points at
+func (mr *MetadataRepository) ListReferencedBlobs(ctx context.Context) ([]string, error) {
+	blobs := []string{}
+
+	err := mr.selectAll(ctx, GetReferencedBlobsStmt, &blobs, map[string]any{})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list referenced blobs")
+		return nil, err
+	}
+
+	return blobs, nil
+}
+
+// ListLegacyBlobUrls returns the chunk and blob urls which are
+// still local paths, from before the blob uris
+func (mr *MetadataRepository) ListLegacyBlobUrls(ctx context.Context) ([]string, error) {
+	urls := []string{}
+
+	// Bound rather than written in the query, where sqlx
+	// would take the colon for the start of a parameter
+	err := mr.selectAll(ctx, GetLegacyBlobUrlsStmt, &urls, map[string]any{
+		"uri_pattern": "%://%",
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list legacy blob urls")
+		return nil, err
+	}
+
+	return urls, nil
+}
+
+// ListBlobsByUrl returns the blob records of the urls, chunks stored
+// before the blobs were recorded have none
+func (mr *MetadataRepository) ListBlobsByUrl(ctx context.Context, urls []string) ([]*Blob, error) {
+	blobs := []*Blob{}
+
+	if len(urls) == 0 {
+		return blobs, nil
+	}
+
+	stmt, ok := mr.querier.GetQuery(GetBlobsByUrlStmt)
+	if !ok {
+		return nil, ErrorStmtNotFound
+	}
+
+	query, args, err := sqlx.In(stmt, urls)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to build in query")
+		return nil, err
+	}
+
+	err = mr.conn.SelectContext(ctx, &blobs, mr.conn.Rebind(query), args...)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list blobs by url")
+		return nil, err
+	}
+
+	return blobs, nil
+}
+
+// RewriteBlobUrl moves the blob record and every chunk pointing at it to
+// the new url, in a transaction. The triggers count the chunks moving to
+// the new url on top of the blob's count, so it is counted again after.
+func (mr *MetadataRepository) RewriteBlobUrl(ctx context.Context, fromURL, toURL string) error {
+	stmts := []string{}
+
+	for _, stmtKey := range []string{
+		RewriteBlobRecordUrlStmt,
+		RewriteChunkBlobUrlStmt,
+		RecountBlobReferencesStmt,
+	} {
+		stmt, ok := mr.querier.GetQuery(stmtKey)
+		if !ok {
+			return ErrorStmtNotFound
+		}
+
+		stmts = append(stmts, stmt)
+	}
+
+	args := map[string]any{"from_url": fromURL, "to_url": toURL}
+
+	tx, err := mr.conn.BeginTxx(ctx, nil)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to init transaction")
+		return err
+	}
+
+	for _, stmt := range stmts {
+		if _, err := tx.NamedExecContext(ctx, stmt, args); err != nil {
+			log.Error().Err(err).Str("blob", fromURL).Msg("failed to rewrite blob url")
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (mr *MetadataRepository) GetStorageUsage(ctx context.Context, userID string) (*StorageUsage, error) {
+	stmt, ok := mr.querier.GetQuery(GetStorageUsageStmt)
+	if !ok {
+		return nil, ErrorStmtNotFound
+	}
+
+	nstmt, err := mr.conn.PrepareNamedContext(ctx, stmt)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to prepare named stmt")
+		return nil, err
+	}
+	defer nstmt.Close()
+
+	usage := &StorageUsage{}
+
+	err = nstmt.GetContext(ctx, usage, map[string]any{"user_id": userID})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to get storage usage")
+		return nil, err
+	}
+
+	usage.SavedBytes = usage.LogicalBytes - usage.PhysicalBytes
+	return usage, nil
+}
+
+// MarkFailed fails the upload of the file, if it is still in progress
+func (mr *MetadataRepository) MarkFailed(ctx context.Context, fileID string) (int64, error) {
+	return mr.exec(ctx, MarkUploadFailedStmt, map[string]any{
+		"id":         fileID,
+		"updated_at": database.Now(),
+	})
+}
+
+// ListStaleUploads returns the files which started uploading before the time
+func (mr *MetadataRepository) ListStaleUploads(
+	ctx context.Context,
+	before time.Time,
+	limit int,
+	offset int,
+) ([]string, error) {
+
+	fileIDs := []string{}
+
+	err := mr.selectAll(ctx, GetStaleUploadsStmt, &fileIDs, map[string]any{
+		"before": before,
+		"limit":  limit,
+		"offset": offset,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list stale uploads")
+		return nil, err
+	}
+
+	return fileIDs, nil
+}
+
 const DefaultLimit = 20
 
 func (slf *MetadataRepository) ListByUserID(
@@ -376,6 +854,38 @@ func (slf *MetadataTokenRepository) CreateMetadataToken(
 
 	log.Info().Msg("create file metadata request and stream token")
 
+	return slf.createMetadataToken(ctx, metadata, token, "", nil)
+}
+
+// CreateVersionToken is CreateMetadataToken for a new version of a file,
+// the chunks it reuses are linked to it in the same transaction
+func (slf *MetadataTokenRepository) CreateVersionToken(
+	ctx context.Context,
+	chunkRepo *UserFileRepository,
+	metadata *FileMetadata,
+	token *tokens.Token,
+	chunks []*UserFile,
+) error {
+
+	log.Info().Int("reused", len(chunks)).Msg("create file version and stream token")
+
+	chunkStmt, ok := chunkRepo.querier.GetQuery(CreateFileChunkStmt)
+	if !ok {
+		log.Error().Msg("failed to create file chunk stmt")
+		return ErrorStmtNotFound
+	}
+
+	return slf.createMetadataToken(ctx, metadata, token, chunkStmt, chunks)
+}
+
+func (slf *MetadataTokenRepository) createMetadataToken(
+	ctx context.Context,
+	metadata *FileMetadata,
+	token *tokens.Token,
+	chunkStmt string,
+	chunks []*UserFile,
+) error {
+
 	metaCreateStmt, ok := slf.metaQuerier.GetQuery(CreateFileMetadataStmt)
 	if !ok {
 		log.Error().Msg("failed to create metadata stmt")
@@ -417,6 +927,14 @@ func (slf *MetadataTokenRepository) CreateMetadataToken(
 		return err
 	}
 
+	for _, chunk := range chunks {
+		if _, err := tx.NamedExecContext(ctx, chunkStmt, chunk); err != nil {
+			log.Error().Err(err).Msg("failed to link reused chunks")
+			tx.Rollback()
+			return err
+		}
+	}
+
 	if err := tx.Commit(); err != nil {
 		log.Error().Err(err).Msg("failed to create metadata or tokens")
 		return err
@@ -427,6 +945,96 @@ func (slf *MetadataTokenRepository) CreateMetadataToken(
 	return nil
 }
 
+var ErrUploadNotInProgress = errors.New("upload_not_in_progress")
+
+// FailUpload marks an upload which is still in progress as failed, deletes
+// the chunks received so far and revokes the stream tokens of the file.
+// It returns the blobs of the deleted chunks.
+func (slf *MetadataTokenRepository) FailUpload(ctx context.Context, fileID string) ([]string, error) {
+	stmts := map[string]string{}
+
+	for _, stmtKey := range []string{
+		MarkUploadFailedStmt,
+		GetFileBlobsStmt,
+		DeleteFileChunksStmt,
+	} {
+		stmt, ok := slf.metaQuerier.GetQuery(stmtKey)
+		if !ok {
+			return nil, ErrorStmtNotFound
+		}
+
+		stmts[stmtKey] = stmt
+	}
+
+	revokeStmt, ok := slf.tokenQuerier.GetQuery(tokens.RevokeResourceTokensStmt)
+	if !ok {
+		return nil, ErrorStmtNotFound
+	}
+
+	now := database.Now()
+
+	tx, err := slf.conn.BeginTxx(ctx, nil)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to init transaction")
+		return nil, err
+	}
+
+	result, err := tx.NamedExecContext(ctx, stmts[MarkUploadFailedStmt], map[string]any{
+		"id":         fileID,
+		"updated_at": now,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to mark upload failed")
+		tx.Rollback()
+		return nil, err
+	}
+
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		tx.Rollback()
+		return nil, ErrUploadNotInProgress
+	}
+
+	args := map[string]any{"file_id": fileID}
+
+	query, queryArgs, err := tx.BindNamed(stmts[GetFileBlobsStmt], args)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	blobs := []string{}
+
+	if err := tx.SelectContext(ctx, &blobs, query, queryArgs...); err != nil {
+		log.Error().Err(err).Msg("failed to fetch upload blobs")
+		tx.Rollback()
+		return nil, err
+	}
+
+	if _, err := tx.NamedExecContext(ctx, stmts[DeleteFileChunksStmt], args); err != nil {
+		log.Error().Err(err).Msg("failed to delete upload chunks")
+		tx.Rollback()
+		return nil, err
+	}
+
+	_, err = tx.NamedExecContext(ctx, revokeStmt, map[string]any{
+		"resource_id":   fileID,
+		"resource_type": tokens.ResourceTypeStream,
+		"revoked_at":    now,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to revoke stream tokens")
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Error().Err(err).Msg("failed to commit failed upload")
+		return nil, err
+	}
+
+	return blobs, nil
+}
+
 // Like Create, It updates the metadata info and creates a new stream token
 func (slf *MetadataTokenRepository) UpdateMetadataToken(
 	ctx context.Context,
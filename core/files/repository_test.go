@@ -1,11 +1,42 @@
 package files
 
 import (
+	"arbokcore/pkg/squirtle"
+	"os"
+	"strings"
 	"testing"
 
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+// newTestMetadataRepository runs the files schema on an in memory sqlite
+func newTestMetadataRepository(t *testing.T) (*sqlx.DB, *MetadataRepository) {
+	db, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	// Every connection to :memory: is another database
+	db.SetMaxOpenConns(1)
+
+	schema, err := os.ReadFile("../../migrations/sqlite/files/schema.up.sql")
+	require.NoError(t, err)
+
+	for _, stmt := range strings.Split(string(schema), "---") {
+		_, err := db.Exec(strings.TrimSpace(stmt))
+		require.NoError(t, err)
+	}
+
+	querier, err := squirtle.QueryConfigStore{
+		{Table: "file_metadatas", QueryFilePaths: []string{"./queries.metadata.sql"}},
+	}.HydrateQueryStore("file_metadatas")
+	require.NoError(t, err)
+
+	return db, NewMetadataRepository(db, querier)
+}
+
 func Test_ClauseStr(t *testing.T) {
 
 	t.Run("when clauses are empty", func(t *testing.T) {
@@ -0,0 +1,80 @@
+package files
+
+import (
+	"arbokcore/pkg/blobstore"
+	"context"
+	"errors"
+
+	"github.com/rs/zerolog/log"
+)
+
+var ErrCompressionReportFailed = errors.New("internal_error:2069:500")
+
+// FileCompression compares the size of a file with the size its chunks
+// are stored in. Ratio is how many times smaller the file is stored,
+// deduplication isn't counted, a chunk shared with other files counts
+// in full for each of them.
+type FileCompression struct {
+	FileID           string         `json:"fileID"`
+	Chunks           int            `json:"chunks"`
+	CompressedChunks int            `json:"compressedChunks"`
+	LogicalBytes     int64          `json:"logicalBytes"`
+	StoredBytes      int64          `json:"storedBytes"`
+	Ratio            float64        `json:"ratio"`
+	Codecs           map[string]int `json:"codecs"`
+}
+
+// BuildFileCompression adds up the chunks of the file with their blobs.
+// Chunks without a blob record were stored before compression.
+func BuildFileCompression(fileID string, spans []*ChunkSpan, blobs []*Blob) *FileCompression {
+	byUrl := map[string]*Blob{}
+	for _, blob := range blobs {
+		byUrl[blob.BlobUrl] = blob
+	}
+
+	report := &FileCompression{FileID: fileID, Ratio: 1, Codecs: map[string]int{}}
+
+	for _, span := range spans {
+		codec, storedSize := blobstore.CodecNone, span.Size
+
+		if blob, ok := byUrl[span.Url]; ok {
+			codec, storedSize = blob.Codec, blob.StoredSize
+		}
+
+		report.Chunks += 1
+		report.LogicalBytes += span.Size
+		report.StoredBytes += storedSize
+		report.Codecs[codec] += 1
+
+		if codec != blobstore.CodecNone {
+			report.CompressedChunks += 1
+		}
+	}
+
+	if report.StoredBytes > 0 {
+		report.Ratio = float64(report.LogicalBytes) / float64(report.StoredBytes)
+	}
+
+	return report
+}
+
+// FileCompression reports how well the chunks of the file compressed
+func (ms MetadataService) FileCompression(ctx context.Context, fileID string, userID string) (*FileCompression, error) {
+	spans, _, err := ms.ListFileSpans(ctx, fileID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	urls := []string{}
+	for _, span := range spans {
+		urls = append(urls, span.Url)
+	}
+
+	blobs, err := ms.repo.ListBlobsByUrl(ctx, urls)
+	if err != nil {
+		log.Error().Err(err).Str("fileID", fileID).Msg("failed to get file blobs")
+		return nil, ErrCompressionReportFailed
+	}
+
+	return BuildFileCompression(fileID, spans, blobs), nil
+}
@@ -0,0 +1,40 @@
+package files
+
+import (
+	"arbokcore/pkg/blobstore"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_BuildFileCompression(t *testing.T) {
+	spans := []*ChunkSpan{
+		{ChunkID: 0, Url: "local://blobs/aa/aa", Offset: 0, Size: 1000},
+		{ChunkID: 1, Url: "local://blobs/bb/bb", Offset: 1000, Size: 1000},
+		{ChunkID: 2, Url: "local://File1/2", Offset: 2000, Size: 500},
+	}
+
+	blobs := []*Blob{
+		{BlobUrl: "local://blobs/aa/aa", Size: 1000, Codec: blobstore.CodecZstd, StoredSize: 100},
+		{BlobUrl: "local://blobs/bb/bb", Size: 1000, Codec: blobstore.CodecNone, StoredSize: 1000},
+	}
+
+	report := BuildFileCompression("File1", spans, blobs)
+
+	require.Equal(t, &FileCompression{
+		FileID:           "File1",
+		Chunks:           3,
+		CompressedChunks: 1,
+		LogicalBytes:     2500,
+		StoredBytes:      1600,
+		Ratio:            2500.0 / 1600.0,
+		Codecs:           map[string]int{blobstore.CodecZstd: 1, blobstore.CodecNone: 2},
+	}, report)
+
+	t.Run("an empty file", func(t *testing.T) {
+		report := BuildFileCompression("File2", nil, nil)
+
+		require.Equal(t, float64(1), report.Ratio)
+		require.Zero(t, report.StoredBytes)
+	})
+}
@@ -0,0 +1,165 @@
+package files
+
+import (
+	"arbokcore/core/database"
+	"context"
+	"errors"
+	"regexp"
+)
+
+// Before uploading a new version, the client can send the hashes of all the
+// chunks of the file, in order. The chunks already stored are linked to the
+// new version right away, and the client only uploads the ones still needed.
+
+var (
+	ErrInvalidManifest = errors.New("invalid_chunk_manifest:2062:422")
+	ErrDeltaFailed     = errors.New("internal_error:2063:500")
+)
+
+var chunkHashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+type ManifestChunk struct {
+	ChunkID int64
+	Hash    string
+	Offset  int64
+	Size    int64
+}
+
+// BuildChunkManifest lays out the chunks of the file. Fixed chunks have
+// their sizes from the file size, content defined chunks send theirs.
+// Either way the sizes have to add up to the file size.
+func BuildChunkManifest(
+	chunking string,
+	fileSize int64,
+	hashes []string,
+	sizes []int64,
+) ([]*ManifestChunk, error) {
+
+	nChunks := len(hashes)
+
+	if chunking != ChunkingCDC {
+		sizes = []int64{}
+
+		for i := 0; i < nChunks; i++ {
+			sizes = append(sizes, min(FrontendChunkSize, fileSize-int64(i)*FrontendChunkSize))
+		}
+	}
+
+	if len(sizes) != nChunks {
+		return nil, ErrInvalidManifest
+	}
+
+	manifest := []*ManifestChunk{}
+	offset := int64(0)
+
+	for i, hash := range hashes {
+		if !chunkHashPattern.MatchString(hash) || sizes[i] <= 0 {
+			return nil, ErrInvalidManifest
+		}
+
+		manifest = append(manifest, &ManifestChunk{
+			ChunkID: int64(i),
+			Hash:    hash,
+			Offset:  offset,
+			Size:    sizes[i],
+		})
+
+		offset += sizes[i]
+	}
+
+	if offset != fileSize {
+		return nil, ErrInvalidManifest
+	}
+
+	return manifest, nil
+}
+
+// PlanChunkReuse links the chunks of the manifest to the stored chunks with
+// the same hash and size, and returns the ids of the chunks left to upload.
+// The linked chunks are the owner's, whoever uploads the version.
+func PlanChunkReuse(
+	ownerID string,
+	fileID string,
+	manifest []*ManifestChunk,
+	stored []*UserFile,
+) ([]*UserFile, []int64) {
+
+	byHash := map[string]*UserFile{}
+
+	for _, chunk := range stored {
+		if chunk.ChunkBlobUrl == "" {
+			continue
+		}
+
+		if _, ok := byHash[chunk.ChunkHash]; !ok {
+			byHash[chunk.ChunkHash] = chunk
+		}
+	}
+
+	reused := []*UserFile{}
+	needed := []int64{}
+
+	for _, entry := range manifest {
+		found, ok := byHash[entry.Hash]
+
+		// Older chunks don't have a size, the hash is enough for those
+		if !ok || (found.ChunkSize != nil && *found.ChunkSize != entry.Size) {
+			needed = append(needed, entry.ChunkID)
+			continue
+		}
+
+		nextChunkID := entry.ChunkID + 1
+		if int(nextChunkID) == len(manifest) {
+			nextChunkID = -1
+		}
+
+		offset, size := entry.Offset, entry.Size
+
+		reused = append(reused, &UserFile{
+			UserID:       ownerID,
+			FileID:       fileID,
+			ChunkID:      entry.ChunkID,
+			ChunkBlobUrl: found.ChunkBlobUrl,
+			ChunkHash:    entry.Hash,
+			NextChunkID:  &nextChunkID,
+			ChunkOffset:  &offset,
+			ChunkSize:    &size,
+			Timestamp:    database.NewTimestamp(),
+		})
+	}
+
+	return reused, needed
+}
+
+// storedChunks finds the chunks the new version can reuse, from the previous
+// version and, if asked for, from every other file of the owner
+func (ms *MetadataService) storedChunks(
+	ctx context.Context,
+	prevMetadata *FileMetadata,
+	manifest []*ManifestChunk,
+	fromAccount bool,
+) ([]*UserFile, error) {
+
+	chunks, err := ms.chunkRepo.GetChunksForFile(ctx, prevMetadata.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := LatestChunks(chunks, prevMetadata.NChunks)
+
+	if !fromAccount {
+		return stored, nil
+	}
+
+	hashes := []string{}
+	for _, entry := range manifest {
+		hashes = append(hashes, entry.Hash)
+	}
+
+	accountChunks, err := ms.chunkRepo.FindOwnerChunksByHash(ctx, prevMetadata.UserID, hashes)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(stored, accountChunks...), nil
+}
@@ -0,0 +1,95 @@
+package files
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testHash(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func Test_BuildChunkManifest(t *testing.T) {
+	hashes := []string{testHash("a"), testHash("b"), testHash("c")}
+
+	t.Run("fixed chunks are sized from the file size", func(t *testing.T) {
+		fileSize := 2*FrontendChunkSize + 10
+
+		manifest, err := BuildChunkManifest(ChunkingFixed, fileSize, hashes, nil)
+		require.NoError(t, err)
+		require.Len(t, manifest, 3)
+
+		require.Equal(t, int64(2), manifest[2].ChunkID)
+		require.Equal(t, 2*FrontendChunkSize, manifest[2].Offset)
+		require.Equal(t, int64(10), manifest[2].Size)
+	})
+
+	t.Run("content defined chunks send their sizes", func(t *testing.T) {
+		manifest, err := BuildChunkManifest(ChunkingCDC, 60, hashes, []int64{10, 20, 30})
+		require.NoError(t, err)
+
+		require.Equal(t, int64(30), manifest[2].Offset)
+		require.Equal(t, int64(30), manifest[2].Size)
+	})
+
+	t.Run("sizes have to add up to the file size", func(t *testing.T) {
+		_, err := BuildChunkManifest(ChunkingCDC, 61, hashes, []int64{10, 20, 30})
+		require.ErrorIs(t, err, ErrInvalidManifest)
+
+		_, err = BuildChunkManifest(ChunkingCDC, 60, hashes, []int64{30, 30})
+		require.ErrorIs(t, err, ErrInvalidManifest)
+
+		_, err = BuildChunkManifest(ChunkingFixed, 10, hashes, nil)
+		require.ErrorIs(t, err, ErrInvalidManifest)
+	})
+
+	t.Run("hashes are sha256 hex digests", func(t *testing.T) {
+		_, err := BuildChunkManifest(ChunkingCDC, 60, []string{"a", "b", "c"}, []int64{10, 20, 30})
+		require.ErrorIs(t, err, ErrInvalidManifest)
+	})
+}
+
+func Test_PlanChunkReuse(t *testing.T) {
+	manifest, err := BuildChunkManifest(
+		ChunkingCDC, 60,
+		[]string{testHash("new"), testHash("a"), testHash("b")},
+		[]int64{10, 20, 30},
+	)
+	require.NoError(t, err)
+
+	size := int64(20)
+	wrongSize := int64(31)
+
+	stored := []*UserFile{
+		{FileID: "Prev", ChunkID: 0, ChunkHash: testHash("a"), ChunkBlobUrl: "/prev/0", ChunkSize: &size},
+		{FileID: "Prev", ChunkID: 1, ChunkHash: testHash("b"), ChunkBlobUrl: "/prev/1", ChunkSize: &wrongSize},
+		{FileID: "Other", ChunkID: 4, ChunkHash: testHash("new"), ChunkBlobUrl: ""},
+	}
+
+	reused, needed := PlanChunkReuse("User1", "File2", manifest, stored)
+
+	require.Equal(t, []int64{0, 2}, needed)
+	require.Len(t, reused, 1)
+
+	chunk := reused[0]
+	require.Equal(t, "File2", chunk.FileID)
+	require.Equal(t, "User1", chunk.UserID)
+	require.Equal(t, int64(1), chunk.ChunkID)
+	require.Equal(t, "/prev/0", chunk.ChunkBlobUrl)
+	require.Equal(t, int64(2), *chunk.NextChunkID)
+	require.Equal(t, int64(10), *chunk.ChunkOffset)
+	require.Equal(t, int64(20), *chunk.ChunkSize)
+
+	t.Run("the last chunk ends the chain", func(t *testing.T) {
+		stored := []*UserFile{{ChunkHash: testHash("b"), ChunkBlobUrl: "/prev/1"}}
+
+		reused, needed := PlanChunkReuse("User1", "File2", manifest, stored)
+
+		require.Equal(t, []int64{0, 1}, needed)
+		require.Equal(t, int64(-1), *reused[0].NextChunkID)
+	})
+}
@@ -0,0 +1,151 @@
+package files
+
+import (
+	"arbokcore/pkg/blobstore"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Failed uploads, chunks uploaded twice and blobs whose cleanup failed all
+// leave files in the storage which no chunk points at. The collector marks
+// every blob referenced from user_files, then sweeps the storage and deletes
+// the rest. Blobs younger than the grace period are left alone, their chunk
+// row might not be written yet.
+
+var ErrBlobGCFailed = errors.New("blob_gc_failed")
+
+type GCReport struct {
+	DryRun     bool `json:"dryRun"`
+	Scanned    int  `json:"scanned"`
+	Referenced int  `json:"referenced"`
+	Young      int  `json:"young"`
+	Orphaned   int  `json:"orphaned"`
+	Deleted    int  `json:"deleted"`
+	Failed     int  `json:"failed"`
+
+	// In a dry run, the bytes which would have been reclaimed
+	ReclaimedBytes int64 `json:"reclaimedBytes"`
+}
+
+// FindOrphanedBlobs picks the blobs which aren't referenced
+// and were last written before the cutoff
+func FindOrphanedBlobs(
+	blobs []*blobstore.BlobInfo,
+	referenced map[string]bool,
+	cutoff time.Time,
+	report *GCReport,
+) []*blobstore.BlobInfo {
+
+	orphans := []*blobstore.BlobInfo{}
+
+	for _, blob := range blobs {
+		report.Scanned += 1
+
+		if referenced[blob.Path] {
+			report.Referenced += 1
+			continue
+		}
+
+		if blob.ModTime.After(cutoff) {
+			report.Young += 1
+			continue
+		}
+
+		report.Orphaned += 1
+		orphans = append(orphans, blob)
+	}
+
+	return orphans
+}
+
+type BlobCollector struct {
+	repo    *MetadataRepository
+	storage blobstore.BlobStorage
+}
+
+func NewBlobCollector(repo *MetadataRepository, storage blobstore.BlobStorage) *BlobCollector {
+	return &BlobCollector{repo: repo, storage: storage}
+}
+
+func (slf *BlobCollector) Collect(ctx context.Context, grace time.Duration, dryRun bool) (*GCReport, error) {
+	report := &GCReport{DryRun: dryRun}
+
+	// The cutoff is taken before marking, anything written
+	// after it is young no matter what the mark saw
+	cutoff := time.Now().Add(-grace)
+
+	urls, err := slf.repo.ListReferencedBlobs(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list referenced blobs")
+		return report, ErrBlobGCFailed
+	}
+
+	referenced := map[string]bool{}
+	for _, url := range urls {
+		// The storage lists uris, a path would never match and its
+		// blob would be taken for an orphan
+		if blobstore.IsLegacyPath(url) {
+			log.Error().Str("blob", url).Msg("blob urls are not migrated, run migrate-blob-uris first")
+			return report, ErrBlobGCFailed
+		}
+
+		referenced[url] = true
+	}
+
+	// Deleting while walking would remove directories under the walk
+	blobs := []*blobstore.BlobInfo{}
+
+	err = slf.storage.ListBlobs(ctx, func(blob *blobstore.BlobInfo) error {
+		blobs = append(blobs, blob)
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list blobs")
+		return report, ErrBlobGCFailed
+	}
+
+	orphans := FindOrphanedBlobs(blobs, referenced, cutoff, report)
+
+	for _, blob := range orphans {
+		if dryRun {
+			log.Info().Str("blob", blob.Path).Int64("size", blob.Size).Msg("would delete orphaned blob")
+
+			report.ReclaimedBytes += blob.Size
+			continue
+		}
+
+		if !slf.remove(ctx, blob.Path) {
+			report.Failed += 1
+			continue
+		}
+
+		report.Deleted += 1
+		report.ReclaimedBytes += blob.Size
+	}
+
+	return report, nil
+}
+
+// remove checks the references again, a chunk could have
+// been linked to the blob since the mark
+func (slf *BlobCollector) remove(ctx context.Context, blob string) bool {
+	removable, err := slf.repo.DeleteUnusedBlob(ctx, blob)
+	if err != nil {
+		log.Error().Err(err).Str("blob", blob).Msg("failed to delete blob record")
+		return false
+	}
+
+	if !removable {
+		return false
+	}
+
+	if err := slf.storage.DeleteChunk(ctx, blob); err != nil {
+		log.Error().Err(err).Str("blob", blob).Msg("failed to delete blob")
+		return false
+	}
+
+	return true
+}
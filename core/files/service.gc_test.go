@@ -0,0 +1,36 @@
+package files
+
+import (
+	"arbokcore/pkg/blobstore"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_FindOrphanedBlobs(t *testing.T) {
+	now := time.Now()
+	cutoff := now.Add(-time.Hour)
+
+	blobs := []*blobstore.BlobInfo{
+		{Path: "/store/F1/0", Size: 10, ModTime: now.Add(-2 * time.Hour)},
+		{Path: "/store/F1/1", Size: 20, ModTime: now.Add(-2 * time.Hour)},
+		{Path: "/store/F2/0", Size: 30, ModTime: now.Add(-time.Minute)},
+		{Path: "/store/F3/0", Size: 40, ModTime: now.Add(-3 * time.Hour)},
+	}
+
+	referenced := map[string]bool{"/store/F1/0": true}
+
+	report := &GCReport{}
+	orphans := FindOrphanedBlobs(blobs, referenced, cutoff, report)
+
+	require.Equal(t, []*blobstore.BlobInfo{blobs[1], blobs[3]}, orphans)
+	require.Equal(t, &GCReport{Scanned: 4, Referenced: 1, Young: 1, Orphaned: 2}, report)
+
+	t.Run("nothing stored", func(t *testing.T) {
+		report := &GCReport{}
+
+		require.Empty(t, FindOrphanedBlobs(nil, referenced, cutoff, report))
+		require.Equal(t, &GCReport{}, report)
+	})
+}
@@ -0,0 +1,135 @@
+package files
+
+import (
+	"arbokcore/pkg/urlsigner"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The manifest lists the chunks of the file with a signed url for each, so
+// a client can fetch the chunks in parallel, check each one against its
+// hash, and only fetch again the ones which failed. The urls are short
+// lived and carry no token, anyone holding one can fetch the chunk.
+
+var (
+	ErrChunkNotFound   = errors.New("chunk_not_found:2066:404")
+	ErrInvalidChunkURL = errors.New("invalid_chunk_url:2067:403")
+	ErrChunkURLExpired = errors.New("chunk_url_expired:2068:403")
+)
+
+const ChunkURLExpiry = 15 * time.Minute
+
+func ChunkURLPath(fileID string, chunkID int64) string {
+	return fmt.Sprintf("/blobs/chunks/%s/%d", fileID, chunkID)
+}
+
+type ManifestEntry struct {
+	ChunkID int64  `json:"chunkID"`
+	Offset  int64  `json:"offset"`
+	Size    int64  `json:"size"`
+	Hash    string `json:"sha256"`
+	Url     string `json:"url"`
+}
+
+type DownloadManifest struct {
+	FileID    string           `json:"fileID"`
+	Name      string           `json:"fileName"`
+	Hash      string           `json:"fileHash"`
+	Size      int64            `json:"fileSize"`
+	Type      string           `json:"fileType"`
+	Chunking  string           `json:"chunking"`
+	ExpiresAt time.Time        `json:"expiresAt"`
+	Chunks    []*ManifestEntry `json:"chunks"`
+}
+
+func BuildDownloadManifest(
+	info *FileInfoResponse,
+	spans []*ChunkSpan,
+	signer *urlsigner.Signer,
+	ttl time.Duration,
+) *DownloadManifest {
+
+	manifest := &DownloadManifest{
+		FileID:   info.ID,
+		Name:     info.Name,
+		Hash:     info.Hash,
+		Size:     info.Size,
+		Type:     info.Type,
+		Chunking: info.Chunking,
+		Chunks:   []*ManifestEntry{},
+	}
+
+	for _, span := range spans {
+		url, expiresAt := signer.Sign(ChunkURLPath(info.ID, span.ChunkID), ttl)
+		manifest.ExpiresAt = expiresAt
+
+		manifest.Chunks = append(manifest.Chunks, &ManifestEntry{
+			ChunkID: span.ChunkID,
+			Offset:  span.Offset,
+			Size:    span.Size,
+			Hash:    span.Hash,
+			Url:     url,
+		})
+	}
+
+	return manifest
+}
+
+// VerifyChunkURL maps the errors of the signer to responses
+func VerifyChunkURL(signer *urlsigner.Signer, path string, query map[string][]string) error {
+	err := signer.Verify(path, query)
+
+	if errors.Is(err, urlsigner.ErrExpired) {
+		return ErrChunkURLExpired
+	}
+
+	if err != nil {
+		return ErrInvalidChunkURL
+	}
+
+	return nil
+}
+
+// FindChunkSpan looks up a chunk of a signed url. Access to the
+// file was checked when the url was signed, so the owner isn't.
+// A file trashed since isn't served anymore.
+func (ms MetadataService) FindChunkSpan(ctx context.Context, fileID string, chunkID int64) (*ChunkSpan, error) {
+	trashed, err := ms.repo.LineageTrashed(ctx, fileID)
+	if err != nil {
+		log.Error().Err(err).Str("file_id", fileID).Msg("failed to look up the lineage")
+		return nil, errors.New("internal_error:2025:500")
+	}
+
+	if trashed {
+		return nil, ErrChunkNotFound
+	}
+
+	filesWithChunks, err := ms.repo.SelectFiles(ctx, []*string{&fileID})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to get files with chunks")
+		return nil, errors.New("internal_error:2025:500")
+	}
+
+	for _, info := range BuildFilesInfoResponse(filesWithChunks) {
+		if info.ID != fileID {
+			continue
+		}
+
+		spans, err := BuildChunkSpans(info)
+		if err != nil {
+			return nil, err
+		}
+
+		if chunkID < 0 || chunkID >= int64(len(spans)) {
+			return nil, ErrChunkNotFound
+		}
+
+		return spans[chunkID], nil
+	}
+
+	return nil, ErrChunkNotFound
+}
@@ -0,0 +1,74 @@
+package files
+
+import (
+	"arbokcore/pkg/urlsigner"
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_BuildDownloadManifest(t *testing.T) {
+	signer := urlsigner.New([]byte("secret"))
+
+	info := &FileInfoResponse{ID: "File1", Name: "a.txt", Hash: "fh", Size: 9, Chunking: ChunkingCDC}
+	spans := []*ChunkSpan{
+		{ChunkID: 0, Url: "/store/c0", Hash: "h0", Offset: 0, Size: 3},
+		{ChunkID: 1, Url: "/store/c1", Hash: "h1", Offset: 3, Size: 6},
+	}
+
+	manifest := BuildDownloadManifest(info, spans, signer, time.Minute)
+
+	require.Equal(t, "File1", manifest.FileID)
+	require.Equal(t, ChunkingCDC, manifest.Chunking)
+	require.WithinDuration(t, time.Now().Add(time.Minute), manifest.ExpiresAt, 2*time.Second)
+	require.Len(t, manifest.Chunks, 2)
+
+	for i, entry := range manifest.Chunks {
+		require.Equal(t, spans[i].ChunkID, entry.ChunkID)
+		require.Equal(t, spans[i].Offset, entry.Offset)
+		require.Equal(t, spans[i].Size, entry.Size)
+		require.Equal(t, spans[i].Hash, entry.Hash)
+
+		// The storage path of the chunk isn't given out
+		path, rawQuery, _ := strings.Cut(entry.Url, "?")
+		require.Equal(t, ChunkURLPath("File1", spans[i].ChunkID), path)
+
+		query, err := url.ParseQuery(rawQuery)
+		require.NoError(t, err)
+
+		require.NoError(t, VerifyChunkURL(signer, path, query))
+		require.ErrorIs(t, VerifyChunkURL(signer, ChunkURLPath("File2", spans[i].ChunkID), query), ErrInvalidChunkURL)
+	}
+}
+
+func Test_FindChunkSpan(t *testing.T) {
+	ctx := context.Background()
+	db, repo := newTestMetadataRepository(t)
+
+	for _, stmt := range []string{
+		"INSERT INTO file_metadatas (id, prev_id, user_id, file_name, file_size, file_type, file_hash, chunks) VALUES ('F1', NULL, 'U1', 'a.txt', 3, 'text/plain', 'h', 1)",
+		"INSERT INTO file_metadatas (id, prev_id, user_id, file_name, file_size, file_type, file_hash, chunks) VALUES ('F2', 'F1', 'U1', 'a.txt', 3, 'text/plain', 'h', 1)",
+		"INSERT INTO user_files (file_id, chunk_id, chunk_blob_url, chunk_hash, chunk_offset, chunk_size) VALUES ('F2', 0, 'local://F2/0', 'h', 0, 3)",
+	} {
+		_, err := db.Exec(stmt)
+		require.NoError(t, err)
+	}
+
+	service := NewMetadataService(repo, nil, nil, nil)
+
+	span, err := service.FindChunkSpan(ctx, "F2", 0)
+	require.NoError(t, err)
+	require.Equal(t, "local://F2/0", span.Url)
+
+	t.Run("a trashed file isn't served", func(t *testing.T) {
+		_, err := repo.TrashLineage(ctx, "F1")
+		require.NoError(t, err)
+
+		_, err = service.FindChunkSpan(ctx, "F2", 0)
+		require.ErrorIs(t, err, ErrChunkNotFound)
+	})
+}
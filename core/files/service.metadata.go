@@ -20,18 +20,21 @@ import (
 type MetadataService struct {
 	repo           *MetadataRepository
 	metaTokensRepo *MetadataTokenRepository
+	chunkRepo      *UserFileRepository
 	queue          queuer.Queuer
 }
 
 func NewMetadataService(
 	repo *MetadataRepository,
 	metaTokensRepo *MetadataTokenRepository,
+	chunkRepo *UserFileRepository,
 	queue queuer.Queuer,
 ) *MetadataService {
 
 	return &MetadataService{
 		repo:           repo,
 		metaTokensRepo: metaTokensRepo,
+		chunkRepo:      chunkRepo,
 		queue:          queue,
 	}
 }
@@ -90,6 +93,22 @@ func (ms MetadataService) ListOrderedFileChunks(ctx context.Context, fileID stri
 	return chunks, fileInfoResp, nil
 }
 
+// ListFileSpans lays out the chunks of the file for a download
+func (ms MetadataService) ListFileSpans(ctx context.Context, fileID string, userID string) ([]*ChunkSpan, *FileInfoResponse, error) {
+	_, fileInfoResp, err := ms.ListOrderedFileChunks(ctx, fileID, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	spans, err := BuildChunkSpans(fileInfoResp)
+	if err != nil {
+		log.Error().Err(err).Str("fileID", fileID).Msg("chunks don't cover the file")
+		return nil, nil, err
+	}
+
+	return spans, fileInfoResp, nil
+}
+
 func (ms *MetadataService) MarkUploadComplete(
 	ctx context.Context,
 	userFileDevice *tokens.UserFileDevice,
@@ -153,7 +172,10 @@ func (ms *MetadataService) PrepareFileForUpload(
 
 	log.Info().Msg("adding file metadata to db")
 
-	chunks := CalculateChunks(req.FileSize)
+	chunking, err := NormalizeChunking(req.Chunking)
+	if err != nil {
+		return api.BuildResponse(err, nil)
+	}
 
 	found, err := ms.repo.FindByHash(ctx, req.Digest)
 	if err != nil {
@@ -173,7 +195,7 @@ func (ms *MetadataService) PrepareFileForUpload(
 		return api.BuildResponse(errors.New("id_gen_failed:2002:500"), nil)
 	}
 
-	if chunks != req.Chunks {
+	if !ValidChunkCount(chunking, req.FileSize, req.Chunks) {
 		log.Error().Msg("number of chunk mismatch")
 		return api.BuildResponse(errors.New("chunks_size_invalid:2005:422"), nil)
 	}
@@ -185,9 +207,11 @@ func (ms *MetadataService) PrepareFileForUpload(
 		FileSize:    req.FileSize,
 		FileType:    req.FileType,
 		FileHash:    req.Digest,
-		NChunks:     int(chunks),
+		NChunks:     req.Chunks,
+		Chunking:    chunking,
 		UploadStaus: req.UploadStatus,
 		CurrentFlag: false,
+		DeviceID:    req.DeviceID,
 		Timestamp:   database.NewTimestamp(),
 	}
 
@@ -238,6 +262,8 @@ type MetadataTokenResponse struct {
 	UploadStatus string        `json:"uploadStatus"`
 	CreatedAt    time.Time     `json:"createdAt"`
 	ExpiresIn    time.Duration `json:"expiresAt"`
+	// Only when the client sent the hashes of its chunks
+	NeededChunks []int64 `json:"neededChunks,omitempty"`
 }
 
 // Get the previous fileID from :fileID
@@ -249,14 +275,31 @@ func (ms *MetadataService) UpdateFileMetadata(
 ) api.Response {
 	// So here the update also needs to
 	// Create a new token and return the same response as Create
-	chunks := CalculateChunks(req.FileSize)
-	if chunks != int(req.Chunks) {
+	chunking, err := NormalizeChunking(req.Chunking)
+	if err != nil {
+		return api.BuildResponse(err, nil)
+	}
+
+	if !ValidChunkCount(chunking, req.FileSize, int(req.Chunks)) {
 		return api.BuildResponse(
 			errors.New("invalid_file_data:2006:422"),
 			nil,
 		)
 	}
 
+	var manifest []*ManifestChunk
+
+	if len(req.ChunkHashes) > 0 {
+		if len(req.ChunkHashes) != int(req.Chunks) {
+			return api.BuildResponse(ErrInvalidManifest, nil)
+		}
+
+		manifest, err = BuildChunkManifest(chunking, req.FileSize, req.ChunkHashes, req.ChunkSizes)
+		if err != nil {
+			return api.BuildResponse(err, nil)
+		}
+	}
+
 	results, err := ms.repo.FindBy(ctx, FindClause{
 		{Key: "id", Operator: "=", Val: req.FileID},
 	})
@@ -287,22 +330,47 @@ func (ms *MetadataService) UpdateFileMetadata(
 
 	log.Info().Str("prevm", prevMetadata.ID).Str("reqfi", req.FileID)
 
+	// The new version stays with the owner of the file, even when
+	// it is uploaded by someone the file is shared with
 	metadata := &FileMetadata{
 		ID:          id,
 		PrevID:      &req.FileID,
-		UserID:      req.UserID,
+		UserID:      prevMetadata.UserID,
 		FileSize:    req.FileSize,
 		FileType:    prevMetadata.FileType,
 		Filename:    prevMetadata.Filename,
 		FileHash:    req.Digest,
 		NChunks:     int(req.Chunks),
+		Chunking:    chunking,
 		CurrentFlag: false,
 		UploadStaus: StatusUploading,
+		DeviceID:    req.DeviceID,
 		Timestamp:   database.NewTimestamp(),
 	}
 
 	// fmt.Printf("updated metadata %+v\n", metadata)
 
+	var (
+		reusedChunks []*UserFile
+		neededChunks []int64
+	)
+
+	if manifest != nil {
+		// Looking through the whole account is only for the owner, a hash
+		// must not give someone else the content of the owner's other files
+		fromAccount := req.ReuseFromAccount && req.UserID == prevMetadata.UserID
+
+		stored, err := ms.storedChunks(ctx, prevMetadata, manifest, fromAccount)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to find stored chunks")
+			return api.BuildResponse(ErrDeltaFailed, nil)
+		}
+
+		// The reused chunks belong to the version, so to its owner
+		reusedChunks, neededChunks = PlanChunkReuse(metadata.UserID, metadata.ID, manifest, stored)
+		metadata.ExplicitChunks = true
+	}
+
 	token, err := tokens.NewToken(
 		metadata.ID, tokens.ResourceTypeStream,
 		tokens.WithDefaultExpiry(),
@@ -316,10 +384,12 @@ func (ms *MetadataService) UpdateFileMetadata(
 		)
 	}
 
-	if err := ms.metaTokensRepo.CreateMetadataToken(
+	if err := ms.metaTokensRepo.CreateVersionToken(
 		ctx,
+		ms.chunkRepo,
 		metadata,
 		token,
+		reusedChunks,
 	); err != nil {
 		log.Error().Err(err).Msg("failed to create metadata and token")
 		return api.BuildResponse(
@@ -335,9 +405,59 @@ func (ms *MetadataService) UpdateFileMetadata(
 		CreatedAt:    token.CreatedAt,
 		UploadStatus: StatusUploading,
 		ExpiresIn:    tokens.ShortExpiryDuration,
+		NeededChunks: neededChunks,
 	})
 }
 
+var (
+	ErrVersionNotFound    = errors.New("version_not_found:2047:404")
+	ErrVersionUnavailable = errors.New("version_unavailable:2048:409")
+	ErrVersionsFailed     = errors.New("internal_error:2049:500")
+)
+
+func (ms *MetadataService) ListVersions(ctx context.Context, fileID string) ([]*FileVersion, error) {
+	versions, err := ms.repo.ListVersions(ctx, fileID)
+	if err != nil {
+		return nil, ErrVersionsFailed
+	}
+
+	if len(versions) == 0 {
+		return nil, ErrVersionNotFound
+	}
+
+	return versions, nil
+}
+
+var ErrStorageUsageFailed = errors.New("internal_error:2064:500")
+
+// StorageUsage reports the bytes of every version of the files of the user
+// against the bytes of the blobs they are stored in
+func (ms *MetadataService) StorageUsage(ctx context.Context, userID string) (*StorageUsage, error) {
+	usage, err := ms.repo.GetStorageUsage(ctx, userID)
+	if err != nil {
+		return nil, ErrStorageUsageFailed
+	}
+
+	return usage, nil
+}
+
+// FindVersion looks up the version in the lineage of the file, so that
+// access to one version of a file can't be used to reach another file.
+func (ms *MetadataService) FindVersion(ctx context.Context, fileID, versionID string) (*FileVersion, error) {
+	versions, err := ms.ListVersions(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, version := range versions {
+		if version.ID == versionID {
+			return version, nil
+		}
+	}
+
+	return nil, ErrVersionNotFound
+}
+
 type FileInfoResponse struct {
 	ID          string `json:"fileID"`
 	Name        string `json:"fileName"`
@@ -348,8 +468,11 @@ type FileInfoResponse struct {
 
 	Chunks map[string]*FilesWithChunks `json:"chunks"`
 
-	NChunks int    `json:"nChunks"`
-	UserID  string `json:"userID"`
+	NChunks  int    `json:"nChunks"`
+	Chunking string `json:"chunking"`
+	UserID   string `json:"userID"`
+
+	ExplicitChunks bool `json:"-"`
 }
 
 type Response struct {
@@ -406,8 +529,11 @@ func BuildFilesInfoResponse(files []*FilesWithChunks) []*FileInfoResponse {
 			Type:        file.FileType,
 			CurrentFlag: file.CurrentFlag,
 			NChunks:     file.NChunks,
+			Chunking:    file.Chunking,
 			UserID:      file.UserID,
 
+			ExplicitChunks: file.ExplicitChunks,
+
 			Chunks: make(map[string]*FilesWithChunks),
 		}
 
@@ -0,0 +1,73 @@
+package files
+
+import (
+	"arbokcore/pkg/blobstore"
+	"context"
+	"errors"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Chunks used to be stored with the absolute path of their blob, which
+// tied the rows to the directory the server ran in. MigrateBlobURIs
+// rewrites those paths to blob uris, once, after which the store can move.
+
+var ErrBlobURIMigrationFailed = errors.New("blob_uri_migration_failed")
+
+type URIMigrationReport struct {
+	Scanned   int `json:"scanned"`
+	Rewritten int `json:"rewritten"`
+	Skipped   int `json:"skipped"`
+	Failed    int `json:"failed"`
+}
+
+// LegacyURIs maps the legacy paths to their uri, paths which don't
+// belong to the store are skipped and left as they are
+func LegacyURIs(
+	paths []string,
+	toURI func(path string) (string, error),
+	report *URIMigrationReport,
+) map[string]string {
+
+	uris := map[string]string{}
+
+	for _, path := range paths {
+		report.Scanned += 1
+
+		uri, err := toURI(path)
+		if err != nil {
+			log.Info().Err(err).Str("path", path).Msg("skipping path outside the store")
+			report.Skipped += 1
+			continue
+		}
+
+		uris[path] = uri
+	}
+
+	return uris
+}
+
+func MigrateBlobURIs(
+	ctx context.Context,
+	repo *MetadataRepository,
+	localFs *blobstore.LocalFS,
+) (*URIMigrationReport, error) {
+
+	report := &URIMigrationReport{}
+
+	paths, err := repo.ListLegacyBlobUrls(ctx)
+	if err != nil {
+		return report, ErrBlobURIMigrationFailed
+	}
+
+	for path, uri := range LegacyURIs(paths, localFs.URI, report) {
+		if err := repo.RewriteBlobUrl(ctx, path, uri); err != nil {
+			report.Failed += 1
+			continue
+		}
+
+		report.Rewritten += 1
+	}
+
+	return report, nil
+}
@@ -0,0 +1,66 @@
+package files
+
+import (
+	"arbokcore/pkg/blobstore"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_LegacyURIs(t *testing.T) {
+	dir := t.TempDir()
+
+	localFs, err := blobstore.NewLocalFS(dir)
+	require.NoError(t, err)
+
+	hash := "5166664037566d1dffaf6dad4ba3691ac61066d2c6eaa95a5ab4533009ba7a66"
+
+	paths := []string{
+		filepath.Join(dir, "File1", "0"),
+		filepath.Join(dir, "blobs", hash[:2], hash),
+		"/somewhere/else/File2/0",
+	}
+
+	report := &URIMigrationReport{}
+	uris := LegacyURIs(paths, localFs.URI, report)
+
+	require.Equal(t, map[string]string{
+		paths[0]: "local://File1/0",
+		paths[1]: "local://blobs/" + hash[:2] + "/" + hash,
+	}, uris)
+
+	require.Equal(t, &URIMigrationReport{Scanned: 3, Skipped: 1}, report)
+}
+
+func Test_ListLegacyBlobUrls(t *testing.T) {
+	ctx := context.Background()
+	db, repo := newTestMetadataRepository(t)
+
+	for _, url := range []string{
+		"local://File1/0",
+		"s3://arbok/blobs/aa/aa",
+		"/tmp/arbokdata/File2/0",
+		"",
+	} {
+		_, err := db.Exec("INSERT INTO user_files (file_id, chunk_id, chunk_blob_url, chunk_hash) VALUES ('F', 0, ?, 'h')", url)
+		require.NoError(t, err)
+	}
+
+	for hash, url := range map[string]string{
+		"aa": "local://blobs/aa/aa",
+		"bb": "/tmp/arbokdata/blobs/bb/bb",
+	} {
+		_, err := db.Exec("INSERT INTO blobs (hash, blob_url, size) VALUES (?, ?, 1)", hash, url)
+		require.NoError(t, err)
+	}
+
+	urls, err := repo.ListLegacyBlobUrls(ctx)
+	require.NoError(t, err)
+
+	require.ElementsMatch(t, []string{
+		"/tmp/arbokdata/File2/0",
+		"/tmp/arbokdata/blobs/bb/bb",
+	}, urls)
+}
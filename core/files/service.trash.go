@@ -0,0 +1,157 @@
+package files
+
+import (
+	"arbokcore/core/notifiers"
+	"arbokcore/pkg/blobstore"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrTrashFailed    = errors.New("trash_failed:2052:500")
+	ErrNotInTrash     = errors.New("file_not_in_trash:2053:404")
+	ErrPurgeFailed    = errors.New("purge_failed:2054:500")
+	ErrAlreadyInTrash = errors.New("file_already_in_trash:2055:409")
+)
+
+const PurgeBatchSize = 100
+
+type TrashService struct {
+	repo     *MetadataRepository
+	storage  blobstore.BlobStorage
+	notifier *notifiers.MetadataUpdateStatus
+}
+
+func NewTrashService(
+	repo *MetadataRepository,
+	storage blobstore.BlobStorage,
+	notifier *notifiers.MetadataUpdateStatus,
+) *TrashService {
+
+	return &TrashService{
+		repo:     repo,
+		storage:  storage,
+		notifier: notifier,
+	}
+}
+
+// TrashRequest identifies the file lineage by its first version. The
+// FileID is the version the request was made for, and is what the
+// other devices of the owner get notified about.
+type TrashRequest struct {
+	FileID    string
+	LineageID string
+	OwnerID   string
+	DeviceID  string
+}
+
+func (slf *TrashService) Trash(ctx context.Context, req *TrashRequest) error {
+	affected, err := slf.repo.TrashLineage(ctx, req.LineageID)
+	if err != nil {
+		log.Error().Err(err).Str("lineage_id", req.LineageID).Msg("failed to trash file")
+		return ErrTrashFailed
+	}
+
+	if affected == 0 {
+		return ErrAlreadyInTrash
+	}
+
+	slf.notify(ctx, req, notifiers.ActionTrashed)
+	return nil
+}
+
+func (slf *TrashService) ListTrash(ctx context.Context, userID string) ([]*TrashedFile, error) {
+	trashed, err := slf.repo.ListTrash(ctx, userID)
+	if err != nil {
+		return nil, ErrTrashFailed
+	}
+
+	return trashed, nil
+}
+
+func (slf *TrashService) Restore(ctx context.Context, req *TrashRequest) error {
+	affected, err := slf.repo.RestoreLineage(ctx, req.LineageID)
+	if err != nil {
+		log.Error().Err(err).Str("lineage_id", req.LineageID).Msg("failed to restore file")
+		return ErrTrashFailed
+	}
+
+	if affected == 0 {
+		return ErrNotInTrash
+	}
+
+	slf.notify(ctx, req, notifiers.ActionRestored)
+	return nil
+}
+
+// Purge deletes the file permanently, along with the blobs
+// of its chunks which aren't used by any other file
+func (slf *TrashService) Purge(ctx context.Context, req *TrashRequest) error {
+	blobs, err := slf.repo.PurgeLineage(ctx, req.LineageID)
+	if err != nil {
+		log.Error().Err(err).Str("lineage_id", req.LineageID).Msg("failed to purge file")
+		return ErrPurgeFailed
+	}
+
+	removeUnreferencedBlobs(ctx, slf.repo, slf.storage, blobs)
+	slf.notify(ctx, req, notifiers.ActionPurged)
+
+	return nil
+}
+
+// PurgeExpired purges the files which have been in the trash for longer
+// than the retention, and returns how many were purged. A file which fails
+// to purge is skipped and left for the next run, the error only reports
+// how many did.
+func (slf *TrashService) PurgeExpired(ctx context.Context, retention time.Duration) (int, error) {
+	before := time.Now().UTC().Add(-retention)
+	purged, failed := 0, 0
+
+	for {
+		// The lineages which failed are still expired, and listed first
+		lineages, err := slf.repo.ListExpiredTrash(ctx, before, PurgeBatchSize, failed)
+		if err != nil {
+			return purged, ErrPurgeFailed
+		}
+
+		for _, lineage := range lineages {
+			err := slf.Purge(ctx, &TrashRequest{
+				FileID:    lineage.LineageID,
+				LineageID: lineage.LineageID,
+				OwnerID:   lineage.OwnerID,
+			})
+			if err != nil {
+				failed += 1
+				continue
+			}
+
+			purged += 1
+		}
+
+		if len(lineages) < PurgeBatchSize {
+			break
+		}
+	}
+
+	if failed > 0 {
+		return purged, fmt.Errorf("%w: %d files failed", ErrPurgeFailed, failed)
+	}
+
+	return purged, nil
+}
+
+func (slf *TrashService) notify(ctx context.Context, req *TrashRequest, action string) {
+	err := slf.notifier.Notify(ctx, []*notifiers.MetadataUpdateStatusEvent{{
+		FileID:   req.FileID,
+		UserID:   req.OwnerID,
+		DeviceID: req.DeviceID,
+		Action:   action,
+	}})
+	if err != nil {
+		log.Error().Err(err).Str("file_id", req.FileID).Str("action", action).Msg("failed to notify")
+	}
+}
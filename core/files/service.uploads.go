@@ -0,0 +1,294 @@
+package files
+
+import (
+	"arbokcore/pkg/blobstore"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrUploadNotFound     = errors.New("upload_not_found:2056:404")
+	ErrUploadStatusFailed = errors.New("internal_error:2057:500")
+	ErrUploadNotAbortable = errors.New("upload_not_in_progress:2058:409")
+	ErrUploadAbortFailed  = errors.New("upload_abort_failed:2059:500")
+	ErrDigestMismatch     = errors.New("digest_mismatch:2060:422")
+)
+
+const ReapBatchSize = 100
+
+type UploadService struct {
+	repo           *MetadataRepository
+	chunkRepo      *UserFileRepository
+	metaTokensRepo *MetadataTokenRepository
+	storage        blobstore.BlobStorage
+}
+
+func NewUploadService(
+	repo *MetadataRepository,
+	chunkRepo *UserFileRepository,
+	metaTokensRepo *MetadataTokenRepository,
+	storage blobstore.BlobStorage,
+) *UploadService {
+
+	return &UploadService{
+		repo:           repo,
+		chunkRepo:      chunkRepo,
+		metaTokensRepo: metaTokensRepo,
+		storage:        storage,
+	}
+}
+
+type ReceivedChunk struct {
+	ChunkID   int64  `json:"chunkID"`
+	ChunkHash string `json:"chunkHash"`
+}
+
+type UploadProgress struct {
+	FileID       string           `json:"fileID"`
+	UploadStatus string           `json:"uploadStatus"`
+	NChunks      int              `json:"chunks"`
+	Received     []*ReceivedChunk `json:"received"`
+	Missing      []int64          `json:"missing"`
+}
+
+// Progress lists the chunks of the file the server already has, and the
+// ones still missing, so that an interrupted upload can be resumed.
+func (slf *UploadService) Progress(ctx context.Context, fileID string) (*UploadProgress, error) {
+	results, err := slf.repo.FindBy(ctx, FindClause{
+		{Key: "id", Operator: "=", Val: fileID},
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to find file by id")
+		return nil, ErrUploadStatusFailed
+	}
+
+	if len(results) == 0 {
+		return nil, ErrUploadNotFound
+	}
+
+	metadata := results[0]
+
+	chunks, err := slf.chunkRepo.GetChunksForFile(ctx, fileID)
+	if err != nil {
+		return nil, ErrUploadStatusFailed
+	}
+
+	return BuildUploadProgress(metadata, chunks), nil
+}
+
+// BuildUploadProgress keeps the latest upload of each chunk, the
+// chunks are expected to be ordered by created_at, newest first
+func BuildUploadProgress(metadata *FileMetadata, chunks []*UserFile) *UploadProgress {
+	progress := &UploadProgress{
+		FileID:       metadata.ID,
+		UploadStatus: metadata.UploadStaus,
+		NChunks:      metadata.NChunks,
+		Received:     []*ReceivedChunk{},
+		Missing:      []int64{},
+	}
+
+	seen := map[int64]bool{}
+
+	for _, chunk := range LatestChunks(chunks, metadata.NChunks) {
+		seen[chunk.ChunkID] = true
+		progress.Received = append(progress.Received, &ReceivedChunk{
+			ChunkID:   chunk.ChunkID,
+			ChunkHash: chunk.ChunkHash,
+		})
+	}
+
+	for chunkID := int64(0); chunkID < int64(metadata.NChunks); chunkID++ {
+		if !seen[chunkID] {
+			progress.Missing = append(progress.Missing, chunkID)
+		}
+	}
+
+	return progress
+}
+
+// LatestChunks keeps the latest upload of each chunk of the file, ordered by
+// chunk id. The chunks are expected to be ordered by created_at, newest first
+func LatestChunks(chunks []*UserFile, nChunks int) []*UserFile {
+	latest := []*UserFile{}
+	seen := map[int64]bool{}
+
+	for _, chunk := range chunks {
+		if seen[chunk.ChunkID] || chunk.ChunkID < 0 || chunk.ChunkID >= int64(nChunks) {
+			continue
+		}
+
+		seen[chunk.ChunkID] = true
+		latest = append(latest, chunk)
+	}
+
+	sort.Slice(latest, func(i, j int) bool {
+		return latest[i].ChunkID < latest[j].ChunkID
+	})
+
+	return latest
+}
+
+// VerifyDigest streams the chunks of the file, in order, through sha256 and
+// compares the result with the digest sent by the client for the whole file.
+// A missing chunk is a mismatch, an unreadable one is returned as is.
+func VerifyDigest(
+	ctx context.Context,
+	storage blobstore.BlobStorage,
+	metadata *FileMetadata,
+	chunks []*UserFile,
+) error {
+
+	latest := LatestChunks(chunks, metadata.NChunks)
+	if len(latest) != metadata.NChunks {
+		log.Info().
+			Int("expected", metadata.NChunks).
+			Int("found", len(latest)).
+			Msg("file has missing chunks")
+
+		return ErrDigestMismatch
+	}
+
+	chunkPaths := []string{}
+
+	for _, chunk := range latest {
+		// Sent without data, and no stored chunk had its hash
+		if chunk.ChunkBlobUrl == "" {
+			log.Info().Int64("chunk_id", chunk.ChunkID).Msg("chunk was never stored")
+			return ErrDigestMismatch
+		}
+
+		chunkPaths = append(chunkPaths, chunk.ChunkBlobUrl)
+	}
+
+	blobs, err := storage.FetchChunks(ctx, chunkPaths)
+	if err != nil {
+		log.Error().Err(err).Str("file_id", metadata.ID).Msg("failed to fetch chunks")
+		return err
+	}
+
+	// Read with the size they were uploaded with, not the size they take
+	for i, blob := range blobs {
+		if latest[i].ChunkSize != nil {
+			blob.WithSize(*latest[i].ChunkSize)
+		}
+	}
+
+	file, err := storage.BuildFile(ctx, blobs)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+
+	if _, err := io.Copy(hasher, file); err != nil {
+		log.Error().Err(err).Str("file_id", metadata.ID).Msg("failed to read chunks")
+		return err
+	}
+
+	digest := hex.EncodeToString(hasher.Sum(nil))
+	if digest != metadata.FileHash {
+		log.Info().
+			Str("expected", metadata.FileHash).
+			Str("found", digest).
+			Msg("file digest mismatch")
+
+		return ErrDigestMismatch
+	}
+
+	return nil
+}
+
+// Abort gives up on an upload in progress. The file is marked failed, and
+// the chunks received so far are deleted along with the stream tokens.
+func (slf *UploadService) Abort(ctx context.Context, fileID string) error {
+	blobs, err := slf.metaTokensRepo.FailUpload(ctx, fileID)
+	if errors.Is(err, ErrUploadNotInProgress) {
+		return ErrUploadNotAbortable
+	}
+
+	if err != nil {
+		log.Error().Err(err).Str("file_id", fileID).Msg("failed to abort upload")
+		return ErrUploadAbortFailed
+	}
+
+	removeUnreferencedBlobs(ctx, slf.repo, slf.storage, blobs)
+	return nil
+}
+
+// ReapStale aborts the uploads which started before the age and are still
+// in progress, and returns how many were aborted. An upload which fails to
+// abort is skipped and left for the next run, the error only reports how
+// many did.
+func (slf *UploadService) ReapStale(ctx context.Context, age time.Duration) (int, error) {
+	before := time.Now().UTC().Add(-age)
+	reaped, failed := 0, 0
+
+	for {
+		// The uploads which failed are still in progress, and listed first
+		fileIDs, err := slf.repo.ListStaleUploads(ctx, before, ReapBatchSize, failed)
+		if err != nil {
+			return reaped, ErrUploadAbortFailed
+		}
+
+		for _, fileID := range fileIDs {
+			err := slf.Abort(ctx, fileID)
+
+			// Completed since it was listed
+			if errors.Is(err, ErrUploadNotAbortable) {
+				continue
+			}
+
+			if err != nil {
+				failed += 1
+				continue
+			}
+
+			reaped += 1
+		}
+
+		if len(fileIDs) < ReapBatchSize {
+			break
+		}
+	}
+
+	if failed > 0 {
+		return reaped, fmt.Errorf("%w: %d uploads failed", ErrUploadAbortFailed, failed)
+	}
+
+	return reaped, nil
+}
+
+// removeUnreferencedBlobs is best effort, a blob left behind takes up
+// space but deleting one still in use would corrupt another file
+func removeUnreferencedBlobs(
+	ctx context.Context,
+	repo *MetadataRepository,
+	storage blobstore.BlobStorage,
+	blobs []string,
+) {
+
+	for _, blob := range blobs {
+		removable, err := repo.DeleteUnusedBlob(ctx, blob)
+		if err != nil {
+			log.Error().Err(err).Str("blob", blob).Msg("failed to delete blob record")
+			continue
+		}
+
+		if !removable {
+			continue
+		}
+
+		if err := storage.DeleteChunk(ctx, blob); err != nil {
+			log.Error().Err(err).Str("blob", blob).Msg("failed to delete blob")
+		}
+	}
+}
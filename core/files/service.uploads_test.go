@@ -0,0 +1,127 @@
+package files
+
+import (
+	"arbokcore/pkg/blobstore"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_BuildUploadProgress(t *testing.T) {
+	metadata := &FileMetadata{ID: "File1", NChunks: 4, UploadStaus: StatusUploading}
+
+	t.Run("nothing uploaded yet", func(t *testing.T) {
+		progress := BuildUploadProgress(metadata, nil)
+
+		require.Empty(t, progress.Received)
+		require.Equal(t, []int64{0, 1, 2, 3}, progress.Missing)
+		require.Equal(t, StatusUploading, progress.UploadStatus)
+	})
+
+	t.Run("keeps the latest upload of a chunk", func(t *testing.T) {
+		chunks := []*UserFile{
+			{FileID: "File1", ChunkID: 2, ChunkHash: "C2-retry"},
+			{FileID: "File1", ChunkID: 0, ChunkHash: "C0"},
+			{FileID: "File1", ChunkID: 2, ChunkHash: "C2"},
+		}
+
+		progress := BuildUploadProgress(metadata, chunks)
+
+		require.Equal(t, []*ReceivedChunk{
+			{ChunkID: 0, ChunkHash: "C0"},
+			{ChunkID: 2, ChunkHash: "C2-retry"},
+		}, progress.Received)
+		require.Equal(t, []int64{1, 3}, progress.Missing)
+	})
+
+	t.Run("ignores chunks outside the file", func(t *testing.T) {
+		chunks := []*UserFile{
+			{FileID: "File1", ChunkID: 0, ChunkHash: "C0"},
+			{FileID: "File1", ChunkID: 1, ChunkHash: "C1"},
+			{FileID: "File1", ChunkID: 2, ChunkHash: "C2"},
+			{FileID: "File1", ChunkID: 3, ChunkHash: "C3"},
+			{FileID: "File1", ChunkID: 4, ChunkHash: "C4"},
+		}
+
+		progress := BuildUploadProgress(metadata, chunks)
+
+		require.Len(t, progress.Received, 4)
+		require.Empty(t, progress.Missing)
+	})
+}
+
+func Test_VerifyDigest(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	storage, err := blobstore.NewLocalFS(dir)
+	require.NoError(t, err)
+
+	blobs := []string{}
+	for i, data := range []string{"hello ", "sync ", "world"} {
+		path := filepath.Join(dir, fmt.Sprintf("%d", i))
+		require.NoError(t, os.WriteFile(path, []byte(data), 0o644))
+		blobs = append(blobs, path)
+	}
+
+	sum := sha256.Sum256([]byte("hello sync world"))
+	metadata := &FileMetadata{ID: "File1", NChunks: 3, FileHash: hex.EncodeToString(sum[:])}
+
+	t.Run("assembles the chunks in order", func(t *testing.T) {
+		chunks := []*UserFile{
+			{ChunkID: 2, ChunkBlobUrl: blobs[2]},
+			{ChunkID: 0, ChunkBlobUrl: blobs[0]},
+			{ChunkID: 1, ChunkBlobUrl: blobs[1]},
+		}
+
+		require.NoError(t, VerifyDigest(ctx, storage, metadata, chunks))
+	})
+
+	t.Run("uses the latest upload of a chunk", func(t *testing.T) {
+		chunks := []*UserFile{
+			{ChunkID: 1, ChunkBlobUrl: blobs[1]},
+			{ChunkID: 1, ChunkBlobUrl: blobs[2]},
+			{ChunkID: 0, ChunkBlobUrl: blobs[0]},
+			{ChunkID: 2, ChunkBlobUrl: blobs[2]},
+		}
+
+		require.NoError(t, VerifyDigest(ctx, storage, metadata, chunks))
+	})
+
+	t.Run("mismatch on corrupt content", func(t *testing.T) {
+		chunks := []*UserFile{
+			{ChunkID: 0, ChunkBlobUrl: blobs[0]},
+			{ChunkID: 1, ChunkBlobUrl: blobs[2]},
+			{ChunkID: 2, ChunkBlobUrl: blobs[1]},
+		}
+
+		require.ErrorIs(t, VerifyDigest(ctx, storage, metadata, chunks), ErrDigestMismatch)
+	})
+
+	t.Run("mismatch on missing chunks", func(t *testing.T) {
+		chunks := []*UserFile{
+			{ChunkID: 0, ChunkBlobUrl: blobs[0]},
+			{ChunkID: 1, ChunkBlobUrl: blobs[1]},
+		}
+
+		require.ErrorIs(t, VerifyDigest(ctx, storage, metadata, chunks), ErrDigestMismatch)
+	})
+
+	t.Run("unreadable chunk", func(t *testing.T) {
+		chunks := []*UserFile{
+			{ChunkID: 0, ChunkBlobUrl: blobs[0]},
+			{ChunkID: 1, ChunkBlobUrl: filepath.Join(dir, "gone")},
+			{ChunkID: 2, ChunkBlobUrl: blobs[2]},
+		}
+
+		err := VerifyDigest(ctx, storage, metadata, chunks)
+		require.ErrorIs(t, err, blobstore.ErrBlobNotFound)
+		require.NotErrorIs(t, err, ErrDigestMismatch)
+	})
+}
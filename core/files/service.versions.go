@@ -0,0 +1,158 @@
+package files
+
+import (
+	"arbokcore/core/database"
+	"arbokcore/core/notifiers"
+	"context"
+	"errors"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrVersionIsCurrent = errors.New("version_is_current:2050:409")
+	ErrRestoreFailed    = errors.New("restore_failed:2051:500")
+	ErrVersionConflict  = errors.New("version_conflict:2070:409")
+)
+
+type VersionService struct {
+	repo      *MetadataRepository
+	chunkRepo *UserFileRepository
+	notifier  *notifiers.MetadataUpdateStatus
+}
+
+func NewVersionService(
+	repo *MetadataRepository,
+	chunkRepo *UserFileRepository,
+	notifier *notifiers.MetadataUpdateStatus,
+) *VersionService {
+
+	return &VersionService{
+		repo:      repo,
+		chunkRepo: chunkRepo,
+		notifier:  notifier,
+	}
+}
+
+type RestoreRequest struct {
+	FileID    string
+	VersionID string
+	OwnerID   string
+	DeviceID  string
+}
+
+// Restore makes an older version of the file current again. Rather than
+// moving the current_flag back, a new version is appended to the prev_id
+// chain, with its user_files rows pointing to the blobs of the old version,
+// so the history stays linear and nothing has to be uploaded again.
+func (slf *VersionService) Restore(ctx context.Context, req *RestoreRequest) (*FileVersion, error) {
+	versions, err := slf.repo.ListVersions(ctx, req.FileID)
+	if err != nil {
+		return nil, ErrVersionsFailed
+	}
+
+	var target, current *FileVersion
+
+	for _, version := range versions {
+		if version.ID == req.VersionID {
+			target = version
+		}
+
+		if version.CurrentFlag {
+			current = version
+		}
+	}
+
+	if target == nil {
+		return nil, ErrVersionNotFound
+	}
+
+	if target.UploadStatus != StatusCompleted || current == nil {
+		return nil, ErrVersionUnavailable
+	}
+
+	if target.ID == current.ID {
+		return nil, ErrVersionIsCurrent
+	}
+
+	chunks, err := slf.chunkRepo.GetChunksForFile(ctx, target.ID)
+	if err != nil {
+		return nil, ErrRestoreFailed
+	}
+
+	if len(chunks) != target.NChunks {
+		log.Error().
+			Str("version_id", target.ID).
+			Int("chunks", len(chunks)).
+			Int("expected", target.NChunks).
+			Msg("version is missing chunks")
+
+		return nil, ErrVersionUnavailable
+	}
+
+	id, err := database.NewID()
+	if err != nil {
+		log.Error().Err(err).Msg("faild to generate ulid")
+		return nil, ErrRestoreFailed
+	}
+
+	metadata := &FileMetadata{
+		ID:          id,
+		PrevID:      &current.ID,
+		UserID:      req.OwnerID,
+		Filename:    target.Filename,
+		FileSize:    target.FileSize,
+		FileType:    target.FileType,
+		FileHash:    target.FileHash,
+		NChunks:     target.NChunks,
+		Chunking:    target.Chunking,
+		CurrentFlag: true,
+		UploadStaus: StatusCompleted,
+		DeviceID:    req.DeviceID,
+		Timestamp:   database.NewTimestamp(),
+
+		ExplicitChunks: true,
+	}
+
+	for _, chunk := range chunks {
+		chunk.UserID = req.OwnerID
+		chunk.FileID = metadata.ID
+		chunk.Timestamp = metadata.Timestamp
+	}
+
+	err = slf.repo.RestoreVersion(ctx, slf.chunkRepo, metadata, chunks)
+	if errors.Is(err, ErrVersionMoved) {
+		return nil, ErrVersionConflict
+	}
+
+	if err != nil {
+		log.Error().Err(err).Str("file_id", metadata.ID).Msg("failed to restore version")
+		return nil, ErrRestoreFailed
+	}
+
+	// The restore already happened, the other devices
+	// will catch up on their next full sync if this fails
+	err = slf.notifier.Notify(ctx, []*notifiers.MetadataUpdateStatusEvent{{
+		FileID:     metadata.ID,
+		UserID:     metadata.UserID,
+		PrevFileID: metadata.PrevID,
+		DeviceID:   req.DeviceID,
+	}})
+	if err != nil {
+		log.Error().Err(err).Str("file_id", metadata.ID).Msg("failed to notify restore")
+	}
+
+	return &FileVersion{
+		ID:           metadata.ID,
+		PrevID:       metadata.PrevID,
+		Filename:     metadata.Filename,
+		FileSize:     metadata.FileSize,
+		FileType:     metadata.FileType,
+		FileHash:     metadata.FileHash,
+		NChunks:      metadata.NChunks,
+		CurrentFlag:  true,
+		UploadStatus: StatusCompleted,
+		DeviceID:     metadata.DeviceID,
+		CreatedAt:    metadata.CreatedAt,
+	}, nil
+}
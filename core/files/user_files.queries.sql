@@ -7,6 +7,8 @@ INSERT INTO user_files (
 	,next_chunk_id
 	,chunk_blob_url
 	,chunk_hash
+	,chunk_offset
+	,chunk_size
 	,created_at
 	,updated_at
 ) VALUES (
@@ -16,6 +18,8 @@ INSERT INTO user_files (
 	,:next_chunk_id
 	,:chunk_blob_url
 	,:chunk_hash
+	,:chunk_offset
+	,:chunk_size
 	,:created_at
 	,:updated_at
 );
@@ -27,6 +31,8 @@ SELECT
 	,next_chunk_id
 	,chunk_blob_url
 	,chunk_hash
+	,chunk_offset
+	,chunk_size
 	,created_at
 	,updated_at
 FROM user_files
@@ -38,10 +44,13 @@ AND chunk_id = :chunk_id;
 
 SELECT 
 	user_id
+	,file_id
 	,chunk_id
 	,next_chunk_id
 	,chunk_blob_url
 	,chunk_hash
+	,chunk_offset
+	,chunk_size
 	,created_at
 	,updated_at
 FROM user_files
@@ -56,8 +65,77 @@ SELECT
 	,next_chunk_id
 	,chunk_blob_url
 	,chunk_hash
+	,chunk_offset
+	,chunk_size
 	,created_at
 	,updated_at
 FROM user_files
 WHERE file_id IN (:file_ids)
 ORDER BY chunk_id DESC;
+
+
+--sql:GetOwnerChunksByHash
+
+SELECT
+	ufs.user_id
+	,ufs.file_id
+	,ufs.chunk_id
+	,ufs.next_chunk_id
+	,ufs.chunk_blob_url
+	,ufs.chunk_hash
+	,ufs.chunk_offset
+	,ufs.chunk_size
+	,ufs.created_at
+	,ufs.updated_at
+FROM user_files ufs
+JOIN file_metadatas fm
+ON
+	fm.id = ufs.file_id
+WHERE fm.user_id = :user_id
+AND fm.deleted_at IS NULL
+AND ufs.chunk_blob_url != ''
+AND ufs.chunk_hash IN (:chunk_hashes);
+
+
+--sql:GetReferenceChunkBlob
+
+SELECT
+	ufs.chunk_blob_url
+FROM file_metadatas f
+JOIN file_metadatas fm
+ON
+	fm.user_id = f.user_id
+JOIN user_files ufs
+ON
+	ufs.file_id = fm.id
+WHERE f.id = :file_id
+AND f.chunking = 'cdc'
+AND fm.deleted_at IS NULL
+AND (f.user_id = :user_id OR fm.id = f.prev_id)
+AND ufs.chunk_blob_url != ''
+AND ufs.chunk_hash = :chunk_hash
+LIMIT 1;
+
+
+--sql:RegisterBlob
+
+INSERT INTO blobs (
+	hash
+	,blob_url
+	,size
+	,codec
+	,stored_size
+	,ref_count
+	,created_at
+	,updated_at
+) VALUES (
+	:hash
+	,:blob_url
+	,:size
+	,:codec
+	,:stored_size
+	,0
+	,:created_at
+	,:updated_at
+) ON CONFLICT (hash) DO UPDATE SET
+	updated_at = excluded.updated_at;
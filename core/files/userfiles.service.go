@@ -7,6 +7,7 @@ import (
 	"arbokcore/pkg/squirtle"
 	"context"
 	"crypto/sha256"
+	"database/sql"
 	"encoding/hex"
 	"errors"
 	"io"
@@ -18,10 +19,14 @@ import (
 )
 
 const (
-	CreateFileChunkStmt = "CreateFileChunk"
-	GetFileChunksStmt   = "GetFileChunks"
-	GetFilesChunksStmt  = "GetFilesChunks"
-	GetChunkForFileStmt = "GetChunkForFile"
+	CreateFileChunkStmt      = "CreateFileChunk"
+	GetFileChunksStmt        = "GetFileChunks"
+	GetFilesChunksStmt       = "GetFilesChunks"
+	GetChunkForFileStmt      = "GetChunkForFile"
+	GetOwnerChunksByHashStmt = "GetOwnerChunksByHash"
+	RegisterBlobStmt         = "RegisterBlob"
+
+	GetReferenceChunkBlobStmt = "GetReferenceChunkBlob"
 )
 
 type UserFileRepository struct {
@@ -88,6 +93,137 @@ func (slf *UserFileRepository) CreateBatch(ctx context.Context, chunks []*UserFi
 	return tx.Commit()
 }
 
+// FindOwnerChunksByHash looks for stored chunks with the hashes in
+// every file of the owner, except the ones in the trash
+func (slf *UserFileRepository) FindOwnerChunksByHash(
+	ctx context.Context,
+	ownerID string,
+	hashes []string,
+) ([]*UserFile, error) {
+
+	chunks := []*UserFile{}
+
+	if len(hashes) == 0 {
+		return chunks, nil
+	}
+
+	stmt, ok := slf.querier.GetQuery(GetOwnerChunksByHashStmt)
+	if !ok {
+		return nil, ErrorStmtNotFound
+	}
+
+	query, args, err := sqlx.Named(stmt, map[string]any{
+		"user_id":      ownerID,
+		"chunk_hashes": hashes,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	query, args, err = sqlx.In(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = slf.conn.SelectContext(ctx, &chunks, slf.conn.Rebind(query), args...)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to find chunks by hash")
+		return nil, err
+	}
+
+	return chunks, nil
+}
+
+// CreateReference creates a chunk sent without data, pointing at the blob
+// of a stored chunk with its hash. The file has to be content defined, and
+// the blob one of the owner's files has, if the user is the owner, or else
+// the previous version of the file has. It reports whether there was such
+// a blob, the lookup and the insert are in a transaction so the blob can't
+// be removed in between.
+func (slf *UserFileRepository) CreateReference(ctx context.Context, userFile *UserFile) (bool, error) {
+	blobStmt, ok := slf.querier.GetQuery(GetReferenceChunkBlobStmt)
+	if !ok {
+		return false, ErrorStmtNotFound
+	}
+
+	stmt, ok := slf.querier.GetQuery(CreateFileChunkStmt)
+	if !ok {
+		return false, ErrorStmtNotFound
+	}
+
+	tx, err := slf.conn.BeginTxx(ctx, nil)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to init transaction")
+		return false, err
+	}
+
+	query, args, err := tx.BindNamed(blobStmt, map[string]any{
+		"user_id":    userFile.UserID,
+		"file_id":    userFile.FileID,
+		"chunk_hash": userFile.ChunkHash,
+	})
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	err = tx.GetContext(ctx, &userFile.ChunkBlobUrl, query, args...)
+	if errors.Is(err, sql.ErrNoRows) {
+		tx.Rollback()
+		return false, nil
+	}
+
+	if err != nil {
+		log.Error().Err(err).Msg("failed to find reference chunk blob")
+		tx.Rollback()
+		return false, err
+	}
+
+	if _, err := tx.NamedExecContext(ctx, stmt, userFile); err != nil {
+		log.Error().Err(err).Msg("failed to insert into database")
+		tx.Rollback()
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// CreateWithBlob records the blob if it is new and creates the chunk
+// pointing at it, in a transaction. The references of a blob are counted
+// as user_files rows pointing at it are created and deleted, so the blob
+// is never left with no references while it is being linked.
+func (slf *UserFileRepository) CreateWithBlob(ctx context.Context, userFile *UserFile, blob *Blob) error {
+	blobStmt, ok := slf.querier.GetQuery(RegisterBlobStmt)
+	if !ok {
+		return ErrorStmtNotFound
+	}
+
+	stmt, ok := slf.querier.GetQuery(CreateFileChunkStmt)
+	if !ok {
+		return ErrorStmtNotFound
+	}
+
+	tx, err := slf.conn.BeginTxx(ctx, nil)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to init transaction")
+		return err
+	}
+
+	if _, err := tx.NamedExecContext(ctx, blobStmt, blob); err != nil {
+		log.Error().Err(err).Msg("failed to register blob")
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.NamedExecContext(ctx, stmt, userFile); err != nil {
+		log.Error().Err(err).Msg("failed to insert into database")
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
 type FileChunkRequest struct {
 	UserID      string        `json:"-"`
 	FileID      string        `json:"-"`
@@ -99,23 +235,28 @@ type FileChunkRequest struct {
 	Version string `json:"-"`
 }
 
-func (slf *UserFileRepository) GetChunksForFile(ctx context.Context, fileID string) error {
+func (slf *UserFileRepository) GetChunksForFile(ctx context.Context, fileID string) ([]*UserFile, error) {
 	stmt, ok := slf.querier.GetQuery(GetFileChunksStmt)
 	if !ok {
-		return errors.New("query_retriever_failed:4001:500")
+		return nil, errors.New("query_retriever_failed:4001:500")
 	}
 
-	// Validate chunk
+	nstmt, err := slf.conn.PrepareNamedContext(ctx, stmt)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to prepare named stmt")
+		return nil, errors.New("internal_error:4002:500")
+	}
+	defer nstmt.Close()
 
-	dest := []*UserFile{}
+	chunks := []*UserFile{}
 
-	err := slf.conn.SelectContext(ctx, dest, stmt, map[string]string{"file_id": fileID})
+	err = nstmt.SelectContext(ctx, &chunks, map[string]any{"file_id": fileID})
 	if err != nil {
 		log.Error().Err(err).Msg("failed to fetch chunks from db")
-		return errors.New("internal_error:4002:500")
+		return nil, errors.New("internal_error:4002:500")
 	}
 
-	return err
+	return chunks, nil
 }
 
 func (slf *UserFileRepository) GetChunk(ctx context.Context, userFile *UserFile) error {
@@ -164,11 +305,23 @@ func ValidateHash(ctx context.Context, req *api.FileChunkRequest) error {
 	return nil
 }
 
+var ErrChunkReferenceNotFound = errors.New("chunk_reference_not_found:5008:422")
+
 func (slf *FileChunkService) Create(ctx context.Context, req *api.FileChunkRequest) api.Response {
-	if err := ValidateHash(ctx, req); err != nil {
-		log.Error().Err(err).Msg("hash mismatch in chunk")
+	// Without data, the chunk is one the previous version already has,
+	// only its hash is sent and the blob is looked up by the hash
+	isReference := req.Data == nil
 
-		return api.BuildResponse(errors.New("corrupted_file:5001:422"), nil)
+	if isReference && (req.ChunkDigest == "" || req.ChunkSize <= 0) {
+		return api.BuildResponse(errors.New("invalid_file_chunk:5006:422"), nil)
+	}
+
+	if !isReference {
+		if err := ValidateHash(ctx, req); err != nil {
+			log.Error().Err(err).Msg("hash mismatch in chunk")
+
+			return api.BuildResponse(errors.New("corrupted_file:5001:422"), nil)
+		}
 	}
 
 	chunkIDInt, err := strconv.Atoi(req.ChunkID)
@@ -183,36 +336,91 @@ func (slf *FileChunkService) Create(ctx context.Context, req *api.FileChunkReque
 		return api.BuildResponse(errors.New("invalid_file_chunk:5004:422"), nil)
 	}
 
-	storedPath, err := slf.storage.UpdateChunk(
-		ctx,
-		req.FileID,
-		blobstore.NewChunkedFile(req.Data, int64(chunkIDInt), nil))
-
-	if err != nil {
-		log.Error().Err(err).Msg("failed to save chunk to disk")
-		return api.BuildResponse(errors.New("internal_server_error:5003:500"), nil)
+	// Fixed chunks are laid out by their id,
+	// content defined chunks send their offset
+	chunkOffset := int64(chunkIDInt) * FrontendChunkSize
+	if req.ChunkOffset != "" {
+		chunkOffset, err = strconv.ParseInt(req.ChunkOffset, 10, 64)
+		if err != nil || chunkOffset < 0 {
+			return api.BuildResponse(errors.New("invalid_file_chunk:5007:422"), nil)
+		}
 	}
 
+	chunkSize := int64(req.ChunkSize)
+
 	model := &UserFile{
-		UserID:       req.UserID,
-		FileID:       req.FileID,
-		ChunkID:      int64(chunkIDInt),
-		ChunkBlobUrl: storedPath,
-		ChunkHash:    req.ChunkDigest,
-		NextChunkID:  &nextChunkIDInt,
-		Timestamp:    database.NewTimestamp(),
+		UserID:      req.UserID,
+		FileID:      req.FileID,
+		ChunkID:     int64(chunkIDInt),
+		ChunkHash:   req.ChunkDigest,
+		NextChunkID: &nextChunkIDInt,
+		ChunkOffset: &chunkOffset,
+		ChunkSize:   &chunkSize,
+		Timestamp:   database.NewTimestamp(),
 	}
 
-	if err := slf.repo.Create(ctx, model); err != nil {
-		log.Error().Err(err).Msg("failed to save file chunk info to db")
-		return api.BuildResponse(errors.New("save_chunk_failed:5005:500"), nil)
+	if isReference {
+		found, err := slf.repo.CreateReference(ctx, model)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to save file chunk info to db")
+			return api.BuildResponse(errors.New("save_chunk_failed:5005:500"), nil)
+		}
+
+		if !found {
+			return api.BuildResponse(ErrChunkReferenceNotFound, nil)
+		}
+	}
+
+	if !isReference {
+		size, err := req.Data.Seek(0, io.SeekEnd)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to read chunk size")
+			return api.BuildResponse(errors.New("internal_server_error:5003:500"), nil)
+		}
+
+		if chunkSize != 0 && chunkSize != size {
+			return api.BuildResponse(errors.New("invalid_file_chunk:5006:422"), nil)
+		}
+
+		chunkSize = size
+
+		// Chunks are stored by their hash, the same chunk in another
+		// file or version shares the blob
+		chunk := blobstore.NewChunkedFile(req.Data, int64(chunkIDInt), nil).
+			WithDigest(req.ChunkDigest)
+
+		model.ChunkBlobUrl, err = slf.storage.StoreBlob(ctx, req.ChunkDigest, chunk)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to save chunk to disk")
+			return api.BuildResponse(errors.New("internal_server_error:5003:500"), nil)
+		}
+
+		storedSize := chunk.StoredSize()
+		if storedSize == 0 {
+			storedSize = chunkSize
+		}
+
+		err = slf.repo.CreateWithBlob(ctx, model, &Blob{
+			Hash:       req.ChunkDigest,
+			BlobUrl:    model.ChunkBlobUrl,
+			Size:       chunkSize,
+			Codec:      chunk.Codec(),
+			StoredSize: storedSize,
+			Timestamp:  database.NewTimestamp(),
+		})
+		if err != nil {
+			log.Error().Err(err).Msg("failed to save file chunk info to db")
+			return api.BuildResponse(errors.New("save_chunk_failed:5005:500"), nil)
+		}
 	}
 
 	return api.BuildResponse(nil, ChunkUploadResponse{
 		ChunkID:      model.ChunkID,
 		NextChunkID:  nextChunkIDInt,
-		ChunkBlobUrl: storedPath,
+		ChunkBlobUrl: model.ChunkBlobUrl,
 		ChunkHash:    req.ChunkDigest,
+		ChunkOffset:  chunkOffset,
+		ChunkSize:    chunkSize,
 		CreatedAt:    model.Timestamp.CreatedAt,
 		UpdatedAt:    model.Timestamp.UpdatedAt,
 	})
@@ -223,6 +431,8 @@ type ChunkUploadResponse struct {
 	NextChunkID  int64     `json:"nextChunkID"`
 	ChunkBlobUrl string    `json:"chunkBlobUrl"`
 	ChunkHash    string    `json:"chunkHash"`
+	ChunkOffset  int64     `json:"chunkOffset"`
+	ChunkSize    int64     `json:"chunkSize"`
 	CreatedAt    time.Time `json:"createdAt"`
 	UpdatedAt    time.Time `json:"updatedAt"`
 }
@@ -21,11 +21,41 @@ func NewMedataUpdateStatus(queue queuer.Queuer) *MetadataUpdateStatus {
 	}
 }
 
+const (
+	// Empty for the events enqueued before actions were added
+	ActionUpdated  = ""
+	ActionTrashed  = "trashed"
+	ActionRestored = "restored"
+	ActionPurged   = "purged"
+	ActionFailed   = "failed"
+)
+
 type MetadataUpdateStatusEvent struct {
 	FileID     string
 	UserID     string
 	PrevFileID *string
 	DeviceID   string
+	Action     string
+}
+
+// Content is the message sent to the devices, the
+// updates keep the fileID:<id> format clients know
+func (event *MetadataUpdateStatusEvent) Content() string {
+	if event.Action == ActionUpdated {
+		return "fileID:" + event.FileID
+	}
+
+	return event.Action + ":" + event.FileID
+}
+
+// ForDevice tells if the device should receive the event. The device which
+// made a change already has it, but only it needs to know its upload failed
+func (event *MetadataUpdateStatusEvent) ForDevice(deviceID string) bool {
+	if event.Action == ActionFailed {
+		return deviceID == event.DeviceID
+	}
+
+	return deviceID != event.DeviceID
 }
 
 type PayloadMap struct {
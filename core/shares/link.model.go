@@ -0,0 +1,110 @@
+package shares
+
+import (
+	"arbokcore/core/database"
+	"arbokcore/core/tokens"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+const (
+	LinkTokenLen = 32
+
+	// bcrypt only looks at the first 72 bytes
+	MaxLinkPasswordLen = 72
+)
+
+// ShareLink hands out the current version of a file lineage to anyone who has
+// the link token. Only the sha256 of the token is stored, the token itself is
+// returned once, when the link is created.
+type ShareLink struct {
+	ID             string     `db:"id" json:"linkID"`
+	LineageID      string     `db:"lineage_id" json:"lineageID"`
+	OwnerID        string     `db:"owner_id" json:"ownerID"`
+	TokenHash      string     `db:"token_hash" json:"-"`
+	HashedPassword *string    `db:"hashedpass" json:"-"`
+	ExpiresAt      *time.Time `db:"expires_at" json:"expiresAt,omitempty"`
+	MaxDownloads   *int64     `db:"max_downloads" json:"maxDownloads,omitempty"`
+	DownloadCount  int64      `db:"download_count" json:"downloadCount"`
+	RevokedAt      *time.Time `db:"revoked_at" json:"revokedAt,omitempty"`
+
+	Protected bool   `db:"-" json:"passwordProtected"`
+	Token     string `db:"-" json:"token,omitempty"`
+
+	database.Timestamp
+}
+
+type LinkOpts struct {
+	Password     string
+	ExpiresIn    time.Duration
+	MaxDownloads int64
+}
+
+func NewShareLink(lineageID, ownerID string, opts LinkOpts) (*ShareLink, error) {
+	id, err := database.NewID()
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := tokens.GenerateToken(LinkTokenLen)
+	if err != nil {
+		return nil, err
+	}
+
+	link := &ShareLink{
+		ID:        id,
+		LineageID: lineageID,
+		OwnerID:   ownerID,
+		TokenHash: HashLinkToken(token),
+		Token:     token,
+		Timestamp: database.NewTimestamp(),
+	}
+
+	if opts.Password != "" {
+		hashedPassword, err := database.HashPassword(opts.Password)
+		if err != nil {
+			return nil, err
+		}
+
+		link.HashedPassword = &hashedPassword
+	}
+
+	if opts.ExpiresIn > 0 {
+		expiresAt := link.CreatedAt.Add(opts.ExpiresIn)
+		link.ExpiresAt = &expiresAt
+	}
+
+	if opts.MaxDownloads > 0 {
+		link.MaxDownloads = &opts.MaxDownloads
+	}
+
+	link.Protected = link.HashedPassword != nil
+
+	return link, nil
+}
+
+func HashLinkToken(token string) string {
+	digest := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(digest[:])
+}
+
+func (link *ShareLink) IsRevoked() bool {
+	return link.RevokedAt != nil
+}
+
+func (link *ShareLink) HasExpired() bool {
+	return link.ExpiresAt != nil && database.Now().After(*link.ExpiresAt)
+}
+
+func (link *ShareLink) IsExhausted() bool {
+	return link.MaxDownloads != nil && link.DownloadCount >= *link.MaxDownloads
+}
+
+func (link *ShareLink) ValidPassword(password string) bool {
+	if link.HashedPassword == nil {
+		return true
+	}
+
+	return database.ValidPassword(*link.HashedPassword, password)
+}
@@ -0,0 +1,61 @@
+package shares
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_NewShareLink(t *testing.T) {
+	t.Run("only the hash of the token is stored", func(t *testing.T) {
+		link, err := NewShareLink("lineage", "owner", LinkOpts{})
+		require.NoError(t, err)
+
+		assert.Len(t, link.Token, LinkTokenLen*2)
+		assert.Equal(t, HashLinkToken(link.Token), link.TokenHash)
+		assert.NotEqual(t, link.Token, link.TokenHash)
+	})
+
+	t.Run("links without options never run out", func(t *testing.T) {
+		link, err := NewShareLink("lineage", "owner", LinkOpts{})
+		require.NoError(t, err)
+
+		assert.Nil(t, link.ExpiresAt)
+		assert.Nil(t, link.MaxDownloads)
+		assert.False(t, link.Protected)
+		assert.False(t, link.HasExpired())
+		assert.False(t, link.IsExhausted())
+		assert.True(t, link.ValidPassword(""))
+	})
+
+	t.Run("password is checked against the bcrypt hash", func(t *testing.T) {
+		link, err := NewShareLink("lineage", "owner", LinkOpts{Password: "secret"})
+		require.NoError(t, err)
+
+		assert.True(t, link.Protected)
+		assert.NotEqual(t, "secret", *link.HashedPassword)
+		assert.True(t, link.ValidPassword("secret"))
+		assert.False(t, link.ValidPassword(""))
+		assert.False(t, link.ValidPassword("wrong"))
+	})
+
+	t.Run("expiry and download limit", func(t *testing.T) {
+		link, err := NewShareLink("lineage", "owner", LinkOpts{
+			ExpiresIn:    time.Hour,
+			MaxDownloads: 2,
+		})
+		require.NoError(t, err)
+
+		assert.False(t, link.HasExpired())
+		assert.False(t, link.IsExhausted())
+
+		link.DownloadCount = 2
+		assert.True(t, link.IsExhausted())
+
+		past := time.Now().Add(-time.Minute)
+		link.ExpiresAt = &past
+		assert.True(t, link.HasExpired())
+	})
+}
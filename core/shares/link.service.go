@@ -0,0 +1,297 @@
+package shares
+
+import (
+	"arbokcore/core/database"
+	"arbokcore/pkg/squirtle"
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	CreateShareLinkStmt             = "CreateShareLink"
+	GetShareLinkByTokenStmt         = "GetShareLinkByToken"
+	GetShareLinksForLineageStmt     = "GetShareLinksForLineage"
+	RevokeShareLinkStmt             = "RevokeShareLink"
+	ClaimShareLinkDownloadStmt      = "ClaimShareLinkDownload"
+	GetCurrentVersionForLineageStmt = "GetCurrentVersionForLineage"
+)
+
+var (
+	ErrLinkNotFound        = errors.New("link_not_found:7010:404")
+	ErrLinkRevoked         = errors.New("link_revoked:7011:410")
+	ErrLinkExpired         = errors.New("link_expired:7012:410")
+	ErrLinkExhausted       = errors.New("link_download_limit_reached:7013:410")
+	ErrLinkPasswordInvalid = errors.New("link_password_invalid:7014:401")
+	ErrLinkCreateFailed    = errors.New("link_create_failed:7015:500")
+	ErrInvalidLinkOpts     = errors.New("invalid_link_options:7016:422")
+)
+
+type LinksRepository struct {
+	conn    *sqlx.DB
+	querier squirtle.QueryMapper
+}
+
+func NewLinksRepository(conn *sqlx.DB, querier squirtle.QueryMapper) *LinksRepository {
+	return &LinksRepository{conn: conn, querier: querier}
+}
+
+func (slf *LinksRepository) prepare(ctx context.Context, stmtKey string) (*sqlx.NamedStmt, error) {
+	stmt, ok := slf.querier.GetQuery(stmtKey)
+	if !ok {
+		return nil, ErrorStmtNotFound
+	}
+
+	nstmt, err := slf.conn.PrepareNamedContext(ctx, stmt)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to prepare named stmt")
+		return nil, err
+	}
+
+	return nstmt, nil
+}
+
+// exec runs the statement and returns the number of rows it changed
+func (slf *LinksRepository) exec(ctx context.Context, stmtKey string, args map[string]any) (int64, error) {
+	stmt, ok := slf.querier.GetQuery(stmtKey)
+	if !ok {
+		return 0, ErrorStmtNotFound
+	}
+
+	result, err := slf.conn.NamedExecContext(ctx, stmt, args)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func (slf *LinksRepository) Create(ctx context.Context, link *ShareLink) error {
+	stmt, ok := slf.querier.GetQuery(CreateShareLinkStmt)
+	if !ok {
+		return ErrorStmtNotFound
+	}
+
+	_, err := slf.conn.NamedExecContext(ctx, stmt, link)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to create share link")
+		return ErrLinkCreateFailed
+	}
+
+	return nil
+}
+
+func (slf *LinksRepository) FindByToken(ctx context.Context, token string) (*ShareLink, error) {
+	nstmt, err := slf.prepare(ctx, GetShareLinkByTokenStmt)
+	if err != nil {
+		return nil, ErrLookupFailed
+	}
+	defer nstmt.Close()
+
+	link := &ShareLink{}
+
+	err = nstmt.GetContext(ctx, link, map[string]any{"token_hash": HashLinkToken(token)})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrLinkNotFound
+	}
+
+	if err != nil {
+		log.Error().Err(err).Msg("failed to find share link")
+		return nil, ErrLookupFailed
+	}
+
+	link.Protected = link.HashedPassword != nil
+	return link, nil
+}
+
+func (slf *LinksRepository) ListForLineage(ctx context.Context, ownerID, lineageID string) ([]*ShareLink, error) {
+	nstmt, err := slf.prepare(ctx, GetShareLinksForLineageStmt)
+	if err != nil {
+		return nil, ErrLookupFailed
+	}
+	defer nstmt.Close()
+
+	links := []*ShareLink{}
+
+	err = nstmt.SelectContext(ctx, &links, map[string]any{
+		"lineage_id": lineageID,
+		"owner_id":   ownerID,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list share links")
+		return nil, ErrLookupFailed
+	}
+
+	for _, link := range links {
+		link.Protected = link.HashedPassword != nil
+	}
+
+	return links, nil
+}
+
+func (slf *LinksRepository) Revoke(ctx context.Context, ownerID, lineageID, linkID string) error {
+	affected, err := slf.exec(ctx, RevokeShareLinkStmt, map[string]any{
+		"id":         linkID,
+		"lineage_id": lineageID,
+		"owner_id":   ownerID,
+		"revoked_at": database.Now(),
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to revoke share link")
+		return ErrShareFailed
+	}
+
+	if affected == 0 {
+		return ErrLinkNotFound
+	}
+
+	return nil
+}
+
+// ClaimDownload counts a download against the link. The limit is checked
+// in the update itself, so concurrent downloads can't go over it.
+func (slf *LinksRepository) ClaimDownload(ctx context.Context, linkID string) error {
+	affected, err := slf.exec(ctx, ClaimShareLinkDownloadStmt, map[string]any{
+		"id":         linkID,
+		"updated_at": database.Now(),
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to claim share link download")
+		return ErrLookupFailed
+	}
+
+	if affected == 0 {
+		return ErrLinkExhausted
+	}
+
+	return nil
+}
+
+// FindCurrentVersion walks the prev_id chain down from the
+// first version of the file to the current one
+func (slf *LinksRepository) FindCurrentVersion(ctx context.Context, lineageID string) (string, error) {
+	nstmt, err := slf.prepare(ctx, GetCurrentVersionForLineageStmt)
+	if err != nil {
+		return "", ErrLookupFailed
+	}
+	defer nstmt.Close()
+
+	var fileID string
+
+	err = nstmt.GetContext(ctx, &fileID, map[string]any{"lineage_id": lineageID})
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrFileNotFound
+	}
+
+	if err != nil {
+		log.Error().Err(err).Msg("failed to find current version")
+		return "", ErrLookupFailed
+	}
+
+	return fileID, nil
+}
+
+type LinkService struct {
+	repo     *LinksRepository
+	shareSvc *ShareService
+}
+
+func NewLinkService(repo *LinksRepository, shareSvc *ShareService) *LinkService {
+	return &LinkService{repo: repo, shareSvc: shareSvc}
+}
+
+// CreateLink makes a public link to the file lineage. Only the owner can
+// create links. The returned link carries the token, it can't be read back.
+func (slf *LinkService) CreateLink(
+	ctx context.Context,
+	ownerID string,
+	fileID string,
+	opts LinkOpts,
+) (*ShareLink, error) {
+
+	if opts.ExpiresIn < 0 || opts.MaxDownloads < 0 ||
+		len(opts.Password) > MaxLinkPasswordLen {
+
+		return nil, ErrInvalidLinkOpts
+	}
+
+	access, err := slf.shareSvc.Authorize(ctx, ownerID, fileID, PermissionOwner)
+	if err != nil {
+		return nil, err
+	}
+
+	link, err := NewShareLink(access.LineageID, ownerID, opts)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to build share link")
+		return nil, ErrLinkCreateFailed
+	}
+
+	if err := slf.repo.Create(ctx, link); err != nil {
+		return nil, err
+	}
+
+	return link, nil
+}
+
+func (slf *LinkService) ListLinks(ctx context.Context, ownerID, fileID string) ([]*ShareLink, error) {
+	access, err := slf.shareSvc.Authorize(ctx, ownerID, fileID, PermissionOwner)
+	if err != nil {
+		return nil, err
+	}
+
+	return slf.repo.ListForLineage(ctx, ownerID, access.LineageID)
+}
+
+func (slf *LinkService) RevokeLink(ctx context.Context, ownerID, fileID, linkID string) error {
+	access, err := slf.shareSvc.Authorize(ctx, ownerID, fileID, PermissionOwner)
+	if err != nil {
+		return err
+	}
+
+	return slf.repo.Revoke(ctx, ownerID, access.LineageID, linkID)
+}
+
+// Resolve validates the link token and password, counts the download and
+// returns read access to the current version of the linked file lineage.
+func (slf *LinkService) Resolve(ctx context.Context, token, password string) (*FileAccess, error) {
+	link, err := slf.repo.FindByToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if link.IsRevoked() {
+		return nil, ErrLinkRevoked
+	}
+
+	if link.HasExpired() {
+		return nil, ErrLinkExpired
+	}
+
+	if link.IsExhausted() {
+		return nil, ErrLinkExhausted
+	}
+
+	if !link.ValidPassword(password) {
+		log.Info().Str("link_id", link.ID).Msg("share link password mismatch")
+		return nil, ErrLinkPasswordInvalid
+	}
+
+	fileID, err := slf.repo.FindCurrentVersion(ctx, link.LineageID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := slf.repo.ClaimDownload(ctx, link.ID); err != nil {
+		return nil, err
+	}
+
+	return &FileAccess{
+		FileID:     fileID,
+		LineageID:  link.LineageID,
+		OwnerID:    link.OwnerID,
+		Permission: PermissionRead,
+	}, nil
+}
@@ -0,0 +1,115 @@
+--sql:CreateShareLink
+
+INSERT INTO share_links (
+	id
+	,lineage_id
+	,owner_id
+	,token_hash
+	,hashedpass
+	,expires_at
+	,max_downloads
+	,download_count
+	,revoked_at
+	,created_at
+	,updated_at
+) VALUES (
+	:id
+	,:lineage_id
+	,:owner_id
+	,:token_hash
+	,:hashedpass
+	,:expires_at
+	,:max_downloads
+	,:download_count
+	,:revoked_at
+	,:created_at
+	,:updated_at
+);
+
+
+--sql:GetShareLinkByToken
+
+SELECT
+	id
+	,lineage_id
+	,owner_id
+	,token_hash
+	,hashedpass
+	,expires_at
+	,max_downloads
+	,download_count
+	,revoked_at
+	,created_at
+	,updated_at
+FROM share_links
+WHERE token_hash = :token_hash
+LIMIT 1;
+
+
+--sql:GetShareLinksForLineage
+
+SELECT
+	id
+	,lineage_id
+	,owner_id
+	,token_hash
+	,hashedpass
+	,expires_at
+	,max_downloads
+	,download_count
+	,revoked_at
+	,created_at
+	,updated_at
+FROM share_links
+WHERE lineage_id = :lineage_id
+AND owner_id = :owner_id
+ORDER BY created_at DESC;
+
+
+--sql:RevokeShareLink
+
+UPDATE share_links
+SET
+	revoked_at = :revoked_at
+	,updated_at = :revoked_at
+WHERE id = :id
+AND lineage_id = :lineage_id
+AND owner_id = :owner_id
+AND revoked_at IS NULL;
+
+
+--sql:ClaimShareLinkDownload
+
+UPDATE share_links
+SET
+	download_count = download_count + 1
+	,updated_at = :updated_at
+WHERE id = :id
+AND revoked_at IS NULL
+AND (max_downloads IS NULL OR download_count < max_downloads);
+
+
+--sql:GetCurrentVersionForLineage
+
+WITH RECURSIVE versions(id) AS (
+	SELECT id
+	FROM file_metadatas
+	WHERE id = :lineage_id
+
+	UNION ALL
+
+	SELECT fm.id
+	FROM file_metadatas fm
+	JOIN versions v
+	ON
+		fm.prev_id = v.id
+)
+SELECT
+	fm.id
+FROM versions v
+JOIN file_metadatas fm
+ON
+	fm.id = v.id
+WHERE fm.current_flag = 1
+AND fm.deleted_at IS NULL
+LIMIT 1;
@@ -0,0 +1,125 @@
+--sql:UpsertShare
+
+INSERT INTO file_shares (
+	id
+	,lineage_id
+	,owner_id
+	,shared_with
+	,permission
+	,created_at
+	,updated_at
+) VALUES (
+	:id
+	,:lineage_id
+	,:owner_id
+	,:shared_with
+	,:permission
+	,:created_at
+	,:updated_at
+)
+ON CONFLICT (lineage_id, shared_with) DO UPDATE SET
+	permission = excluded.permission
+	,updated_at = excluded.updated_at;
+
+
+--sql:GetSharesForLineage
+
+SELECT
+	id
+	,lineage_id
+	,owner_id
+	,shared_with
+	,permission
+	,created_at
+	,updated_at
+FROM file_shares
+WHERE lineage_id = :lineage_id
+AND owner_id = :owner_id
+ORDER BY created_at ASC;
+
+
+--sql:GetShareForUser
+
+SELECT
+	id
+	,lineage_id
+	,owner_id
+	,shared_with
+	,permission
+	,created_at
+	,updated_at
+FROM file_shares
+WHERE lineage_id = :lineage_id
+AND shared_with = :shared_with
+LIMIT 1;
+
+
+--sql:DeleteShare
+
+DELETE FROM file_shares
+WHERE lineage_id = :lineage_id
+AND owner_id = :owner_id
+AND shared_with = :shared_with;
+
+
+--sql:GetFileLineage
+
+WITH RECURSIVE lineage(id, prev_id, user_id, deleted_at) AS (
+	SELECT id, prev_id, user_id, deleted_at
+	FROM file_metadatas
+	WHERE id = :file_id
+
+	UNION ALL
+
+	SELECT fm.id, fm.prev_id, fm.user_id, fm.deleted_at
+	FROM file_metadatas fm
+	JOIN lineage l
+	ON
+		fm.id = l.prev_id
+)
+SELECT
+	id AS lineage_id
+	,user_id AS owner_id
+	,deleted_at
+FROM lineage
+WHERE prev_id IS NULL
+LIMIT 1;
+
+
+--sql:GetFilesSharedWithUser
+
+WITH RECURSIVE versions(lineage_id, id) AS (
+	SELECT lineage_id, lineage_id
+	FROM file_shares
+	WHERE shared_with = :shared_with
+
+	UNION ALL
+
+	SELECT v.lineage_id, fm.id
+	FROM file_metadatas fm
+	JOIN versions v
+	ON
+		fm.prev_id = v.id
+)
+SELECT
+	fm.id AS file_id
+	,fm.file_name
+	,fm.file_size
+	,fm.file_type
+	,fm.file_hash
+	,fs.lineage_id
+	,fs.owner_id
+	,fs.permission
+	,fs.created_at
+	,fs.updated_at
+FROM versions v
+JOIN file_metadatas fm
+ON
+	fm.id = v.id
+AND fm.current_flag = 1
+AND fm.deleted_at IS NULL
+JOIN file_shares fs
+ON
+	fs.lineage_id = v.lineage_id
+AND fs.shared_with = :shared_with
+ORDER BY fs.created_at DESC;
@@ -0,0 +1,71 @@
+package shares
+
+import (
+	"arbokcore/core/database"
+	"time"
+)
+
+const (
+	PermissionRead      = "read"
+	PermissionReadWrite = "read-write"
+
+	// Never stored, the owner of a file lineage has every permission
+	PermissionOwner = "owner"
+)
+
+// Shares are granted on the lineage of a file. The lineage is identified by
+// the first version of the file (prev_id IS NULL), so that every newer version
+// created through the prev_id chain is covered by the same share.
+type Share struct {
+	ID         string `db:"id" json:"shareID"`
+	LineageID  string `db:"lineage_id" json:"lineageID"`
+	OwnerID    string `db:"owner_id" json:"ownerID"`
+	SharedWith string `db:"shared_with" json:"sharedWith"`
+	Permission string `db:"permission" json:"permission"`
+
+	database.Timestamp
+}
+
+type FileAccess struct {
+	FileID     string
+	LineageID  string     `db:"lineage_id"`
+	OwnerID    string     `db:"owner_id"`
+	DeletedAt  *time.Time `db:"deleted_at"`
+	Permission string
+}
+
+func (access *FileAccess) IsTrashed() bool {
+	return access.DeletedAt != nil
+}
+
+type SharedFile struct {
+	FileID     string `db:"file_id" json:"fileID"`
+	Filename   string `db:"file_name" json:"fileName"`
+	FileSize   int64  `db:"file_size" json:"fileSize"`
+	FileType   string `db:"file_type" json:"fileType"`
+	FileHash   string `db:"file_hash" json:"fileHash"`
+	LineageID  string `db:"lineage_id" json:"lineageID"`
+	OwnerID    string `db:"owner_id" json:"ownerID"`
+	Permission string `db:"permission" json:"permission"`
+
+	CreatedAt time.Time `db:"created_at" json:"sharedAt"`
+	UpdatedAt time.Time `db:"updated_at" json:"updatedAt"`
+}
+
+func ValidPermission(permission string) bool {
+	return permission == PermissionRead || permission == PermissionReadWrite
+}
+
+// Allows checks if the granted permission is enough for the needed one
+func Allows(granted, needed string) bool {
+	switch granted {
+	case PermissionOwner:
+		return true
+	case PermissionReadWrite:
+		return needed == PermissionRead || needed == PermissionReadWrite
+	case PermissionRead:
+		return needed == PermissionRead
+	}
+
+	return false
+}
@@ -0,0 +1,38 @@
+package shares
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Allows(t *testing.T) {
+	t.Run("owner is allowed everything", func(t *testing.T) {
+		assert.True(t, Allows(PermissionOwner, PermissionRead))
+		assert.True(t, Allows(PermissionOwner, PermissionReadWrite))
+		assert.True(t, Allows(PermissionOwner, PermissionOwner))
+	})
+
+	t.Run("read write does not make you the owner", func(t *testing.T) {
+		assert.True(t, Allows(PermissionReadWrite, PermissionRead))
+		assert.True(t, Allows(PermissionReadWrite, PermissionReadWrite))
+		assert.False(t, Allows(PermissionReadWrite, PermissionOwner))
+	})
+
+	t.Run("read is only read", func(t *testing.T) {
+		assert.True(t, Allows(PermissionRead, PermissionRead))
+		assert.False(t, Allows(PermissionRead, PermissionReadWrite))
+	})
+
+	t.Run("unknown permissions allow nothing", func(t *testing.T) {
+		assert.False(t, Allows("", PermissionRead))
+		assert.False(t, Allows("admin", PermissionRead))
+	})
+}
+
+func Test_ValidPermission(t *testing.T) {
+	assert.True(t, ValidPermission(PermissionRead))
+	assert.True(t, ValidPermission(PermissionReadWrite))
+	assert.False(t, ValidPermission(PermissionOwner))
+	assert.False(t, ValidPermission("write"))
+}
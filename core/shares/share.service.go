@@ -0,0 +1,327 @@
+package shares
+
+import (
+	"arbokcore/core/database"
+	"arbokcore/core/users"
+	"arbokcore/pkg/squirtle"
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	UpsertShareStmt            = "UpsertShare"
+	GetSharesForLineageStmt    = "GetSharesForLineage"
+	GetShareForUserStmt        = "GetShareForUser"
+	DeleteShareStmt            = "DeleteShare"
+	GetFileLineageStmt         = "GetFileLineage"
+	GetFilesSharedWithUserStmt = "GetFilesSharedWithUser"
+)
+
+var (
+	ErrorStmtNotFound    = errors.New("stmt_not_found:7001:500")
+	ErrFileNotFound      = errors.New("file_not_found:7002:404")
+	ErrForbidden         = errors.New("forbidden:7003:403")
+	ErrShareFailed       = errors.New("share_failed:7004:500")
+	ErrShareNotFound     = errors.New("share_not_found:7005:404")
+	ErrInvalidPermission = errors.New("invalid_permission:7006:422")
+	ErrShareWithSelf     = errors.New("share_with_self:7007:422")
+	ErrUserNotFound      = errors.New("user_not_found:7008:404")
+	ErrLookupFailed      = errors.New("share_lookup_failed:7009:500")
+)
+
+type SharesRepository struct {
+	conn    *sqlx.DB
+	querier squirtle.QueryMapper
+}
+
+func NewSharesRepository(conn *sqlx.DB, querier squirtle.QueryMapper) *SharesRepository {
+	return &SharesRepository{conn: conn, querier: querier}
+}
+
+func (slf *SharesRepository) get(ctx context.Context, stmtKey string, dest any, args map[string]any) error {
+	stmt, ok := slf.querier.GetQuery(stmtKey)
+	if !ok {
+		return ErrorStmtNotFound
+	}
+
+	nstmt, err := slf.conn.PrepareNamedContext(ctx, stmt)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to prepare named stmt")
+		return err
+	}
+	defer nstmt.Close()
+
+	return nstmt.GetContext(ctx, dest, args)
+}
+
+func (slf *SharesRepository) selectAll(ctx context.Context, stmtKey string, dest any, args map[string]any) error {
+	stmt, ok := slf.querier.GetQuery(stmtKey)
+	if !ok {
+		return ErrorStmtNotFound
+	}
+
+	nstmt, err := slf.conn.PrepareNamedContext(ctx, stmt)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to prepare named stmt")
+		return err
+	}
+	defer nstmt.Close()
+
+	return nstmt.SelectContext(ctx, dest, args)
+}
+
+// FindLineage walks the prev_id chain up to the first version of the file
+func (slf *SharesRepository) FindLineage(ctx context.Context, fileID string) (*FileAccess, error) {
+	access := &FileAccess{FileID: fileID}
+
+	err := slf.get(ctx, GetFileLineageStmt, access, map[string]any{"file_id": fileID})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrFileNotFound
+	}
+
+	if err != nil {
+		log.Error().Err(err).Msg("failed to find file lineage")
+		return nil, ErrLookupFailed
+	}
+
+	return access, nil
+}
+
+func (slf *SharesRepository) FindShare(ctx context.Context, lineageID, userID string) (*Share, error) {
+	share := &Share{}
+
+	err := slf.get(ctx, GetShareForUserStmt, share, map[string]any{
+		"lineage_id":  lineageID,
+		"shared_with": userID,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrShareNotFound
+	}
+
+	if err != nil {
+		log.Error().Err(err).Msg("failed to find share")
+		return nil, ErrLookupFailed
+	}
+
+	return share, nil
+}
+
+func (slf *SharesRepository) Upsert(ctx context.Context, share *Share) error {
+	stmt, ok := slf.querier.GetQuery(UpsertShareStmt)
+	if !ok {
+		return ErrorStmtNotFound
+	}
+
+	_, err := slf.conn.NamedExecContext(ctx, stmt, share)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to upsert share")
+		return ErrShareFailed
+	}
+
+	return nil
+}
+
+func (slf *SharesRepository) ListForLineage(ctx context.Context, ownerID, lineageID string) ([]*Share, error) {
+	shares := []*Share{}
+
+	err := slf.selectAll(ctx, GetSharesForLineageStmt, &shares, map[string]any{
+		"lineage_id": lineageID,
+		"owner_id":   ownerID,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list shares")
+		return nil, ErrLookupFailed
+	}
+
+	return shares, nil
+}
+
+func (slf *SharesRepository) ListSharedWith(ctx context.Context, userID string) ([]*SharedFile, error) {
+	sharedFiles := []*SharedFile{}
+
+	err := slf.selectAll(ctx, GetFilesSharedWithUserStmt, &sharedFiles, map[string]any{
+		"shared_with": userID,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list files shared with user")
+		return nil, ErrLookupFailed
+	}
+
+	return sharedFiles, nil
+}
+
+func (slf *SharesRepository) Delete(ctx context.Context, ownerID, lineageID, userID string) error {
+	stmt, ok := slf.querier.GetQuery(DeleteShareStmt)
+	if !ok {
+		return ErrorStmtNotFound
+	}
+
+	result, err := slf.conn.NamedExecContext(ctx, stmt, map[string]any{
+		"lineage_id":  lineageID,
+		"owner_id":    ownerID,
+		"shared_with": userID,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to delete share")
+		return ErrShareFailed
+	}
+
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return ErrShareNotFound
+	}
+
+	return nil
+}
+
+type ShareService struct {
+	repo    *SharesRepository
+	userSvc *users.UserService
+}
+
+func NewShareService(repo *SharesRepository, userSvc *users.UserService) *ShareService {
+	return &ShareService{repo: repo, userSvc: userSvc}
+}
+
+// Authorize checks if the user can access the file with the needed permission,
+// either as the owner of the file lineage or through a share. Trashed files
+// can't be accessed, see AuthorizeTrashed.
+func (slf *ShareService) Authorize(
+	ctx context.Context,
+	userID string,
+	fileID string,
+	needed string,
+) (*FileAccess, error) {
+
+	access, err := slf.repo.FindLineage(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	if access.IsTrashed() {
+		return nil, ErrFileNotFound
+	}
+
+	if access.OwnerID == userID {
+		access.Permission = PermissionOwner
+		return access, nil
+	}
+
+	share, err := slf.repo.FindShare(ctx, access.LineageID, userID)
+	if errors.Is(err, ErrShareNotFound) {
+		log.Info().Str("file_id", fileID).Msg("file not shared with user")
+		return nil, ErrForbidden
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !Allows(share.Permission, needed) {
+		log.Info().
+			Str("granted", share.Permission).
+			Str("needed", needed).
+			Msg("insufficient share permission")
+
+		return nil, ErrForbidden
+	}
+
+	access.Permission = share.Permission
+	return access, nil
+}
+
+// AuthorizeTrashed is Authorize for the files in the trash,
+// which only the owner can see, restore or purge
+func (slf *ShareService) AuthorizeTrashed(ctx context.Context, userID, fileID string) (*FileAccess, error) {
+	access, err := slf.repo.FindLineage(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !access.IsTrashed() || access.OwnerID != userID {
+		return nil, ErrFileNotFound
+	}
+
+	access.Permission = PermissionOwner
+	return access, nil
+}
+
+// ShareFile grants, or changes, the access of the user with
+// the email to the lineage of the file. Only the owner can share.
+func (slf *ShareService) ShareFile(
+	ctx context.Context,
+	ownerID string,
+	fileID string,
+	email string,
+	permission string,
+) (*Share, error) {
+
+	if !ValidPermission(permission) {
+		return nil, ErrInvalidPermission
+	}
+
+	access, err := slf.Authorize(ctx, ownerID, fileID, PermissionOwner)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := slf.userSvc.FindByEmail(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil {
+		return nil, ErrUserNotFound
+	}
+
+	if user.ID == ownerID {
+		return nil, ErrShareWithSelf
+	}
+
+	id, err := database.NewID()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to generate id")
+		return nil, ErrShareFailed
+	}
+
+	share := &Share{
+		ID:         id,
+		LineageID:  access.LineageID,
+		OwnerID:    ownerID,
+		SharedWith: user.ID,
+		Permission: permission,
+		Timestamp:  database.NewTimestamp(),
+	}
+
+	if err := slf.repo.Upsert(ctx, share); err != nil {
+		return nil, err
+	}
+
+	// On conflict the existing row is kept, so read it back
+	return slf.repo.FindShare(ctx, access.LineageID, user.ID)
+}
+
+func (slf *ShareService) ListShares(ctx context.Context, ownerID, fileID string) ([]*Share, error) {
+	access, err := slf.Authorize(ctx, ownerID, fileID, PermissionOwner)
+	if err != nil {
+		return nil, err
+	}
+
+	return slf.repo.ListForLineage(ctx, ownerID, access.LineageID)
+}
+
+func (slf *ShareService) RevokeShare(ctx context.Context, ownerID, fileID, userID string) error {
+	access, err := slf.Authorize(ctx, ownerID, fileID, PermissionOwner)
+	if err != nil {
+		return err
+	}
+
+	return slf.repo.Delete(ctx, ownerID, access.LineageID, userID)
+}
+
+func (slf *ShareService) ListSharedWithMe(ctx context.Context, userID string) ([]*SharedFile, error) {
+	return slf.repo.ListSharedWith(ctx, userID)
+}
@@ -4,6 +4,7 @@ import (
 	"arbokcore/core/database"
 	"arbokcore/core/files"
 	"arbokcore/core/notifiers"
+	"arbokcore/pkg/blobstore"
 	"arbokcore/pkg/queuer"
 	"arbokcore/pkg/utils"
 	"arbokcore/pkg/workerpool"
@@ -72,16 +73,18 @@ func (slf *MetadataChangelog) Produce(ctx context.Context) chan []*queuer.Payloa
 type MetadataExecutor struct {
 	repo     *files.MetadataRepository
 	crepo    *files.UserFileRepository
+	storage  blobstore.BlobStorage
 	notifier *notifiers.MetadataUpdateStatus
 }
 
 func NewMetadataExecutor(
 	repo *files.MetadataRepository,
 	crepo *files.UserFileRepository,
+	storage blobstore.BlobStorage,
 	notifier *notifiers.MetadataUpdateStatus,
 ) *MetadataExecutor {
 
-	return &MetadataExecutor{repo: repo, crepo: crepo, notifier: notifier}
+	return &MetadataExecutor{repo: repo, crepo: crepo, storage: storage, notifier: notifier}
 }
 
 func (slf *MetadataExecutor) ExecuteEach(ctx context.Context, cachedData *files.CacheMetadata) error {
@@ -112,21 +115,7 @@ func (slf *MetadataExecutor) ExecuteEach(ctx context.Context, cachedData *files.
 
 	//TODO: Add tests for refactoring
 	if cachedData.PrevID == nil {
-		err := slf.repo.Update(
-			ctx,
-			cachedData.PrevID,
-			cachedData.ID,
-			files.StatusCompleted,
-		)
-		if err != nil {
-			log.Error().
-				Err(err).
-				Msg("failed to update file metadata")
-
-			return err
-		}
-
-		return nil
+		return slf.promote(ctx, cachedData, files.StatusCompleted)
 	}
 
 	filesWithChunks, err := slf.repo.SelectFiles(ctx, ids)
@@ -162,11 +151,7 @@ func (slf *MetadataExecutor) ExecuteEach(ctx context.Context, cachedData *files.
 		prevFile = resps[0]
 	}
 
-	var fillerChunks map[string]*files.FilesWithChunks
-
-	if thisFile.NChunks == prevFile.NChunks {
-		fillerChunks = RestOfChunks(thisFile, prevFile)
-	}
+	fillerChunks := FillerChunks(thisFile, prevFile)
 
 	isValid := Validate(ReconstructChunks(thisFile, prevFile), prevFile)
 	log.Info().Bool("isvalid", isValid).Msg("file reconstruction validation")
@@ -174,21 +159,7 @@ func (slf *MetadataExecutor) ExecuteEach(ctx context.Context, cachedData *files.
 	if len(fillerChunks) == 0 {
 		log.Info().Msg("no matching chunks, file completely replaced")
 
-		err = slf.repo.Update(
-			ctx,
-			cachedData.PrevID,
-			cachedData.ID,
-			files.StatusCompleted,
-		)
-		if err != nil {
-			log.Error().
-				Err(err).
-				Msg("failed to update file metadata")
-
-			return err
-		}
-
-		return nil
+		return slf.promote(ctx, cachedData, files.StatusCompleted)
 	}
 
 	chunks := []*files.UserFile{}
@@ -201,6 +172,8 @@ func (slf *MetadataExecutor) ExecuteEach(ctx context.Context, cachedData *files.
 			ChunkBlobUrl: chunk.ChunkBlobUrl,
 			ChunkHash:    chunk.ChunkHash,
 			NextChunkID:  chunk.NextChunkID,
+			ChunkOffset:  chunk.ChunkOffset,
+			ChunkSize:    chunk.ChunkSize,
 			Timestamp:    database.NewTimestamp(),
 		}
 		chunks = append(chunks, uf)
@@ -219,7 +192,35 @@ func (slf *MetadataExecutor) ExecuteEach(ctx context.Context, cachedData *files.
 	}
 
 	log.Info().Str("upload_status", uploadStatus).Msg("updating the current flag now")
-	err = slf.repo.Update(
+	return slf.promote(ctx, cachedData, uploadStatus)
+}
+
+// promote makes the new version the current one. A completed upload is
+// first checked against the digest the client sent for the whole file,
+// and on mismatch the version is marked failed instead.
+func (slf *MetadataExecutor) promote(
+	ctx context.Context,
+	cachedData *files.CacheMetadata,
+	uploadStatus string,
+) error {
+
+	if uploadStatus == files.StatusCompleted {
+		err := slf.verify(ctx, cachedData.ID)
+		if errors.Is(err, files.ErrDigestMismatch) {
+			if _, ferr := slf.repo.MarkFailed(ctx, cachedData.ID); ferr != nil {
+				log.Error().Err(ferr).Msg("failed to mark upload failed")
+				return ferr
+			}
+
+			return err
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err := slf.repo.Update(
 		ctx,
 		cachedData.PrevID,
 		cachedData.ID,
@@ -234,6 +235,34 @@ func (slf *MetadataExecutor) ExecuteEach(ctx context.Context, cachedData *files.
 	return err
 }
 
+func (slf *MetadataExecutor) verify(ctx context.Context, fileID string) error {
+	results, err := slf.repo.FindBy(ctx, files.FindClause{
+		{Key: "id", Operator: "=", Val: fileID},
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(results) == 0 {
+		return errors.New("file_not_found")
+	}
+
+	metadata := results[0]
+
+	// Nothing to check the file against
+	if metadata.FileHash == "" {
+		log.Warn().Str("file_id", fileID).Msg("file has no digest, skipping verification")
+		return nil
+	}
+
+	chunks, err := slf.crepo.GetChunksForFile(ctx, fileID)
+	if err != nil {
+		return err
+	}
+
+	return files.VerifyDigest(ctx, slf.storage, metadata, chunks)
+}
+
 func (slf *MetadataExecutor) Execute(ctx context.Context, payloads []*queuer.Payload) error {
 	//Ideally there should be only 1 here
 	fmt.Printf("len of payloads %d, payloads %+v\n", len(payloads), payloads)
@@ -258,6 +287,18 @@ func (slf *MetadataExecutor) Execute(ctx context.Context, payloads []*queuer.Pay
 		}
 
 		err = slf.ExecuteEach(ctx, &cachedData)
+		if errors.Is(err, files.ErrDigestMismatch) {
+			updateSuccessEvents = append(updateSuccessEvents, &notifiers.MetadataUpdateStatusEvent{
+				FileID:     cachedData.ID,
+				UserID:     cachedData.UserID,
+				DeviceID:   cachedData.DeviceID,
+				PrevFileID: cachedData.PrevID,
+				Action:     notifiers.ActionFailed,
+			})
+
+			continue
+		}
+
 		if err != nil {
 			return err
 		}
@@ -292,6 +333,24 @@ func (slf *MetadataExecutor) Execute(ctx context.Context, payloads []*queuer.Pay
 	return err
 }
 
+// FillerChunks returns the chunks the new version takes from the previous
+// one. A version negotiated with the chunk hashes had every chunk linked or
+// uploaded explicitly, so nothing is taken for it. Neither is anything taken
+// for content defined chunks: every one of them is sent, and the ones without
+// data are linked to the blob of their hash when they are.
+func FillerChunks(thisFile, prevFile *files.FileInfoResponse) map[string]*files.FilesWithChunks {
+	switch {
+	case thisFile.ExplicitChunks || thisFile.Chunking == files.ChunkingCDC:
+		return nil
+
+	// Fixed chunks only line up by index with fixed chunks
+	case thisFile.NChunks == prevFile.NChunks && prevFile.Chunking != files.ChunkingCDC:
+		return RestOfChunks(thisFile, prevFile)
+	}
+
+	return nil
+}
+
 func RestOfChunks(thisFile, prevFile *files.FileInfoResponse) map[string]*files.FilesWithChunks {
 	matchedChunks := map[string]*files.FilesWithChunks{}
 
@@ -364,6 +423,7 @@ func MetadataSupervisor(
 	ctx context.Context,
 	repo *files.MetadataRepository,
 	crepo *files.UserFileRepository,
+	storage blobstore.BlobStorage,
 	producer *MetadataChangelog,
 	notifier *notifiers.MetadataUpdateStatus,
 
@@ -372,7 +432,7 @@ func MetadataSupervisor(
 	log.Info().Msg("starting metadata changelog supervisor")
 
 	// This is the processorFunc for each worker
-	executor := NewMetadataExecutor(repo, crepo, notifier)
+	executor := NewMetadataExecutor(repo, crepo, storage, notifier)
 
 	// WorkerPool that will Process each Redis Message
 	pool := workerpool.NewWorkerPool(1, executor.Execute, false)
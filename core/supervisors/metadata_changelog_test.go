@@ -198,6 +198,55 @@ func Test_RestOfChunks(t *testing.T) {
 	require.Equal(t, len(chunks), 1)
 }
 
+func Test_FillerChunks(t *testing.T) {
+	prevFile := &files.FileInfoResponse{
+		Chunking: files.ChunkingFixed,
+		NChunks:  3,
+		Chunks: map[string]*files.FilesWithChunks{
+			"0": {ChunkID: 0, ChunkHash: "a", ChunkBlobUrl: "/prev/0"},
+			"1": {ChunkID: 1, ChunkHash: "b", ChunkBlobUrl: "/prev/1"},
+			"2": {ChunkID: 2, ChunkHash: "c", ChunkBlobUrl: "/prev/2"},
+		},
+	}
+
+	// Chunk 2 was never uploaded
+	thisFile := &files.FileInfoResponse{
+		Chunking: files.ChunkingFixed,
+		NChunks:  3,
+		Chunks: map[string]*files.FilesWithChunks{
+			"0": {ChunkID: 0, ChunkHash: "a", ChunkBlobUrl: "/prev/0"},
+			"1": {ChunkID: 1, ChunkHash: "new", ChunkBlobUrl: "/this/1"},
+		},
+	}
+
+	t.Run("taken by index", func(t *testing.T) {
+		chunks := FillerChunks(thisFile, prevFile)
+		require.Len(t, chunks, 1)
+		require.Equal(t, "/prev/2", chunks["2"].ChunkBlobUrl)
+	})
+
+	t.Run("not guessed for a negotiated version", func(t *testing.T) {
+		explicit := *thisFile
+		explicit.ExplicitChunks = true
+
+		require.Empty(t, FillerChunks(&explicit, prevFile))
+	})
+
+	t.Run("not lined up with content defined chunks", func(t *testing.T) {
+		cdc := *prevFile
+		cdc.Chunking = files.ChunkingCDC
+
+		require.Empty(t, FillerChunks(thisFile, &cdc))
+	})
+
+	t.Run("not taken for content defined chunks", func(t *testing.T) {
+		cdc := *thisFile
+		cdc.Chunking = files.ChunkingCDC
+
+		require.Empty(t, FillerChunks(&cdc, prevFile))
+	})
+}
+
 func Test_ReconstructChunks(t *testing.T) {
 	thisFile := &files.FileInfoResponse{}
 
@@ -7,6 +7,9 @@ INSERT INTO tokens (
 	,user_id
 	,access_token
 	,refresh_token
+	,family_id
+	,device_id
+	,revoked_at
 	,access_expires_at
 	,refresh_expires_at
 	,created_at
@@ -18,6 +21,9 @@ INSERT INTO tokens (
 	,:user_id
 	,:access_token
 	,:refresh_token
+	,:family_id
+	,:device_id
+	,:revoked_at
 	,:access_expires_at
 	,:refresh_expires_at
 	,:created_at
@@ -27,20 +33,27 @@ INSERT INTO tokens (
 --sql:GetAccessToken
 
 SELECT
-	resource_id
-	,resource_type
-	,token_type
-	,user_id
-	,access_token
-	,refresh_token
-	,access_expires_at
-	,refresh_expires_at
-	,created_at
-	,updated_at
-FROM tokens
-WHERE access_token = :access_token
-AND resource_id = :resource_id
-AND resource_type = :resource_type
+	t.resource_id
+	,t.resource_type
+	,t.token_type
+	,t.user_id
+	,t.access_token
+	,t.refresh_token
+	,t.family_id
+	,COALESCE(t.device_id, '') AS device_id
+	,t.revoked_at
+	,t.access_expires_at
+	,t.refresh_expires_at
+	,t.created_at
+	,t.updated_at
+	,COALESCE(u.blocked, 0) AS user_blocked
+FROM tokens t
+JOIN users u
+ON
+	u.id = t.resource_id
+WHERE t.access_token = :access_token
+AND t.resource_type = :resource_type
+AND t.revoked_at IS NULL
 LIMIT 1;
 
 --sql:GetStreamToken
@@ -52,6 +65,7 @@ SELECT
 	,user_id
 	,access_token
 	,refresh_token
+	,COALESCE(device_id, '') AS device_id
 	,access_expires_at
 	,refresh_expires_at
 	,created_at
@@ -61,5 +75,78 @@ WHERE access_token = :access_token
 AND resource_id = :resource_id
 AND user_id = :user_id
 AND resource_type = :resource_type
+AND revoked_at IS NULL
 LIMIT 1;
 
+--sql:GetRefreshToken
+
+SELECT
+	t.resource_id
+	,t.resource_type
+	,t.token_type
+	,t.user_id
+	,t.access_token
+	,t.refresh_token
+	,t.family_id
+	,COALESCE(t.device_id, '') AS device_id
+	,t.revoked_at
+	,t.access_expires_at
+	,t.refresh_expires_at
+	,t.created_at
+	,t.updated_at
+	,COALESCE(u.blocked, 0) AS user_blocked
+FROM tokens t
+JOIN users u
+ON
+	u.id = t.resource_id
+WHERE t.refresh_token = :refresh_token
+AND t.resource_type = :resource_type
+LIMIT 1;
+
+--sql:RevokeRefreshToken
+
+UPDATE tokens
+SET
+	revoked_at = :revoked_at
+	,updated_at = :revoked_at
+WHERE refresh_token = :refresh_token
+AND revoked_at IS NULL;
+
+--sql:RevokeTokenFamily
+
+UPDATE tokens
+SET
+	revoked_at = :revoked_at
+	,updated_at = :revoked_at
+WHERE family_id = :family_id
+AND revoked_at IS NULL;
+
+--sql:BindDeviceToFamily
+
+UPDATE tokens
+SET
+	device_id = :device_id
+	,updated_at = :updated_at
+WHERE family_id = :family_id
+AND revoked_at IS NULL;
+
+--sql:RevokeDeviceTokens
+
+UPDATE tokens
+SET
+	revoked_at = :revoked_at
+	,updated_at = :revoked_at
+WHERE device_id = :device_id
+AND user_id = :user_id
+AND revoked_at IS NULL;
+
+--sql:RevokeResourceTokens
+
+UPDATE tokens
+SET
+	access_expires_at = :revoked_at
+	,revoked_at = :revoked_at
+	,updated_at = :revoked_at
+WHERE resource_id = :resource_id
+AND resource_type = :resource_type
+AND revoked_at IS NULL;
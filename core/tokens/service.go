@@ -1,8 +1,10 @@
 package tokens
 
 import (
+	"arbokcore/core/database"
 	"arbokcore/pkg/squirtle"
 	"context"
+	"database/sql"
 	"errors"
 
 	"github.com/jmoiron/sqlx"
@@ -22,9 +24,12 @@ type FindByClause struct {
 }
 
 type Repository interface {
-	CreateSession(ctx context.Context, resourceID, resourceType string, userID *string) (*Token, error)
+	CreateSession(ctx context.Context, resourceID, resourceType string, userID *string, opts ...TokenOpts) (*Token, error)
 	FindByAccessToken(ctx context.Context, clause FindByClause) (*Token, error)
 	FindByStreamToken(ctx context.Context, clause FindByClause) (*Token, error)
+	FindByRefreshToken(ctx context.Context, clause FindByClause) (*Token, error)
+	RotateSession(ctx context.Context, token *Token) (*Token, error)
+	RevokeFamily(ctx context.Context, familyID string) error
 }
 
 type TokensRepository struct {
@@ -41,15 +46,26 @@ func NewTokensRepository(
 }
 
 const (
-	CreateTokenStmt    = "CreateToken"
-	GetAccessTokenStmt = "GetAccessToken"
-	GetStreamTokenStmt = "GetStreamToken"
+	CreateTokenStmt        = "CreateToken"
+	GetAccessTokenStmt     = "GetAccessToken"
+	GetStreamTokenStmt     = "GetStreamToken"
+	GetRefreshTokenStmt    = "GetRefreshToken"
+	RevokeRefreshTokenStmt = "RevokeRefreshToken"
+	RevokeTokenFamilyStmt  = "RevokeTokenFamily"
+	BindDeviceToFamilyStmt = "BindDeviceToFamily"
+	RevokeDeviceTokensStmt = "RevokeDeviceTokens"
+
+	RevokeResourceTokensStmt = "RevokeResourceTokens"
 )
 
 var (
 	ErrTokenNotFound    = errors.New("token_not_found")
 	ErrTokenExpired     = errors.New("token_expired:2007:410")
 	ErrStatmentNotFound = errors.New("stmt_not_found:2008:500")
+	ErrUserBlocked      = errors.New("user_blocked:2009:403")
+	ErrTokenReused      = errors.New("refresh_token_reused:2010:401")
+	ErrTokenRotate      = errors.New("token_rotate_failed:3003:500")
+	ErrTokenRevoke      = errors.New("token_revoke_failed:3004:500")
 )
 
 func (tsrepo *TokensRepository) FindByAccessToken(
@@ -63,41 +79,57 @@ func (tsrepo *TokensRepository) FindByAccessToken(
 		return tsrepo.findByTestMode(ctx, clause)
 	}
 
-	stmt, ok := tsrepo.querier.GetQuery(GetStreamTokenStmt)
+	token, err := tsrepo.findOne(ctx, GetAccessTokenStmt, map[string]any{
+		"access_token":  clause.AccessToken,
+		"resource_type": ResourceTypeUser,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to get session access token")
+		return nil, err
+	}
+
+	if token.UserBlocked {
+		log.Error().Str("user_id", token.ResourceID).Msg("user is blocked")
+		return nil, ErrUserBlocked
+	}
+
+	if token.HasAccessExpired() {
+		log.Error().Msg("access token expired")
+		return nil, ErrTokenExpired
+	}
+
+	return token, nil
+}
+
+func (tsrepo *TokensRepository) findOne(
+	ctx context.Context,
+	stmtKey string,
+	args map[string]any,
+) (*Token, error) {
+
+	stmt, ok := tsrepo.querier.GetQuery(stmtKey)
 	if !ok {
 		return nil, ErrStatmentNotFound
 	}
 
-	token := &Token{}
-
-	rows, err := tsrepo.conn.NamedQueryContext(
-		ctx,
-		stmt,
-		map[string]any{
-			"access_token":  clause.AccessToken,
-			"resource_id":   clause.ResourceID, //user_id
-			"resource_type": "user",
-		},
-	)
+	nstmt, err := tsrepo.conn.PrepareNamedContext(ctx, stmt)
 	if err != nil {
-		log.Error().Err(err).Msg("failed to get session access token")
+		log.Error().Err(err).Msg("failed to prepare named stmt")
 		return nil, err
 	}
+	defer nstmt.Close()
 
-	for rows.Next() {
-		err = rows.StructScan(token)
+	token := &Token{}
+
+	err = nstmt.GetContext(ctx, token, args)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTokenNotFound
 	}
 
 	if err != nil {
-		log.Error().Err(err).Msg("failed to unmarshall access token")
 		return nil, err
 	}
 
-	if token.HasAccessExpired() {
-		log.Error().Msg("access token expired")
-		return nil, ErrTokenExpired
-	}
-
 	return token, nil
 }
 
@@ -136,38 +168,17 @@ func (tsrepo *TokensRepository) FindByStreamToken(
 	clause FindByClause,
 ) (*Token, error) {
 
-	stmt, ok := tsrepo.querier.GetQuery(GetStreamTokenStmt)
-	if !ok {
-		return nil, ErrStatmentNotFound
-	}
-
-	token := &Token{}
-
-	// log.Info().Msgf("token clause %+v", clause)
-	rows, err := tsrepo.conn.NamedQueryContext(
-		ctx,
-		stmt,
-		map[string]any{
-			"access_token":  clause.StreamToken,
-			"resource_id":   clause.ResourceID, //file_id
-			"resource_type": "stream",
-			"user_id":       clause.UserID,
-		},
-	)
+	token, err := tsrepo.findOne(ctx, GetStreamTokenStmt, map[string]any{
+		"access_token":  clause.StreamToken,
+		"resource_id":   clause.ResourceID, //file_id
+		"resource_type": ResourceTypeStream,
+		"user_id":       clause.UserID,
+	})
 	if err != nil {
 		log.Error().Err(err).Msg("failed to get stream access token")
 		return nil, err
 	}
 
-	for rows.Next() {
-		err = rows.StructScan(token)
-	}
-
-	if err != nil {
-		log.Error().Err(err).Msg("failed to destructure stream access token")
-		return nil, err
-	}
-
 	if token.HasAccessExpired() {
 		log.Error().Msg("stream token expired")
 		return nil, ErrTokenExpired
@@ -181,12 +192,17 @@ func (tsrepo *TokensRepository) CreateSession(
 	resourceID string,
 	resourceType string,
 	userID *string,
+	opts ...TokenOpts,
 ) (*Token, error) {
 
-	token, err := NewToken(
-		resourceID, resourceType, // We will get rid of this later
+	opts = append([]TokenOpts{
 		WithUserID(userID),
 		WithDefaultExpiry(),
+	}, opts...)
+
+	token, err := NewToken(
+		resourceID, resourceType, // We will get rid of this later
+		opts...,
 	)
 	if err != nil {
 		log.Error().Err(err).Msg("failed to build token")
@@ -206,3 +222,107 @@ func (tsrepo *TokensRepository) CreateSession(
 
 	return token, nil
 }
+
+// FindByRefreshToken also returns revoked tokens, so that
+// the caller can tell a replayed refresh token from an unknown one
+func (tsrepo *TokensRepository) FindByRefreshToken(
+	ctx context.Context,
+	clause FindByClause,
+) (*Token, error) {
+
+	token, err := tsrepo.findOne(ctx, GetRefreshTokenStmt, map[string]any{
+		"refresh_token": clause.RefreshToken,
+		"resource_type": ResourceTypeUser,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to get refresh token")
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// RotateSession revokes the token and issues a new access and refresh
+// token pair in the same family. If the token was already revoked by
+// a concurrent rotation, ErrTokenReused is returned.
+func (tsrepo *TokensRepository) RotateSession(
+	ctx context.Context,
+	token *Token,
+) (*Token, error) {
+
+	newToken, err := NewToken(
+		token.ResourceID, token.ResouceType,
+		WithUserID(token.UserID),
+		WithFamilyID(token.FamilyID),
+		WithDeviceID(token.DeviceID),
+		WithDefaultExpiry(),
+	)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to build token")
+		return nil, ErrTokenRotate
+	}
+
+	revokeStmt, ok := tsrepo.querier.GetQuery(RevokeRefreshTokenStmt)
+	if !ok {
+		return nil, ErrStatmentNotFound
+	}
+
+	createStmt, ok := tsrepo.querier.GetQuery(CreateTokenStmt)
+	if !ok {
+		return nil, ErrStatmentNotFound
+	}
+
+	tx, err := tsrepo.conn.BeginTxx(ctx, nil)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to init transaction")
+		return nil, ErrTokenRotate
+	}
+
+	result, err := tx.NamedExecContext(ctx, revokeStmt, map[string]any{
+		"refresh_token": token.RefreshToken,
+		"revoked_at":    database.Now(),
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to revoke refresh token")
+		tx.Rollback()
+		return nil, ErrTokenRotate
+	}
+
+	if affected, err := result.RowsAffected(); err != nil || affected != 1 {
+		log.Error().Msg("refresh token already rotated")
+		tx.Rollback()
+		return nil, ErrTokenReused
+	}
+
+	_, err = tx.NamedExecContext(ctx, createStmt, newToken)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to create rotated token")
+		tx.Rollback()
+		return nil, ErrTokenRotate
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Error().Err(err).Msg("failed to commit token rotation")
+		return nil, ErrTokenRotate
+	}
+
+	return newToken, nil
+}
+
+func (tsrepo *TokensRepository) RevokeFamily(ctx context.Context, familyID string) error {
+	stmt, ok := tsrepo.querier.GetQuery(RevokeTokenFamilyStmt)
+	if !ok {
+		return ErrStatmentNotFound
+	}
+
+	_, err := tsrepo.conn.NamedExecContext(ctx, stmt, map[string]any{
+		"family_id":  familyID,
+		"revoked_at": database.Now(),
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to revoke token family")
+		return ErrTokenRevoke
+	}
+
+	return nil
+}
@@ -16,7 +16,12 @@ type Token struct {
 	RefreshToken string  `db:"refresh_token"`
 	TokenType    string  `db:"token_type"`
 	UserID       *string `db:"user_id"`
-	DeviceID     string  `db:"-"`
+	DeviceID     string  `db:"device_id"`
+	UserBlocked  bool    `db:"user_blocked"`
+
+	// Every token rotated out of the same login shares a family
+	FamilyID  string     `db:"family_id"`
+	RevokedAt *time.Time `db:"revoked_at"`
 
 	AccessExpiresAt  time.Time `db:"access_expires_at"`
 	RefreshExpiresAt time.Time `db:"refresh_expires_at"`
@@ -40,6 +45,14 @@ func (token *Token) HasAccessExpired() bool {
 	return token.AccessExpiresAt.Before(database.Now())
 }
 
+func (token *Token) HasRefreshExpired() bool {
+	return token.RefreshExpiresAt.Before(database.Now())
+}
+
+func (token *Token) IsRevoked() bool {
+	return token.RevokedAt != nil
+}
+
 const (
 	ResourceTypeUser   string = "user"
 	ResourceTypeStream string = "stream"
@@ -96,6 +109,19 @@ func WithUserID(userID *string) TokenOpts {
 	}
 }
 
+func WithDeviceID(deviceID string) TokenOpts {
+	return func(t *Token) {
+		t.DeviceID = deviceID
+	}
+}
+
+// WithFamilyID keeps a rotated token in the family of the token it replaces
+func WithFamilyID(familyID string) TokenOpts {
+	return func(t *Token) {
+		t.FamilyID = familyID
+	}
+}
+
 func NewToken(resourceID, resourceType string, opts ...TokenOpts) (*Token, error) {
 	resourceType = strings.ToLower(resourceType)
 	if !ValidateResourceType(resourceType) {
@@ -112,11 +138,18 @@ func NewToken(resourceID, resourceType string, opts ...TokenOpts) (*Token, error
 		return nil, err
 	}
 
+	familyID, err := database.NewID()
+	if err != nil {
+		return nil, err
+	}
+
 	token := &Token{
 		ResourceID:       resourceID,
 		ResouceType:      resourceType,
+		TokenType:        resourceType,
 		AccessToken:      accessToken,
 		RefreshToken:     refreshToken,
+		FamilyID:         familyID,
 		RefreshExpiresAt: database.Now().Add(LongExpiryDuration),
 		Timestamp:        database.NewTimestamp(),
 	}
@@ -0,0 +1,49 @@
+package tokens
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_NewToken(t *testing.T) {
+	t.Run("new tokens start a new family", func(t *testing.T) {
+		first, err := NewToken("U1", ResourceTypeUser)
+		require.NoError(t, err)
+
+		second, err := NewToken("U1", ResourceTypeUser)
+		require.NoError(t, err)
+
+		require.NotEmpty(t, first.FamilyID)
+		require.NotEqual(t, first.FamilyID, second.FamilyID)
+		require.Equal(t, ResourceTypeUser, first.TokenType)
+		require.False(t, first.IsRevoked())
+	})
+
+	t.Run("rotated tokens keep the family", func(t *testing.T) {
+		first, err := NewToken("U1", ResourceTypeUser)
+		require.NoError(t, err)
+
+		rotated, err := NewToken("U1", ResourceTypeUser, WithFamilyID(first.FamilyID))
+		require.NoError(t, err)
+
+		require.Equal(t, first.FamilyID, rotated.FamilyID)
+		require.NotEqual(t, first.RefreshToken, rotated.RefreshToken)
+	})
+
+	t.Run("invalid resource type", func(t *testing.T) {
+		_, err := NewToken("U1", "device")
+		require.ErrorIs(t, err, ErrTokenValidationFailed)
+	})
+}
+
+func Test_HasRefreshExpired(t *testing.T) {
+	token, err := NewToken("U1", ResourceTypeUser)
+	require.NoError(t, err)
+
+	require.False(t, token.HasRefreshExpired())
+
+	token.RefreshExpiresAt = time.Now().Add(-1 * time.Minute)
+	require.True(t, token.HasRefreshExpired())
+}
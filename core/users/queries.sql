@@ -24,8 +24,22 @@ SELECT
 	,user_type
 	,email
 	,hashedpass
+	,COALESCE(blocked, 0) AS blocked
 FROM users
 WHERE 
 	email = :email AND 
 	user_type = :user_type;
 
+
+--sql:GetUserByID
+
+SELECT 
+	id
+	,user_type
+	,email
+	,hashedpass
+	,COALESCE(blocked, 0) AS blocked
+FROM users
+WHERE 
+	id = :id;
+
@@ -2,8 +2,12 @@ package users
 
 import (
 	"context"
+	"database/sql"
 	"errors"
+	"time"
 
+	"arbokcore/core/database"
+	"arbokcore/core/devices"
 	"arbokcore/core/tokens"
 	"arbokcore/pkg/squirtle"
 
@@ -12,31 +16,86 @@ import (
 )
 
 type Session struct {
+	UserID           string    `json:"userID"`
+	Email            string    `json:"email"`
+	DeviceID         string    `json:"deviceID,omitempty"`
+	AccessToken      string    `json:"accessToken"`
+	RefreshToken     string    `json:"refreshToken"`
+	AccessExpiresAt  time.Time `json:"accessExpiresAt"`
+	RefreshExpiresAt time.Time `json:"refreshExpiresAt"`
+}
+
+func NewSession(user *User, token *tokens.Token) *Session {
+	return &Session{
+		UserID:           user.ID,
+		Email:            user.Email,
+		DeviceID:         token.DeviceID,
+		AccessToken:      token.AccessToken,
+		RefreshToken:     token.RefreshToken,
+		AccessExpiresAt:  token.AccessExpiresAt,
+		RefreshExpiresAt: token.RefreshExpiresAt,
+	}
 }
 
 const (
-	CreateUserQueryKey = "CreateUserQuery"
-	SelectUserQueryKey = "GetUserByEmail"
+	CreateUserQueryKey     = "CreateUserQuery"
+	SelectUserQueryKey     = "GetUserByEmail"
+	SelectUserByIDQueryKey = "GetUserByID"
 )
 
 type Service interface {
 	Create(ctx context.Context, email, password string) (*Session, error)
+	Login(ctx context.Context, email, password, deviceID string) (*Session, error)
+	Refresh(ctx context.Context, refreshToken string) (*Session, error)
+	Logout(ctx context.Context, token *tokens.Token) error
 }
 
 type UserService struct {
-	conn    *sqlx.DB
-	querier squirtle.QueryMapper
+	conn       *sqlx.DB
+	querier    squirtle.QueryMapper
+	tokensRepo tokens.Repository
+	deviceSvc  *devices.DeviceService
 }
 
-func NewUserService(conn *sqlx.DB, querier squirtle.QueryMapper) *UserService {
-	return &UserService{conn: conn, querier: querier}
+func NewUserService(
+	conn *sqlx.DB,
+	querier squirtle.QueryMapper,
+	tokensRepo tokens.Repository,
+	deviceSvc *devices.DeviceService,
+) *UserService {
+
+	return &UserService{
+		conn:       conn,
+		querier:    querier,
+		tokensRepo: tokensRepo,
+		deviceSvc:  deviceSvc,
+	}
 }
 
 var (
-	UserCreationFailed = errors.New("user_creation_failed:1001:500")
+	UserCreationFailed    = errors.New("user_creation_failed:1001:500")
+	ErrQueryNotFound      = errors.New("query_retriever_failed:1002:500")
+	ErrUserExists         = errors.New("user_already_exists:1003:409")
+	ErrUserLookupFailed   = errors.New("user_lookup_failed:1004:500")
+	ErrInvalidCredentials = errors.New("invalid_credentials:1005:401")
+	ErrSessionFailed      = errors.New("session_create_failed:1006:500")
+	ErrUserBlocked        = errors.New("user_blocked:1007:403")
+	ErrInvalidRefresh     = errors.New("invalid_refresh_token:1008:401")
+	ErrRefreshReused      = errors.New("refresh_token_reused:1009:401")
+	ErrLogoutFailed       = errors.New("logout_failed:1010:500")
 )
 
-func (us *UserService) Create(ctx context.Context, email, password string) (*tokens.Token, error) {
+func (us *UserService) Create(ctx context.Context, email, password string) (*Session, error) {
+	existing, err := us.FindByEmail(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing != nil {
+		log.Info().Msg("user with email already exists")
+		return nil, ErrUserExists
+	}
+
 	user, err := NewUser(email, password)
 	if err != nil {
 		log.Error().Err(err).Msg("failed to build user")
@@ -46,14 +105,190 @@ func (us *UserService) Create(ctx context.Context, email, password string) (*tok
 	stmt, ok := us.querier.GetQuery(CreateUserQueryKey)
 	if !ok {
 		log.Error().Msg("failed to get query")
-		return nil, errors.New("query_retriever_failed:1002:500")
+		return nil, ErrQueryNotFound
 	}
 
+	// The lookup above is racy, two signups with the
+	// same email are told apart by the unique index
 	_, err = us.conn.NamedExecContext(ctx, stmt, user)
+	if database.IsUniqueViolation(err) {
+		log.Info().Msg("user with email already exists")
+		return nil, ErrUserExists
+	}
+
 	if err != nil {
 		log.Error().Err(err).Msg("failed to insert users into database")
+		return nil, UserCreationFailed
+	}
+
+	return us.createSession(ctx, user)
+}
+
+// Login creates a new session. When deviceID is given, it has to be one of
+// the user's registered devices and the session is bound to it. Otherwise
+// the session can be bound later by registering a device.
+func (us *UserService) Login(ctx context.Context, email, password, deviceID string) (*Session, error) {
+	user, err := us.FindByEmail(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil {
+		log.Info().Msg("no user found for email")
+		return nil, ErrInvalidCredentials
+	}
+
+	if !database.ValidPassword(user.HashedPassword, password) {
+		log.Info().Str("user_id", user.ID).Msg("password mismatch")
+		return nil, ErrInvalidCredentials
+	}
+
+	if user.Blocked {
+		log.Info().Str("user_id", user.ID).Msg("blocked user login")
+		return nil, ErrUserBlocked
+	}
+
+	if deviceID == "" {
+		return us.createSession(ctx, user)
+	}
+
+	device, err := us.deviceSvc.Find(ctx, user.ID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	return us.createSession(ctx, user, tokens.WithDeviceID(device.ID))
+}
+
+// Refresh exchanges a refresh token for a new access and refresh token pair.
+// The old pair is revoked. If an already revoked refresh token is presented,
+// someone is replaying it, so the whole token family is revoked.
+func (us *UserService) Refresh(ctx context.Context, refreshToken string) (*Session, error) {
+	token, err := us.tokensRepo.FindByRefreshToken(ctx, tokens.FindByClause{
+		RefreshToken: refreshToken,
+	})
+	if err != nil {
+		return nil, ErrInvalidRefresh
+	}
+
+	if token.IsRevoked() {
+		log.Error().
+			Str("user_id", token.ResourceID).
+			Str("family_id", token.FamilyID).
+			Msg("revoked refresh token reused, revoking token family")
+
+		us.revokeFamily(ctx, token.FamilyID)
+		return nil, ErrRefreshReused
+	}
+
+	if token.HasRefreshExpired() {
+		log.Info().Msg("refresh token expired")
+		return nil, ErrInvalidRefresh
+	}
+
+	if token.UserBlocked {
+		return nil, ErrUserBlocked
+	}
+
+	user, err := us.FindByID(ctx, token.ResourceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil {
+		return nil, ErrInvalidRefresh
+	}
+
+	newToken, err := us.tokensRepo.RotateSession(ctx, token)
+	if errors.Is(err, tokens.ErrTokenReused) {
+		us.revokeFamily(ctx, token.FamilyID)
+		return nil, ErrRefreshReused
+	}
+
+	if err != nil {
+		log.Error().Err(err).Msg("failed to rotate session")
+		return nil, ErrSessionFailed
+	}
+
+	return NewSession(user, newToken), nil
+}
+
+// Logout revokes every token issued for the session the token belongs to
+func (us *UserService) Logout(ctx context.Context, token *tokens.Token) error {
+	if err := us.tokensRepo.RevokeFamily(ctx, token.FamilyID); err != nil {
+		return ErrLogoutFailed
+	}
+
+	return nil
+}
+
+func (us *UserService) revokeFamily(ctx context.Context, familyID string) {
+	if err := us.tokensRepo.RevokeFamily(ctx, familyID); err != nil {
+		log.Error().Err(err).Str("family_id", familyID).Msg("failed to revoke token family")
+	}
+}
+
+// FindByEmail returns nil, nil when there is no user for the email
+func (us *UserService) FindByEmail(ctx context.Context, email string) (*User, error) {
+	return us.findOne(ctx, SelectUserQueryKey, map[string]any{
+		"email":     email,
+		"user_type": UserTypeNormal,
+	})
+}
+
+// FindByID returns nil, nil when there is no user for the id
+func (us *UserService) FindByID(ctx context.Context, userID string) (*User, error) {
+	return us.findOne(ctx, SelectUserByIDQueryKey, map[string]any{
+		"id": userID,
+	})
+}
+
+func (us *UserService) findOne(ctx context.Context, stmtKey string, args map[string]any) (*User, error) {
+	stmt, ok := us.querier.GetQuery(stmtKey)
+	if !ok {
+		log.Error().Msg("failed to get query")
+		return nil, ErrQueryNotFound
+	}
+
+	nstmt, err := us.conn.PrepareNamedContext(ctx, stmt)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to prepare named stmt")
+		return nil, ErrUserLookupFailed
+	}
+	defer nstmt.Close()
+
+	user := &User{}
+
+	err = nstmt.GetContext(ctx, user, args)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	if err != nil {
+		log.Error().Err(err).Msg("failed to find user")
+		return nil, ErrUserLookupFailed
+	}
+
+	return user, nil
+}
+
+func (us *UserService) createSession(
+	ctx context.Context,
+	user *User,
+	opts ...tokens.TokenOpts,
+) (*Session, error) {
+
+	token, err := us.tokensRepo.CreateSession(
+		ctx,
+		user.ID,
+		tokens.ResourceTypeUser,
+		&user.ID,
+		opts...,
+	)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to create user session")
+		return nil, ErrSessionFailed
 	}
 
-	// TODO: Create tokens and allow login
-	return &tokens.AdminToken, nil
+	return NewSession(user, token), nil
 }
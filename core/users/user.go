@@ -12,6 +12,7 @@ type User struct {
 	Type           string `db:"user_type"`
 	Email          string `db:"email"`
 	HashedPassword string `db:"hashedpass"`
+	Blocked        bool   `db:"blocked"`
 
 	database.Timestamp
 }
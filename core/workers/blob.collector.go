@@ -0,0 +1,76 @@
+package workers
+
+import (
+	"arbokcore/core/database"
+	"arbokcore/core/files"
+	"arbokcore/pkg/config"
+	"arbokcore/pkg/squirtle"
+	"context"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const BlobGCInterval = 6 * time.Hour
+
+// BlobGarbageCollector deletes the blobs which no chunk points at
+// anymore, once they are older than the configured grace period
+func BlobGarbageCollector(ctx context.Context, cfg config.AppConfig) error {
+	conn := database.ConnectSqlite(cfg.DbName)
+	dbconn := conn.Connect(ctx)
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	qs := squirtle.LoadAll("./config/querystore.yaml")
+
+	metadataQueryStore, err := qs.HydrateQueryStore("file_metadatas")
+	if err != nil {
+		return err
+	}
+
+	storage, err := database.NewBlobStorage(cfg)
+	if err != nil {
+		return err
+	}
+
+	collector := files.NewBlobCollector(
+		files.NewMetadataRepository(dbconn, metadataQueryStore),
+		storage,
+	)
+
+	log.Info().
+		Dur("grace", cfg.BlobGCGrace).
+		Bool("dry_run", cfg.BlobGCDryRun).
+		Msg("starting blob garbage collector")
+
+	ticker := time.NewTicker(BlobGCInterval)
+	defer ticker.Stop()
+
+	for {
+		report, err := collector.Collect(ctx, cfg.BlobGCGrace, cfg.BlobGCDryRun)
+		if err != nil {
+			log.Error().Err(err).Msg("blob gc failed")
+		} else {
+			log.Info().
+				Bool("dry_run", report.DryRun).
+				Int("scanned", report.Scanned).
+				Int("referenced", report.Referenced).
+				Int("young", report.Young).
+				Int("orphaned", report.Orphaned).
+				Int("deleted", report.Deleted).
+				Int("failed", report.Failed).
+				Int64("reclaimed_bytes", report.ReclaimedBytes).
+				Msg("blob gc complete")
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Info().Msg("stopping blob garbage collector")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -77,11 +77,7 @@ func ManualChunkMetadataReconciler(ctx context.Context, cfg config.AppConfig) er
 		prevFile = resps[0]
 	}
 
-	var fillerChunks map[string]*files.FilesWithChunks
-
-	if thisFile.NChunks == prevFile.NChunks {
-		fillerChunks = supervisors.RestOfChunks(thisFile, prevFile)
-	}
+	fillerChunks := supervisors.FillerChunks(thisFile, prevFile)
 
 	fmt.Println("validation", !supervisors.Validate(supervisors.ReconstructChunks(thisFile, prevFile), prevFile))
 
@@ -60,6 +60,11 @@ func MetdataSupervisor(ctx context.Context, cfg config.AppConfig) error {
 
 	chunkRepo := files.NewUserFileRespository(dbconn, chunkQueryStore)
 
+	storage, err := database.NewBlobStorage(cfg)
+	if err != nil {
+		return err
+	}
+
 	// Here, in the worker, After the metadata worker has updated the
 	// current_flag to true for the new fileID, it can again enqueue into a different
 	// queue.
@@ -68,6 +73,7 @@ func MetdataSupervisor(ctx context.Context, cfg config.AppConfig) error {
 		ctx,
 		repo,
 		chunkRepo,
+		storage,
 		producer,
 		notifier,
 	)
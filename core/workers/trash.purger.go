@@ -0,0 +1,77 @@
+package workers
+
+import (
+	"arbokcore/core/database"
+	"arbokcore/core/files"
+	"arbokcore/core/notifiers"
+	"arbokcore/pkg/config"
+	"arbokcore/pkg/queuer"
+	"arbokcore/pkg/squirtle"
+	"context"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const TrashPurgeInterval = 1 * time.Hour
+
+// TrashPurger permanently deletes the files which have been
+// in the trash for longer than the configured retention
+func TrashPurger(ctx context.Context, cfg config.AppConfig) error {
+	conn := database.ConnectSqlite(cfg.DbName)
+	dbconn := conn.Connect(ctx)
+	redisconn, err := database.NewRedisConnection(cfg.RedisURL)
+
+	if err != nil {
+		log.Error().Err(err).Msg("failed to connect to redis")
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	qs := squirtle.LoadAll("./config/querystore.yaml")
+
+	metadataQueryStore, err := qs.HydrateQueryStore("file_metadatas")
+	if err != nil {
+		return err
+	}
+
+	repo := files.NewMetadataRepository(dbconn, metadataQueryStore)
+
+	storage, err := database.NewBlobStorage(cfg)
+	if err != nil {
+		return err
+	}
+
+	nsq := queuer.NewRedisQ(
+		redisconn,
+		database.MetadataUpdateClientsNotifierQueue,
+		1*time.Second,
+	)
+
+	trashSvc := files.NewTrashService(repo, storage, notifiers.NewMedataUpdateStatus(nsq))
+
+	log.Info().Dur("retention", cfg.TrashRetention).Msg("starting trash purger")
+
+	ticker := time.NewTicker(TrashPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := trashSvc.PurgeExpired(ctx, cfg.TrashRetention)
+		if err != nil {
+			log.Error().Err(err).Int("purged", purged).Msg("trash purge failed")
+		} else {
+			log.Info().Int("purged", purged).Msg("trash purge complete")
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Info().Msg("stopping trash purger")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
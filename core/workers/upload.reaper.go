@@ -0,0 +1,77 @@
+package workers
+
+import (
+	"arbokcore/core/database"
+	"arbokcore/core/files"
+	"arbokcore/core/tokens"
+	"arbokcore/pkg/config"
+	"arbokcore/pkg/squirtle"
+	"context"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const UploadReapInterval = 15 * time.Minute
+
+// UploadReaper aborts the uploads which are still in progress after their
+// stream token has expired, the client can't finish them anymore
+func UploadReaper(ctx context.Context, cfg config.AppConfig) error {
+	conn := database.ConnectSqlite(cfg.DbName)
+	dbconn := conn.Connect(ctx)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	qs := squirtle.LoadAll("./config/querystore.yaml")
+
+	metadataQueryStore, err := qs.HydrateQueryStore("file_metadatas")
+	if err != nil {
+		return err
+	}
+
+	tokensQs, err := qs.HydrateQueryStore("tokens")
+	if err != nil {
+		return err
+	}
+
+	chunkQs, err := qs.HydrateQueryStore("user_files")
+	if err != nil {
+		return err
+	}
+
+	storage, err := database.NewBlobStorage(cfg)
+	if err != nil {
+		return err
+	}
+
+	uploadSvc := files.NewUploadService(
+		files.NewMetadataRepository(dbconn, metadataQueryStore),
+		files.NewUserFileRespository(dbconn, chunkQs),
+		files.NewMetadataTokenRepository(dbconn, metadataQueryStore, tokensQs),
+		storage,
+	)
+
+	log.Info().Dur("age", tokens.AccessExpiryDuration).Msg("starting upload reaper")
+
+	ticker := time.NewTicker(UploadReapInterval)
+	defer ticker.Stop()
+
+	for {
+		reaped, err := uploadSvc.ReapStale(ctx, tokens.AccessExpiryDuration)
+		if err != nil {
+			log.Error().Err(err).Int("reaped", reaped).Msg("upload reap failed")
+		} else {
+			log.Info().Int("reaped", reaped).Msg("upload reap complete")
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Info().Msg("stopping upload reaper")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -3,3 +3,15 @@ DROP TABLE file_metadatas;
 ---
 
 DROP TABLE user_files;
+
+---
+
+DROP TABLE blobs;
+
+---
+
+DROP TABLE file_shares;
+
+---
+
+DROP TABLE share_links;
@@ -7,4 +7,16 @@ DROP TABLE users;
 DROP TABLE user_files;
 ---
 
+DROP TABLE blobs;
+---
+
 DROP TABLE tokens;
+---
+
+DROP TABLE devices;
+---
+
+DROP TABLE file_shares;
+---
+
+DROP TABLE share_links;
@@ -12,6 +12,10 @@ CREATE TABLE IF NOT EXISTS file_metadatas (
 	,created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 	,updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 	,end_date TIMESTAMP DEFAULT NULL
+	,device_id VARCHAR(48)
+	,deleted_at TIMESTAMP DEFAULT NULL
+	,chunking VARCHAR(16) NOT NULL DEFAULT 'fixed'
+	,explicit_chunks TINYINT(1) NOT NULL DEFAULT 0
 );
 
 
@@ -29,6 +33,11 @@ CREATE TABLE IF NOT EXISTS users (
 
 ---
 
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email
+ON users (email);
+
+---
+
 CREATE TABLE IF NOT EXISTS user_files (
 	user_id VARCHAR(48)
 	,file_id VARCHAR(48) NOT NULL
@@ -36,12 +45,60 @@ CREATE TABLE IF NOT EXISTS user_files (
 	,next_chunk_id INTEGER
 	,chunk_blob_url TEXT NOT NULL
 	,chunk_hash TEXT NOT NULL
+	,chunk_offset INTEGER
+	,chunk_size INTEGER
+	,created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	,updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+---
+
+CREATE TABLE IF NOT EXISTS blobs (
+	hash VARCHAR(64) PRIMARY KEY
+	,blob_url TEXT NOT NULL
+	,size INTEGER NOT NULL
+	,codec VARCHAR(16) NOT NULL DEFAULT 'none'
+	,stored_size INTEGER
+	,ref_count INTEGER NOT NULL DEFAULT 0
 	,created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 	,updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 );
 
 ---
 
+CREATE UNIQUE INDEX IF NOT EXISTS idx_blobs_blob_url
+ON blobs (blob_url);
+
+---
+
+CREATE TRIGGER IF NOT EXISTS trg_user_files_blob_insert
+AFTER INSERT ON user_files
+WHEN NEW.chunk_blob_url != ''
+BEGIN
+	UPDATE blobs SET ref_count = ref_count + 1 WHERE blob_url = NEW.chunk_blob_url;
+END;
+
+---
+
+CREATE TRIGGER IF NOT EXISTS trg_user_files_blob_delete
+AFTER DELETE ON user_files
+WHEN OLD.chunk_blob_url != ''
+BEGIN
+	UPDATE blobs SET ref_count = ref_count - 1 WHERE blob_url = OLD.chunk_blob_url;
+END;
+
+---
+
+CREATE TRIGGER IF NOT EXISTS trg_user_files_blob_update
+AFTER UPDATE OF chunk_blob_url ON user_files
+WHEN OLD.chunk_blob_url != NEW.chunk_blob_url
+BEGIN
+	UPDATE blobs SET ref_count = ref_count - 1 WHERE blob_url = OLD.chunk_blob_url;
+	UPDATE blobs SET ref_count = ref_count + 1 WHERE blob_url = NEW.chunk_blob_url;
+END;
+
+---
+
 CREATE TABLE IF NOT EXISTS tokens (
 	resource_id VARCHAR(48) NOT NULL
 	,resource_type VARCHAR(20)
@@ -49,9 +106,60 @@ CREATE TABLE IF NOT EXISTS tokens (
 	,access_token VARCHAR(64)
 	,refresh_token VARCHAR(64)
 	,token_type VARCHAR(20)
+	,family_id VARCHAR(48)
+	,device_id VARCHAR(48)
+	,revoked_at TIMESTAMP DEFAULT NULL
 	,access_expires_at TIMESTAMP NOT NULL 
 	,refresh_expires_at TIMESTAMP NOT NULL
 	,created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 	,updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 );
 
+---
+
+CREATE TABLE IF NOT EXISTS devices (
+	id VARCHAR(48) PRIMARY KEY
+	,user_id VARCHAR(48) NOT NULL
+	,device_name TEXT NOT NULL
+	,platform VARCHAR(50)
+	,created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	,updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+---
+
+CREATE TABLE IF NOT EXISTS file_shares (
+	id VARCHAR(48) PRIMARY KEY
+	,lineage_id VARCHAR(48) NOT NULL
+	,owner_id VARCHAR(48) NOT NULL
+	,shared_with VARCHAR(48) NOT NULL
+	,permission VARCHAR(20) NOT NULL
+	,created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	,updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+---
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_file_shares_lineage_user
+ON file_shares (lineage_id, shared_with);
+
+---
+
+CREATE TABLE IF NOT EXISTS share_links (
+	id VARCHAR(48) PRIMARY KEY
+	,lineage_id VARCHAR(48) NOT NULL
+	,owner_id VARCHAR(48) NOT NULL
+	,token_hash VARCHAR(64) NOT NULL
+	,hashedpass TEXT
+	,expires_at TIMESTAMP DEFAULT NULL
+	,max_downloads INTEGER DEFAULT NULL
+	,download_count INTEGER NOT NULL DEFAULT 0
+	,revoked_at TIMESTAMP DEFAULT NULL
+	,created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	,updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+---
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_share_links_token_hash
+ON share_links (token_hash);
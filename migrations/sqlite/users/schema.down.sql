@@ -3,3 +3,7 @@ DROP TABLE users;
 ---
 
 DROP TABLE tokens;
+
+---
+
+DROP TABLE devices;
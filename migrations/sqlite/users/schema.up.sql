@@ -10,6 +10,11 @@ CREATE TABLE IF NOT EXISTS users (
 
 ---
 
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email
+ON users (email);
+
+---
+
 CREATE TABLE IF NOT EXISTS tokens (
 	resource_id VARCHAR(48) NOT NULL
 	,resource_type VARCHAR(20)
@@ -17,8 +22,22 @@ CREATE TABLE IF NOT EXISTS tokens (
 	,access_token VARCHAR(64)
 	,refresh_token VARCHAR(64)
 	,token_type VARCHAR(20)
+	,family_id VARCHAR(48)
+	,device_id VARCHAR(48)
+	,revoked_at TIMESTAMP DEFAULT NULL
 	,access_expires_at TIMESTAMP NOT NULL 
 	,refresh_expires_at TIMESTAMP NOT NULL
 	,created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 	,updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 );
+
+---
+
+CREATE TABLE IF NOT EXISTS devices (
+	id VARCHAR(48) PRIMARY KEY
+	,user_id VARCHAR(48) NOT NULL
+	,device_name TEXT NOT NULL
+	,platform VARCHAR(50)
+	,created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	,updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
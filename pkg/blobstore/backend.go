@@ -0,0 +1,248 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+)
+
+var ErrUnknownBackend = errors.New("unknown_blob_backend")
+
+const (
+	BackendLocal = "local"
+	BackendS3    = "s3"
+)
+
+// SchemeOf is the backend a blob uri belongs to. Paths without a scheme
+// were written by LocalFS before it handed out uris.
+func SchemeOf(uri string) string {
+	scheme, _, ok := strings.Cut(uri, "://")
+	if !ok {
+		return BackendLocal
+	}
+
+	return scheme
+}
+
+// IsLegacyPath tells a local path, stored before the uris, from an uri
+func IsLegacyPath(uri string) bool {
+	return !strings.Contains(uri, "://")
+}
+
+// Registry reads and deletes a blob with the storage of its uri scheme,
+// so chunks written to another backend stay readable after switching.
+// New chunks are always written to the primary storage.
+type Registry struct {
+	primary  BlobStorage
+	backends map[string]BlobStorage
+}
+
+// EncryptedOf finds the encryption among the decorators of the storage
+func EncryptedOf(storage BlobStorage) (*Encrypted, bool) {
+	for {
+		switch layer := storage.(type) {
+		case *Encrypted:
+			return layer, true
+		case interface{ Unwrap() BlobStorage }:
+			storage = layer.Unwrap()
+		default:
+			return nil, false
+		}
+	}
+}
+
+func NewRegistry(scheme string, primary BlobStorage) *Registry {
+	return &Registry{
+		primary:  primary,
+		backends: map[string]BlobStorage{scheme: primary},
+	}
+}
+
+func (slf *Registry) Register(scheme string, storage BlobStorage) {
+	slf.backends[scheme] = storage
+}
+
+func (slf *Registry) backendOf(uri string) (BlobStorage, error) {
+	storage, ok := slf.backends[SchemeOf(uri)]
+	if !ok {
+		return nil, ErrUnknownBackend
+	}
+
+	return storage, nil
+}
+
+func (slf *Registry) UpdateChunk(ctx context.Context, fileID string, chunk *ChunkedFile) (string, error) {
+	return slf.primary.UpdateChunk(ctx, fileID, chunk)
+}
+
+func (slf *Registry) StoreBlob(ctx context.Context, hash string, chunk *ChunkedFile) (string, error) {
+	return slf.primary.StoreBlob(ctx, hash, chunk)
+}
+
+func (slf *Registry) BatchCreateChunk(ctx context.Context, fileID string, chunks []*ChunkedFile) ([]*ChunkedFile, error) {
+	return slf.primary.BatchCreateChunk(ctx, fileID, chunks)
+}
+
+// FetchChunks looks the chunks up in one call per backend, and puts
+// them back in the order of the file
+func (slf *Registry) FetchChunks(ctx context.Context, chunkPaths []string) ([]*ChunkedFile, error) {
+	indexes := map[BlobStorage][]int{}
+
+	for i, uri := range chunkPaths {
+		storage, err := slf.backendOf(uri)
+		if err != nil {
+			return nil, err
+		}
+
+		indexes[storage] = append(indexes[storage], i)
+	}
+
+	chunks := make([]*ChunkedFile, len(chunkPaths))
+
+	for storage, positions := range indexes {
+		paths := []string{}
+		for _, i := range positions {
+			paths = append(paths, chunkPaths[i])
+		}
+
+		fetched, err := storage.FetchChunks(ctx, paths)
+		if err != nil {
+			return nil, err
+		}
+
+		for j, i := range positions {
+			chunks[i] = fetched[j]
+		}
+	}
+
+	for i := range chunks {
+		chunks[i].chunkID = int64(i)
+		chunks[i].next = nil
+
+		if i+1 < len(chunks) {
+			chunks[i].next = chunks[i+1]
+		}
+	}
+
+	return chunks, nil
+}
+
+func (slf *Registry) BuildFile(ctx context.Context, chunks []*ChunkedFile) (io.ReadSeekCloser, error) {
+	return NewChunkChain(ctx, chunks, slf.OpenChunk), nil
+}
+
+func (slf *Registry) OpenChunk(ctx context.Context, chunkPath string) (io.ReadCloser, error) {
+	storage, err := slf.backendOf(chunkPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.OpenChunk(ctx, chunkPath)
+}
+
+func (slf *Registry) ReplaceChunk(ctx context.Context, chunkPath string, chunk *ChunkedFile) error {
+	storage, err := slf.backendOf(chunkPath)
+	if err != nil {
+		return err
+	}
+
+	return storage.ReplaceChunk(ctx, chunkPath, chunk)
+}
+
+func (slf *Registry) DeleteChunk(ctx context.Context, chunkPath string) error {
+	storage, err := slf.backendOf(chunkPath)
+	if err != nil {
+		return err
+	}
+
+	return storage.DeleteChunk(ctx, chunkPath)
+}
+
+// ListBlobs lists the blobs of every backend
+func (slf *Registry) ListBlobs(ctx context.Context, fn func(*BlobInfo) error) error {
+	schemes := []string{}
+	for scheme := range slf.backends {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+
+	for _, scheme := range schemes {
+		if err := slf.backends[scheme].ListBlobs(ctx, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Options picks the storage New builds
+type Options struct {
+	// Where new blobs go, "local" under Dir or "s3"
+	Backend string
+	Dir     string
+
+	// S3 is readable once a bucket is set, whatever the backend
+	S3 S3Config
+
+	// Chunks are encrypted with the master key of KeyID when it is set.
+	// MasterKeys lists every master key, "<id>:<base64 key>,..".
+	KeyID      string
+	MasterKeys string
+
+	// The codecs tried on every chunk, chunks aren't compressed without any
+	Compression []string
+}
+
+// New builds the storage picked by the backend. The local store is always
+// readable, and S3 is too once a bucket is set. With a key id, chunks are
+// encrypted on top of it, and with codecs they are compressed before that.
+func New(opts Options) (BlobStorage, error) {
+	localFs, err := NewLocalFS(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var s3Store *S3
+
+	if opts.Backend == BackendS3 || opts.S3.Bucket != "" {
+		s3Store, err = NewS3(opts.S3)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var registry *Registry
+
+	switch opts.Backend {
+	case BackendLocal, "":
+		registry = NewRegistry(BackendLocal, localFs)
+	case BackendS3:
+		registry = NewRegistry(BackendS3, s3Store)
+		registry.Register(BackendLocal, localFs)
+	default:
+		return nil, ErrUnknownBackend
+	}
+
+	if s3Store != nil {
+		registry.Register(BackendS3, s3Store)
+	}
+
+	var storage BlobStorage = registry
+
+	if opts.KeyID != "" {
+		keys, err := ParseKeyring(opts.KeyID, opts.MasterKeys)
+		if err != nil {
+			return nil, err
+		}
+
+		storage = NewEncrypted(storage, keys)
+	}
+
+	if len(opts.Compression) > 0 {
+		return NewCompressed(storage, opts.Compression)
+	}
+
+	return storage, nil
+}
@@ -0,0 +1,82 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_SchemeOf(t *testing.T) {
+	require.Equal(t, BackendLocal, SchemeOf("local://File1/0"))
+	require.Equal(t, BackendS3, SchemeOf("s3://arbok/File1/0"))
+	require.Equal(t, BackendLocal, SchemeOf("/tmp/arbokdata/File1/0"))
+
+	require.True(t, IsLegacyPath("/tmp/arbokdata/File1/0"))
+	require.False(t, IsLegacyPath("local://File1/0"))
+}
+
+func Test_Registry(t *testing.T) {
+	ctx := context.Background()
+
+	localFs, err := NewLocalFS(t.TempDir())
+	require.NoError(t, err)
+
+	s3Store, _ := newTestS3(t, "")
+
+	registry := NewRegistry(BackendS3, s3Store)
+	registry.Register(BackendLocal, localFs)
+
+	newChunk := func(data string, chunkID int64) *ChunkedFile {
+		return NewChunkedFile(NewBytesBlob([]byte(data)), chunkID, nil)
+	}
+
+	// Written before switching to S3
+	localURI, err := localFs.UpdateChunk(ctx, "File1", newChunk("first ", 0))
+	require.NoError(t, err)
+
+	s3URI, err := registry.UpdateChunk(ctx, "File1", newChunk("second", 1))
+	require.NoError(t, err)
+	require.Equal(t, "s3://arbok/File1/1", s3URI)
+
+	t.Run("reads a file across backends", func(t *testing.T) {
+		chunks, err := registry.FetchChunks(ctx, []string{localURI, s3URI, localURI})
+		require.NoError(t, err)
+
+		for i, chunk := range chunks {
+			require.Equal(t, int64(i), chunk.ChunkID())
+		}
+
+		file, err := registry.BuildFile(ctx, chunks)
+		require.NoError(t, err)
+		defer file.Close()
+
+		data, err := io.ReadAll(file)
+		require.NoError(t, err)
+		require.Equal(t, "first secondfirst ", string(data))
+	})
+
+	t.Run("lists every backend", func(t *testing.T) {
+		found := []string{}
+
+		err := registry.ListBlobs(ctx, func(blob *BlobInfo) error {
+			found = append(found, blob.Path)
+			return nil
+		})
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{localURI, s3URI}, found)
+	})
+
+	t.Run("deletes with the backend of the uri", func(t *testing.T) {
+		require.NoError(t, registry.DeleteChunk(ctx, localURI))
+
+		_, err := registry.FetchChunks(ctx, []string{localURI})
+		require.ErrorIs(t, err, ErrBlobNotFound)
+	})
+
+	t.Run("unknown scheme", func(t *testing.T) {
+		_, err := registry.OpenChunk(ctx, "ipfs://Qm")
+		require.ErrorIs(t, err, ErrUnknownBackend)
+	})
+}
@@ -0,0 +1,326 @@
+package blobstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/rs/zerolog/log"
+)
+
+// Compressed compresses the chunks before the storage under it sees them.
+// Every configured codec is tried on a chunk and the smallest result wins,
+// a chunk no codec makes smaller is stored as it is. A compressed chunk
+// starts with a frame naming its codec and its size, so the codec is known
+// from the blob itself and chunks stored without it are read as they are.
+// The frame is only read when the chunk is, chunks are fetched with the
+// size they take in the store and the caller sizes them with the size it
+// recorded, the codec and stored size are kept with the blob.
+//
+// Compression goes on top of encryption, sealed chunks don't compress.
+
+var (
+	ErrUnknownCodec  = errors.New("unknown_blob_codec")
+	ErrCorruptedBlob = errors.New("corrupted_compressed_blob")
+)
+
+const (
+	CodecNone = "none"
+	CodecGzip = "gzip"
+	CodecZstd = "zstd"
+
+	frameMagic = "ARZ1"
+
+	// magic, codec, size of the chunk before compression
+	frameHeaderSize = len(frameMagic) + 1 + 8
+)
+
+var codecIDs = map[string]byte{
+	CodecNone: 0,
+	CodecGzip: 1,
+	CodecZstd: 2,
+}
+
+type Compressed struct {
+	inner  BlobStorage
+	codecs []string
+
+	zstdEncoder *zstd.Encoder
+}
+
+func NewCompressed(inner BlobStorage, codecs []string) (*Compressed, error) {
+	for _, codec := range codecs {
+		if _, ok := codecIDs[codec]; !ok || codec == CodecNone {
+			return nil, ErrUnknownCodec
+		}
+	}
+
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Compressed{inner: inner, codecs: codecs, zstdEncoder: encoder}, nil
+}
+
+func (slf *Compressed) Unwrap() BlobStorage {
+	return slf.inner
+}
+
+func (slf *Compressed) encode(codec string, plain []byte) ([]byte, error) {
+	switch codec {
+	case CodecZstd:
+		return slf.zstdEncoder.EncodeAll(plain, nil), nil
+	case CodecGzip:
+		buf := &bytes.Buffer{}
+
+		writer := gzip.NewWriter(buf)
+		if _, err := writer.Write(plain); err != nil {
+			return nil, err
+		}
+
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	}
+
+	return nil, ErrUnknownCodec
+}
+
+func frame(codec string, plain, payload []byte) []byte {
+	framed := make([]byte, 0, frameHeaderSize+len(payload))
+	framed = append(framed, frameMagic...)
+	framed = append(framed, codecIDs[codec])
+	framed = binary.BigEndian.AppendUint64(framed, uint64(len(plain)))
+
+	return append(framed, payload...)
+}
+
+// pack picks the smallest encoding of the chunk
+func (slf *Compressed) pack(plain []byte) (string, []byte, error) {
+	codec, packed := CodecNone, plain
+
+	// A chunk which looks framed is framed anyway, to be read back as it is
+	if bytes.HasPrefix(plain, []byte(frameMagic)) {
+		packed = frame(CodecNone, plain, plain)
+	}
+
+	for _, candidate := range slf.codecs {
+		payload, err := slf.encode(candidate, plain)
+		if err != nil {
+			return "", nil, err
+		}
+
+		if frameHeaderSize+len(payload) < len(packed) {
+			codec, packed = candidate, frame(candidate, plain, payload)
+		}
+	}
+
+	return codec, packed, nil
+}
+
+// compressChunk also records the codec it picked and the size it
+// is stored in on the chunk, for the caller to keep with the blob.
+// Sealing it after updates the stored size.
+func (slf *Compressed) compressChunk(chunk *ChunkedFile) (*ChunkedFile, error) {
+	if _, err := chunk.data.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	plain, err := io.ReadAll(chunk.data)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := chunk.verify(plain); err != nil {
+		return nil, err
+	}
+
+	codec, packed, err := slf.pack(plain)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to compress chunk")
+		return nil, err
+	}
+
+	chunk.codec = codec
+	chunk.stored(int64(len(packed)))
+
+	return chunk.transformed(packed), nil
+}
+
+func (slf *Compressed) UpdateChunk(ctx context.Context, fileID string, chunk *ChunkedFile) (string, error) {
+	packed, err := slf.compressChunk(chunk)
+	if err != nil {
+		return "", err
+	}
+
+	return slf.inner.UpdateChunk(ctx, fileID, packed)
+}
+
+func (slf *Compressed) StoreBlob(ctx context.Context, hash string, chunk *ChunkedFile) (string, error) {
+	packed, err := slf.compressChunk(chunk)
+	if err != nil {
+		return "", err
+	}
+
+	return slf.inner.StoreBlob(ctx, hash, packed)
+}
+
+func (slf *Compressed) BatchCreateChunk(ctx context.Context, fileID string, chunks []*ChunkedFile) ([]*ChunkedFile, error) {
+	packed := []*ChunkedFile{}
+
+	for _, chunk := range chunks {
+		packedChunk, err := slf.compressChunk(chunk)
+		if err != nil {
+			return nil, err
+		}
+
+		packed = append(packed, packedChunk)
+	}
+
+	return slf.inner.BatchCreateChunk(ctx, fileID, packed)
+}
+
+func (slf *Compressed) ReplaceChunk(ctx context.Context, chunkPath string, chunk *ChunkedFile) error {
+	packed, err := slf.compressChunk(chunk)
+	if err != nil {
+		return err
+	}
+
+	return slf.inner.ReplaceChunk(ctx, chunkPath, packed)
+}
+
+type frameHeader struct {
+	codec string
+	size  int64
+}
+
+func parseFrameHeader(header []byte) (*frameHeader, bool) {
+	if len(header) < frameHeaderSize || !bytes.HasPrefix(header, []byte(frameMagic)) {
+		return nil, false
+	}
+
+	for codec, id := range codecIDs {
+		if header[len(frameMagic)] == id {
+			return &frameHeader{
+				codec: codec,
+				size:  int64(binary.BigEndian.Uint64(header[len(frameMagic)+1:])),
+			}, true
+		}
+	}
+
+	return nil, false
+}
+
+// readFrameHeader reads the frame header off the chunk, the header is
+// nil when the chunk isn't framed, along with the bytes read for it
+func readFrameHeader(reader io.Reader) (*frameHeader, []byte, error) {
+	header := make([]byte, frameHeaderSize)
+
+	n, err := io.ReadFull(reader, header)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, header[:n], nil
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	parsed, ok := parseFrameHeader(header)
+	if !ok {
+		return nil, header, nil
+	}
+
+	return parsed, header, nil
+}
+
+// FetchChunks looks the chunks up without reading their frame, a
+// compressed chunk has the size it takes in the store
+func (slf *Compressed) FetchChunks(ctx context.Context, chunkPaths []string) ([]*ChunkedFile, error) {
+	return slf.inner.FetchChunks(ctx, chunkPaths)
+}
+
+func (slf *Compressed) BuildFile(ctx context.Context, chunks []*ChunkedFile) (io.ReadSeekCloser, error) {
+	return NewChunkChain(ctx, chunks, slf.OpenChunk), nil
+}
+
+// decodedChunk closes the decoder along with the chunk under it
+type decodedChunk struct {
+	io.Reader
+	close func()
+	chunk io.Closer
+}
+
+func (slf *decodedChunk) Close() error {
+	if slf.close != nil {
+		slf.close()
+	}
+
+	return slf.chunk.Close()
+}
+
+// OpenChunk decompresses the chunk as it is read
+func (slf *Compressed) OpenChunk(ctx context.Context, chunkPath string) (io.ReadCloser, error) {
+	reader, err := slf.inner.OpenChunk(ctx, chunkPath)
+	if err != nil {
+		return nil, err
+	}
+
+	header, read, err := readFrameHeader(reader)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+
+	if header == nil {
+		// Kept seekable, so a range of the chunk doesn't read all of it
+		if seeker, ok := reader.(io.Seeker); ok {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				reader.Close()
+				return nil, err
+			}
+
+			return reader, nil
+		}
+
+		return &decodedChunk{Reader: io.MultiReader(bytes.NewReader(read), reader), chunk: reader}, nil
+	}
+
+	switch header.codec {
+	case CodecNone:
+		return &decodedChunk{Reader: reader, chunk: reader}, nil
+	case CodecGzip:
+		decoder, err := gzip.NewReader(reader)
+		if err != nil {
+			reader.Close()
+			return nil, ErrCorruptedBlob
+		}
+
+		return &decodedChunk{Reader: decoder, close: func() { decoder.Close() }, chunk: reader}, nil
+	case CodecZstd:
+		decoder, err := zstd.NewReader(reader, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			reader.Close()
+			return nil, ErrCorruptedBlob
+		}
+
+		return &decodedChunk{Reader: decoder, close: decoder.Close, chunk: reader}, nil
+	}
+
+	reader.Close()
+	return nil, ErrUnknownCodec
+}
+
+func (slf *Compressed) DeleteChunk(ctx context.Context, chunkPath string) error {
+	return slf.inner.DeleteChunk(ctx, chunkPath)
+}
+
+func (slf *Compressed) ListBlobs(ctx context.Context, fn func(*BlobInfo) error) error {
+	return slf.inner.ListBlobs(ctx, fn)
+}
@@ -0,0 +1,187 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// readChunks reads the chunks back with the sizes they were recorded with
+func readChunks(t *testing.T, storage BlobStorage, uris []string, sizes []int64) ([]*ChunkedFile, []byte) {
+	ctx := context.Background()
+
+	chunks, err := storage.FetchChunks(ctx, uris)
+	require.NoError(t, err)
+
+	for i, chunk := range chunks {
+		chunk.WithSize(sizes[i])
+	}
+
+	file, err := storage.BuildFile(ctx, chunks)
+	require.NoError(t, err)
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	require.NoError(t, err)
+
+	return chunks, data
+}
+
+func Test_NewCompressed(t *testing.T) {
+	_, err := NewCompressed(nil, []string{CodecZstd, "lz4"})
+	require.ErrorIs(t, err, ErrUnknownCodec)
+
+	_, err = NewCompressed(nil, []string{CodecNone})
+	require.ErrorIs(t, err, ErrUnknownCodec)
+}
+
+func Test_Compressed(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	localFs, err := NewLocalFS(dir)
+	require.NoError(t, err)
+
+	logs := []byte(strings.Repeat("2024-01-01T00:00:00Z INFO request served path=/my/files\n", 500))
+
+	for _, codec := range []string{CodecZstd, CodecGzip} {
+		t.Run(codec, func(t *testing.T) {
+			storage, err := NewCompressed(localFs, []string{codec})
+			require.NoError(t, err)
+
+			chunk := NewChunkedFile(NewBytesBlob(logs), 0, nil)
+
+			uri, err := storage.UpdateChunk(ctx, "File-"+codec, chunk)
+			require.NoError(t, err)
+
+			require.Equal(t, codec, chunk.Codec())
+			require.Less(t, chunk.StoredSize(), int64(len(logs))/5)
+
+			stored, err := os.ReadFile(filepath.Join(dir, "File-"+codec, "0"))
+			require.NoError(t, err)
+			require.Equal(t, chunk.StoredSize(), int64(len(stored)))
+
+			// Fetched with the size it is stored in, without reading it
+			fetched, err := storage.FetchChunks(ctx, []string{uri})
+			require.NoError(t, err)
+			require.Equal(t, chunk.StoredSize(), fetched[0].Size())
+
+			_, data := readChunks(t, storage, []string{uri}, []int64{int64(len(logs))})
+			require.Equal(t, logs, data)
+		})
+	}
+
+	storage, err := NewCompressed(localFs, []string{CodecZstd, CodecGzip})
+	require.NoError(t, err)
+
+	t.Run("chunks which don't compress are stored as they are", func(t *testing.T) {
+		random := make([]byte, 4096)
+		_, err := rand.Read(random)
+		require.NoError(t, err)
+
+		chunk := NewChunkedFile(NewBytesBlob(random), 0, nil)
+
+		uri, err := storage.UpdateChunk(ctx, "File1", chunk)
+		require.NoError(t, err)
+		require.Equal(t, CodecNone, chunk.Codec())
+
+		stored, err := os.ReadFile(filepath.Join(dir, "File1", "0"))
+		require.NoError(t, err)
+		require.Equal(t, random, stored)
+
+		_, data := readChunks(t, storage, []string{uri}, []int64{4096})
+		require.Equal(t, random, data)
+	})
+
+	t.Run("chunks which look framed are read back as they are", func(t *testing.T) {
+		framed := []byte(frameMagic + "\x02 not really a frame")
+
+		uri, err := storage.UpdateChunk(ctx, "File2", NewChunkedFile(NewBytesBlob(framed), 0, nil))
+		require.NoError(t, err)
+
+		_, data := readChunks(t, storage, []string{uri}, []int64{int64(len(framed))})
+		require.Equal(t, framed, data)
+	})
+
+	t.Run("chunks stored before compression", func(t *testing.T) {
+		legacy, err := localFs.UpdateChunk(ctx, "File3", NewChunkedFile(NewBytesBlob([]byte("short")), 0, nil))
+		require.NoError(t, err)
+
+		compressed, err := storage.UpdateChunk(ctx, "File3", NewChunkedFile(NewBytesBlob(logs), 1, nil))
+		require.NoError(t, err)
+
+		chunks, data := readChunks(t, storage, []string{legacy, compressed}, []int64{5, int64(len(logs))})
+		require.Equal(t, int64(5), chunks[0].Size())
+		require.Equal(t, "short"+string(logs), string(data))
+	})
+
+	t.Run("a range within a compressed chunk", func(t *testing.T) {
+		uri, err := storage.StoreBlob(ctx, strings.Repeat("ab", 32), NewChunkedFile(NewBytesBlob(logs), 0, nil))
+		require.NoError(t, err)
+
+		chunks, err := storage.FetchChunks(ctx, []string{uri})
+		require.NoError(t, err)
+		chunks[0].WithSize(int64(len(logs)))
+
+		file, err := storage.BuildFile(ctx, chunks)
+		require.NoError(t, err)
+		defer file.Close()
+
+		_, err = file.Seek(1000, io.SeekStart)
+		require.NoError(t, err)
+
+		data := make([]byte, 100)
+		_, err = io.ReadFull(file, data)
+		require.NoError(t, err)
+		require.Equal(t, logs[1000:1100], data)
+	})
+}
+
+func Test_CompressedEncrypted(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	localFs, err := NewLocalFS(dir)
+	require.NoError(t, err)
+
+	keys, err := NewKeyring("k1", map[string][]byte{"k1": testMasterKey(1)})
+	require.NoError(t, err)
+
+	storage, err := NewCompressed(NewEncrypted(localFs, keys), []string{CodecZstd})
+	require.NoError(t, err)
+
+	logs := []byte(strings.Repeat("GET /my/storage 200\n", 1000))
+	chunk := NewChunkedFile(NewBytesBlob(logs), 0, nil)
+
+	uri, err := storage.UpdateChunk(ctx, "File1", chunk)
+	require.NoError(t, err)
+	require.Equal(t, CodecZstd, chunk.Codec())
+
+	// Compressed first, then sealed, the stored size counts both
+	stored, err := os.ReadFile(filepath.Join(dir, "File1", "0"))
+	require.NoError(t, err)
+	require.Equal(t, chunk.StoredSize(), int64(len(stored)))
+	require.Less(t, chunk.StoredSize(), int64(len(logs))/5)
+	require.True(t, bytes.HasPrefix(stored, []byte(envelopeMagic)))
+
+	chunks, data := readChunks(t, storage, []string{uri}, []int64{int64(len(logs))})
+	require.Equal(t, int64(len(logs)), chunks[0].Size())
+	require.Equal(t, logs, data)
+
+	encrypted, ok := EncryptedOf(storage)
+	require.True(t, ok)
+
+	report, err := encrypted.Rewrap(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Current)
+
+	_, ok = EncryptedOf(localFs)
+	require.False(t, ok)
+}
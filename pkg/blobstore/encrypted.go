@@ -0,0 +1,431 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Encrypted seals the chunks with AES-256-GCM before the storage under it
+// sees them. Every chunk gets its own random data key, which is kept in a
+// header in front of the chunk, wrapped by a master key. The header names
+// the master key, so rotating it only rewraps the data keys, the data is
+// never encrypted again. Chunk hashes stay the hashes of the plaintext.
+//
+// Data keys are per chunk rather than per file. Chunks are stored once by
+// their hash and shared by every file and version which has them, so no
+// one file owns the key of a blob.
+//
+// A chunk is sealed as a whole, reading any byte of it reads and
+// authenticates all of it. Chunks stored before encryption was turned on
+// have no header and are read as they are. Which of the two a chunk is
+// only shows once it is opened, so chunks are fetched with the size they
+// take in the store, the caller sizes them with the size it recorded.
+
+var (
+	ErrInvalidMasterKey = errors.New("invalid_master_key")
+	ErrUnknownKeyID     = errors.New("unknown_key_id")
+	ErrDecryptFailed    = errors.New("chunk_decrypt_failed")
+)
+
+const (
+	MaxKeyIDLen = 32
+
+	envelopeMagic  = "ARE1"
+	dataKeySize    = 32
+	gcmNonceSize   = 12
+	gcmTagSize     = 16
+	wrappedKeySize = gcmNonceSize + dataKeySize + gcmTagSize
+
+	// magic, key id length, key id padded to its max, wrapped data key
+	keyHeaderSize = len(envelopeMagic) + 1 + MaxKeyIDLen + wrappedKeySize
+
+	// What a sealed chunk takes on top of the plaintext
+	EnvelopeOverhead = keyHeaderSize + gcmNonceSize + gcmTagSize
+)
+
+// Keyring holds the master keys by id, chunks are sealed with the active
+// one, the others are kept to open the chunks sealed before a rotation
+type Keyring struct {
+	activeID string
+	keys     map[string][]byte
+}
+
+func NewKeyring(activeID string, keys map[string][]byte) (*Keyring, error) {
+	for id, key := range keys {
+		if id == "" || len(id) > MaxKeyIDLen || len(key) != 32 {
+			return nil, ErrInvalidMasterKey
+		}
+	}
+
+	if _, ok := keys[activeID]; !ok {
+		return nil, ErrUnknownKeyID
+	}
+
+	return &Keyring{activeID: activeID, keys: keys}, nil
+}
+
+// ParseKeyring reads the master keys from "<id>:<base64 key>,<id>:<base64 key>"
+func ParseKeyring(activeID, spec string) (*Keyring, error) {
+	keys := map[string][]byte{}
+
+	for _, entry := range strings.Split(spec, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok {
+			return nil, ErrInvalidMasterKey
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, ErrInvalidMasterKey
+		}
+
+		keys[id] = key
+	}
+
+	return NewKeyring(activeID, keys)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func randomBytes(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	_, err := rand.Read(buf)
+
+	return buf, err
+}
+
+// keyHeader wraps the data key with the active master key,
+// the key id is bound to it as additional data
+func (slf *Keyring) keyHeader(dataKey []byte) ([]byte, error) {
+	aead, err := newGCM(slf.keys[slf.activeID])
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := randomBytes(gcmNonceSize)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, MaxKeyIDLen)
+	copy(id, slf.activeID)
+
+	header := make([]byte, 0, keyHeaderSize)
+	header = append(header, envelopeMagic...)
+	header = append(header, byte(len(slf.activeID)))
+	header = append(header, id...)
+	header = append(header, nonce...)
+
+	return aead.Seal(header, nonce, dataKey, []byte(slf.activeID)), nil
+}
+
+// dataKey unwraps the data key of a sealed chunk, with the master key
+// named in its header
+func (slf *Keyring) dataKey(sealed []byte) (string, []byte, error) {
+	idLen := int(sealed[len(envelopeMagic)])
+	if idLen == 0 || idLen > MaxKeyIDLen {
+		return "", nil, ErrDecryptFailed
+	}
+
+	idStart := len(envelopeMagic) + 1
+	keyID := string(sealed[idStart : idStart+idLen])
+
+	masterKey, ok := slf.keys[keyID]
+	if !ok {
+		return keyID, nil, ErrUnknownKeyID
+	}
+
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return keyID, nil, err
+	}
+
+	wrapped := sealed[idStart+MaxKeyIDLen : keyHeaderSize]
+
+	dataKey, err := aead.Open(nil, wrapped[:gcmNonceSize], wrapped[gcmNonceSize:], []byte(keyID))
+	if err != nil {
+		return keyID, nil, ErrDecryptFailed
+	}
+
+	return keyID, dataKey, nil
+}
+
+func (slf *Keyring) seal(plain []byte) ([]byte, error) {
+	dataKey, err := randomBytes(dataKeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := slf.keyHeader(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := randomBytes(gcmNonceSize)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := make([]byte, 0, len(plain)+EnvelopeOverhead)
+	sealed = append(sealed, header...)
+	sealed = append(sealed, nonce...)
+
+	return aead.Seal(sealed, nonce, plain, []byte(envelopeMagic)), nil
+}
+
+func (slf *Keyring) open(sealed []byte) ([]byte, error) {
+	_, dataKey, err := slf.dataKey(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := sealed[keyHeaderSize : keyHeaderSize+gcmNonceSize]
+
+	plain, err := aead.Open(nil, nonce, sealed[keyHeaderSize+gcmNonceSize:], []byte(envelopeMagic))
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+
+	return plain, nil
+}
+
+// rewrap swaps the key header of the sealed chunk for one wrapped by the
+// active master key, the rest of the chunk is kept byte for byte
+func (slf *Keyring) rewrap(sealed []byte) ([]byte, bool, error) {
+	keyID, dataKey, err := slf.dataKey(sealed)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if keyID == slf.activeID {
+		return sealed, false, nil
+	}
+
+	header, err := slf.keyHeader(dataKey)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return append(header, sealed[keyHeaderSize:]...), true, nil
+}
+
+func isSealed(data []byte) bool {
+	return len(data) >= EnvelopeOverhead && bytes.HasPrefix(data, []byte(envelopeMagic))
+}
+
+type Encrypted struct {
+	inner BlobStorage
+	keys  *Keyring
+}
+
+func NewEncrypted(inner BlobStorage, keys *Keyring) *Encrypted {
+	return &Encrypted{inner: inner, keys: keys}
+}
+
+func (slf *Encrypted) Unwrap() BlobStorage {
+	return slf.inner
+}
+
+func (slf *Encrypted) sealChunk(chunk *ChunkedFile) (*ChunkedFile, error) {
+	if _, err := chunk.data.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	plain, err := io.ReadAll(chunk.data)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := chunk.verify(plain); err != nil {
+		return nil, err
+	}
+
+	sealed, err := slf.keys.seal(plain)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to seal chunk")
+		return nil, err
+	}
+
+	chunk.stored(int64(len(sealed)))
+
+	return chunk.transformed(sealed), nil
+}
+
+func (slf *Encrypted) UpdateChunk(ctx context.Context, fileID string, chunk *ChunkedFile) (string, error) {
+	sealed, err := slf.sealChunk(chunk)
+	if err != nil {
+		return "", err
+	}
+
+	return slf.inner.UpdateChunk(ctx, fileID, sealed)
+}
+
+func (slf *Encrypted) StoreBlob(ctx context.Context, hash string, chunk *ChunkedFile) (string, error) {
+	sealed, err := slf.sealChunk(chunk)
+	if err != nil {
+		return "", err
+	}
+
+	return slf.inner.StoreBlob(ctx, hash, sealed)
+}
+
+func (slf *Encrypted) BatchCreateChunk(ctx context.Context, fileID string, chunks []*ChunkedFile) ([]*ChunkedFile, error) {
+	sealed := []*ChunkedFile{}
+
+	for _, chunk := range chunks {
+		sealedChunk, err := slf.sealChunk(chunk)
+		if err != nil {
+			return nil, err
+		}
+
+		sealed = append(sealed, sealedChunk)
+	}
+
+	return slf.inner.BatchCreateChunk(ctx, fileID, sealed)
+}
+
+func (slf *Encrypted) ReplaceChunk(ctx context.Context, chunkPath string, chunk *ChunkedFile) error {
+	sealed, err := slf.sealChunk(chunk)
+	if err != nil {
+		return err
+	}
+
+	return slf.inner.ReplaceChunk(ctx, chunkPath, sealed)
+}
+
+// FetchChunks looks the chunks up without opening them, a sealed chunk
+// has the size it takes in the store
+func (slf *Encrypted) FetchChunks(ctx context.Context, chunkPaths []string) ([]*ChunkedFile, error) {
+	return slf.inner.FetchChunks(ctx, chunkPaths)
+}
+
+func (slf *Encrypted) BuildFile(ctx context.Context, chunks []*ChunkedFile) (io.ReadSeekCloser, error) {
+	return NewChunkChain(ctx, chunks, slf.OpenChunk), nil
+}
+
+func (slf *Encrypted) readAll(ctx context.Context, chunkPath string) ([]byte, error) {
+	reader, err := slf.inner.OpenChunk(ctx, chunkPath)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
+
+// OpenChunk reads and decrypts the whole chunk
+func (slf *Encrypted) OpenChunk(ctx context.Context, chunkPath string) (io.ReadCloser, error) {
+	data, err := slf.readAll(ctx, chunkPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isSealed(data) {
+		return NewBytesBlob(data), nil
+	}
+
+	plain, err := slf.keys.open(data)
+	if err != nil {
+		log.Error().Err(err).Str("blob", chunkPath).Msg("failed to open sealed chunk")
+		return nil, err
+	}
+
+	return NewBytesBlob(plain), nil
+}
+
+func (slf *Encrypted) DeleteChunk(ctx context.Context, chunkPath string) error {
+	return slf.inner.DeleteChunk(ctx, chunkPath)
+}
+
+func (slf *Encrypted) ListBlobs(ctx context.Context, fn func(*BlobInfo) error) error {
+	return slf.inner.ListBlobs(ctx, fn)
+}
+
+type RewrapReport struct {
+	Scanned   int `json:"scanned"`
+	Rewrapped int `json:"rewrapped"`
+	Current   int `json:"current"`
+	Plaintext int `json:"plaintext"`
+	Failed    int `json:"failed"`
+}
+
+// Rewrap moves the data key of every sealed chunk to the active master
+// key, after which the older master keys can be dropped
+func (slf *Encrypted) Rewrap(ctx context.Context) (*RewrapReport, error) {
+	report := &RewrapReport{}
+
+	// Replacing while listing would change the store under the walk
+	blobs := []string{}
+
+	err := slf.inner.ListBlobs(ctx, func(blob *BlobInfo) error {
+		blobs = append(blobs, blob.Path)
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	for _, blob := range blobs {
+		report.Scanned += 1
+
+		data, err := slf.readAll(ctx, blob)
+		if err != nil {
+			log.Error().Err(err).Str("blob", blob).Msg("failed to read blob")
+			report.Failed += 1
+			continue
+		}
+
+		if !isSealed(data) {
+			report.Plaintext += 1
+			continue
+		}
+
+		rewrapped, changed, err := slf.keys.rewrap(data)
+		if err != nil {
+			log.Error().Err(err).Str("blob", blob).Msg("failed to rewrap blob")
+			report.Failed += 1
+			continue
+		}
+
+		if !changed {
+			report.Current += 1
+			continue
+		}
+
+		err = slf.inner.ReplaceChunk(ctx, blob, &ChunkedFile{data: NewBytesBlob(rewrapped)})
+		if err != nil {
+			report.Failed += 1
+			continue
+		}
+
+		report.Rewrapped += 1
+	}
+
+	return report, nil
+}
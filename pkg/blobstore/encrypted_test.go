@@ -0,0 +1,202 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testMasterKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func Test_ParseKeyring(t *testing.T) {
+	k1 := base64.StdEncoding.EncodeToString(testMasterKey(1))
+	k2 := base64.StdEncoding.EncodeToString(testMasterKey(2))
+
+	keys, err := ParseKeyring("k2", "k1:"+k1+", k2:"+k2)
+	require.NoError(t, err)
+	require.Equal(t, "k2", keys.activeID)
+	require.Len(t, keys.keys, 2)
+
+	_, err = ParseKeyring("k3", "k1:"+k1)
+	require.ErrorIs(t, err, ErrUnknownKeyID)
+
+	_, err = ParseKeyring("k1", "k1:"+base64.StdEncoding.EncodeToString([]byte("short")))
+	require.ErrorIs(t, err, ErrInvalidMasterKey)
+
+	_, err = ParseKeyring("k1", "k1")
+	require.ErrorIs(t, err, ErrInvalidMasterKey)
+
+	_, err = ParseKeyring(strings.Repeat("k", MaxKeyIDLen+1), strings.Repeat("k", MaxKeyIDLen+1)+":"+k1)
+	require.ErrorIs(t, err, ErrInvalidMasterKey)
+}
+
+func Test_Encrypted(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	localFs, err := NewLocalFS(dir)
+	require.NoError(t, err)
+
+	keys, err := NewKeyring("k1", map[string][]byte{"k1": testMasterKey(1)})
+	require.NoError(t, err)
+
+	storage := NewEncrypted(localFs, keys)
+
+	plain := []byte("a chunk of a log file, in plaintext")
+	sum := sha256.Sum256(plain)
+	hash := hex.EncodeToString(sum[:])
+
+	newChunk := func(data []byte) *ChunkedFile {
+		return NewChunkedFile(NewBytesBlob(data), 0, nil)
+	}
+
+	chunk := newChunk(plain)
+
+	uri, err := storage.StoreBlob(ctx, hash, chunk)
+	require.NoError(t, err)
+
+	t.Run("the blob is stored by the plaintext hash, sealed", func(t *testing.T) {
+		require.Equal(t, "local://blobs/"+hash[:2]+"/"+hash, uri)
+
+		stored, err := os.ReadFile(filepath.Join(dir, BlobsDir, hash[:2], hash))
+		require.NoError(t, err)
+
+		require.Len(t, stored, len(plain)+EnvelopeOverhead)
+		require.Equal(t, int64(len(stored)), chunk.StoredSize())
+		require.False(t, bytes.Contains(stored, plain))
+	})
+
+	t.Run("reads back the plaintext", func(t *testing.T) {
+		chunks, err := storage.FetchChunks(ctx, []string{uri})
+		require.NoError(t, err)
+		require.Equal(t, chunk.StoredSize(), chunks[0].Size())
+
+		chunks[0].WithSize(int64(len(plain)))
+
+		file, err := storage.BuildFile(ctx, chunks)
+		require.NoError(t, err)
+		defer file.Close()
+
+		_, err = file.Seek(2, io.SeekStart)
+		require.NoError(t, err)
+
+		data, err := io.ReadAll(file)
+		require.NoError(t, err)
+		require.Equal(t, plain[2:], data)
+	})
+
+	t.Run("chunks from before encryption are read as they are", func(t *testing.T) {
+		legacy, err := localFs.UpdateChunk(ctx, "File1", newChunk([]byte("old plaintext")))
+		require.NoError(t, err)
+
+		chunks, err := storage.FetchChunks(ctx, []string{legacy, uri})
+		require.NoError(t, err)
+		require.Equal(t, int64(13), chunks[0].Size())
+
+		chunks[1].WithSize(int64(len(plain)))
+
+		file, err := storage.BuildFile(ctx, chunks)
+		require.NoError(t, err)
+		defer file.Close()
+
+		data, err := io.ReadAll(file)
+		require.NoError(t, err)
+		require.Equal(t, "old plaintext"+string(plain), string(data))
+	})
+
+	t.Run("tampering is detected", func(t *testing.T) {
+		tampered, err := storage.UpdateChunk(ctx, "File2", newChunk(plain))
+		require.NoError(t, err)
+
+		path := filepath.Join(dir, "File2", "0")
+		stored, err := os.ReadFile(path)
+		require.NoError(t, err)
+
+		stored[len(stored)-1] ^= 1
+		require.NoError(t, os.WriteFile(path, stored, 0o644))
+
+		_, err = storage.OpenChunk(ctx, tampered)
+		require.ErrorIs(t, err, ErrDecryptFailed)
+	})
+
+	t.Run("the digest is checked against the plaintext", func(t *testing.T) {
+		_, err := storage.UpdateChunk(ctx, "File3", newChunk(plain).WithDigest(hash))
+		require.NoError(t, err)
+
+		_, err = storage.UpdateChunk(ctx, "File3", newChunk([]byte("other")).WithDigest(hash))
+		require.ErrorIs(t, err, ErrDigestMismatch)
+	})
+
+	t.Run("a master key which isn't known", func(t *testing.T) {
+		other, err := NewKeyring("k9", map[string][]byte{"k9": testMasterKey(9)})
+		require.NoError(t, err)
+
+		_, err = NewEncrypted(localFs, other).OpenChunk(ctx, uri)
+		require.ErrorIs(t, err, ErrUnknownKeyID)
+	})
+}
+
+func Test_EncryptedRewrap(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	localFs, err := NewLocalFS(dir)
+	require.NoError(t, err)
+
+	oldKeys, err := NewKeyring("k1", map[string][]byte{"k1": testMasterKey(1)})
+	require.NoError(t, err)
+
+	plain := []byte("rotated")
+
+	uri, err := NewEncrypted(localFs, oldKeys).UpdateChunk(ctx, "File1", NewChunkedFile(NewBytesBlob(plain), 0, nil))
+	require.NoError(t, err)
+
+	_, err = localFs.UpdateChunk(ctx, "File2", NewChunkedFile(NewBytesBlob([]byte("plaintext")), 0, nil))
+	require.NoError(t, err)
+
+	path := filepath.Join(dir, "File1", "0")
+	before, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	keys, err := NewKeyring("k2", map[string][]byte{"k1": testMasterKey(1), "k2": testMasterKey(2)})
+	require.NoError(t, err)
+
+	report, err := NewEncrypted(localFs, keys).Rewrap(ctx)
+	require.NoError(t, err)
+	require.Equal(t, &RewrapReport{Scanned: 2, Rewrapped: 1, Plaintext: 1}, report)
+
+	after, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	// Only the key header changed, the data is as it was
+	require.NotEqual(t, before[:keyHeaderSize], after[:keyHeaderSize])
+	require.Equal(t, before[keyHeaderSize:], after[keyHeaderSize:])
+
+	// Readable without the old master key
+	onlyNew, err := NewKeyring("k2", map[string][]byte{"k2": testMasterKey(2)})
+	require.NoError(t, err)
+
+	reader, err := NewEncrypted(localFs, onlyNew).OpenChunk(ctx, uri)
+	require.NoError(t, err)
+
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, plain, data)
+
+	t.Run("nothing left to rewrap", func(t *testing.T) {
+		report, err := NewEncrypted(localFs, keys).Rewrap(ctx)
+		require.NoError(t, err)
+		require.Equal(t, &RewrapReport{Scanned: 2, Current: 1, Plaintext: 1}, report)
+	})
+}
@@ -2,7 +2,11 @@ package blobstore
 
 import (
 	"arbokcore/pkg/utils"
+	"bytes"
 	"context"
+	"errors"
+	"io"
+	"sort"
 	"time"
 )
 
@@ -57,3 +61,153 @@ func ReadFileInChunks(ctx context.Context, filePath string) (chunks []*ChunkedFi
 	//
 	return chunks, nil
 }
+
+var (
+	ErrInvalidSeek   = errors.New("invalid_seek")
+	ErrChunkTooShort = errors.New("chunk_too_short")
+)
+
+// bytesBlob is a chunk held in memory
+type bytesBlob struct {
+	*bytes.Reader
+}
+
+func (bytesBlob) Close() error { return nil }
+
+func NewBytesBlob(data []byte) io.ReadSeekCloser {
+	return bytesBlob{bytes.NewReader(data)}
+}
+
+type ChunkOpener func(ctx context.Context, chunkPath string) (io.ReadCloser, error)
+
+// ChunkChain reads the chunks as one file, opening a chunk only when the
+// read gets to it. Seeking within the chunk being read keeps it open,
+// otherwise the chunk at the new offset is opened, so a range of the file
+// only reads the chunks it covers.
+type ChunkChain struct {
+	ctx     context.Context
+	chunks  []*ChunkedFile
+	offsets []int64
+	size    int64
+	open    ChunkOpener
+
+	pos int64
+
+	current    io.ReadCloser
+	currentEnd int64
+	currentPos int64
+}
+
+func NewChunkChain(ctx context.Context, chunks []*ChunkedFile, open ChunkOpener) *ChunkChain {
+	offsets := make([]int64, len(chunks))
+	size := int64(0)
+
+	for i, chunk := range chunks {
+		offsets[i] = size
+		size += chunk.size
+	}
+
+	return &ChunkChain{ctx: ctx, chunks: chunks, offsets: offsets, size: size, open: open}
+}
+
+func (slf *ChunkChain) Size() int64 {
+	return slf.size
+}
+
+func (slf *ChunkChain) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += slf.pos
+	case io.SeekEnd:
+		offset += slf.size
+	default:
+		return 0, ErrInvalidSeek
+	}
+
+	if offset < 0 {
+		return 0, ErrInvalidSeek
+	}
+
+	slf.pos = offset
+	return offset, nil
+}
+
+func (slf *ChunkChain) Read(p []byte) (int, error) {
+	if slf.pos >= slf.size {
+		return 0, io.EOF
+	}
+
+	if slf.current == nil || slf.currentPos != slf.pos {
+		if err := slf.openAt(slf.pos); err != nil {
+			return 0, err
+		}
+	}
+
+	if left := slf.currentEnd - slf.pos; int64(len(p)) > left {
+		p = p[:left]
+	}
+
+	n, err := slf.current.Read(p)
+	slf.pos += int64(n)
+	slf.currentPos = slf.pos
+
+	if errors.Is(err, io.EOF) {
+		err = nil
+
+		if slf.pos < slf.currentEnd {
+			err = ErrChunkTooShort
+		}
+	}
+
+	if slf.pos == slf.currentEnd {
+		slf.closeCurrent()
+	}
+
+	return n, err
+}
+
+func (slf *ChunkChain) Close() error {
+	slf.closeCurrent()
+	return nil
+}
+
+func (slf *ChunkChain) closeCurrent() {
+	if slf.current != nil {
+		slf.current.Close()
+		slf.current = nil
+	}
+}
+
+func (slf *ChunkChain) openAt(pos int64) error {
+	slf.closeCurrent()
+
+	index := sort.Search(len(slf.chunks), func(i int) bool {
+		return slf.offsets[i]+slf.chunks[i].size > pos
+	})
+	chunk := slf.chunks[index]
+
+	reader, err := slf.open(slf.ctx, chunk.chunkPath)
+	if err != nil {
+		return err
+	}
+
+	if skip := pos - slf.offsets[index]; skip > 0 {
+		if seeker, ok := reader.(io.Seeker); ok {
+			_, err = seeker.Seek(skip, io.SeekStart)
+		} else {
+			_, err = io.CopyN(io.Discard, reader, skip)
+		}
+
+		if err != nil {
+			reader.Close()
+			return err
+		}
+	}
+
+	slf.current = reader
+	slf.currentEnd = slf.offsets[index] + chunk.size
+	slf.currentPos = pos
+
+	return nil
+}
@@ -2,27 +2,40 @@ package blobstore
 
 import (
 	"arbokcore/pkg/utils"
-	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/rogpeppe/go-internal/lockedfile"
 	"github.com/rs/zerolog/log"
 )
 
-//TODO: use https://pkg.go.dev/github.com/rogpeppe/go-internal/lockedfile to lock the directory
-
 type ChunkedFile struct {
 	data    io.ReadSeekCloser
 	chunkID int64
 
 	fileDir   string
 	chunkPath string
+	size      int64
 	next      *ChunkedFile
+
+	codec      string
+	storedSize int64
+
+	digest string
+
+	// The chunk a decorator transformed this one from
+	origin *ChunkedFile
 }
 
 const ChunkSize = int64(4 * 1024 * 1024)
@@ -31,35 +44,184 @@ func NewChunkedFile(data io.ReadSeekCloser, chunkID int64, next *ChunkedFile) *C
 	return &ChunkedFile{data: data, chunkID: chunkID, next: next}
 }
 
-// We could have a BuildFile, because our chunk names are sequential integers,
-// ordering isn't much of an issue
-// In case of array, the whole file will essentially be in memory
-// Instead of loading in parallel, we could load sequentially
-// there having a next pointer and a GetNextChunk will help
-// Fetch Chunks needs to only load the linkedlist or array
-// And then expose another function BuildFile which will take the
-// head of the linked list or array, and then append the chunks sequentially
-// Since, we will only store structs and not data, until evaluated
-// switching to array for better memory access
+func (slf *ChunkedFile) ChunkID() int64 {
+	return slf.chunkID
+}
+
+func (slf *ChunkedFile) Path() string {
+	return slf.chunkPath
+}
+
+func (slf *ChunkedFile) Size() int64 {
+	return slf.size
+}
+
+// WithSize sets the size the chunk reads as. A storage which changes the
+// bytes it keeps fetches a chunk with the size it takes in the store, the
+// caller sets the size it recorded for the chunk before building the file.
+func (slf *ChunkedFile) WithSize(size int64) *ChunkedFile {
+	slf.size = size
+	return slf
+}
+
+// WithDigest sets the sha256 the data of the chunk has, the storage
+// checks the bytes it writes against it
+func (slf *ChunkedFile) WithDigest(digest string) *ChunkedFile {
+	slf.digest = digest
+	return slf
+}
+
+func (slf *ChunkedFile) verify(data []byte) error {
+	if slf.digest == "" {
+		return nil
+	}
+
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != slf.digest {
+		return ErrDigestMismatch
+	}
+
+	return nil
+}
+
+// transformed is the chunk with its data replaced by a decorator, the
+// digest follows the new data when the chunk had one
+func (slf *ChunkedFile) transformed(data []byte) *ChunkedFile {
+	chunk := &ChunkedFile{
+		data:    NewBytesBlob(data),
+		chunkID: slf.chunkID,
+		fileDir: slf.fileDir,
+		origin:  slf,
+	}
+
+	if slf.origin != nil {
+		chunk.origin = slf.origin
+	}
+
+	if slf.digest != "" {
+		sum := sha256.Sum256(data)
+		chunk.digest = hex.EncodeToString(sum[:])
+	}
+
+	return chunk
+}
+
+// Codec is the compression the chunk is stored with
+func (slf *ChunkedFile) Codec() string {
+	if slf.codec == "" {
+		return CodecNone
+	}
+
+	return slf.codec
+}
+
+// StoredSize is the size the chunk takes in the store, once compressed
+// and sealed, 0 when the storage keeps the chunk as it was given
+func (slf *ChunkedFile) StoredSize() int64 {
+	return slf.storedSize
+}
+
+// stored records the size the chunk takes in the store on the chunk the
+// caller gave, the decorators only see the chunks they transformed it to
+func (slf *ChunkedFile) stored(size int64) {
+	if slf.origin != nil {
+		slf.origin.storedSize = size
+	}
+
+	slf.storedSize = size
+}
+
+// FetchChunks only looks the chunks up, in the order of the file, nothing
+// is read until BuildFile's reader gets to a chunk. So a file is never
+// held in memory, only the chunk being read.
 
 type BlobStorage interface {
 	UpdateChunk(ctx context.Context, fileID string, chunk *ChunkedFile) (string, error)
+	StoreBlob(ctx context.Context, hash string, chunk *ChunkedFile) (string, error)
 	BatchCreateChunk(ctx context.Context, fileID string, chunks []*ChunkedFile) ([]*ChunkedFile, error)
-	FetchChunks(ctx context.Context, fileID string, chunkIDs []int64) ([]*ChunkedFile, error)
-	BuildFile(ctx context.Context, chunkIDs []*ChunkedFile) (io.ReadCloser, error)
+	FetchChunks(ctx context.Context, chunkPaths []string) ([]*ChunkedFile, error)
+	BuildFile(ctx context.Context, chunks []*ChunkedFile) (io.ReadSeekCloser, error)
+	ReplaceChunk(ctx context.Context, chunkPath string, chunk *ChunkedFile) error
+	DeleteChunk(ctx context.Context, chunkPath string) error
+	OpenChunk(ctx context.Context, chunkPath string) (io.ReadCloser, error)
+	ListBlobs(ctx context.Context, fn func(*BlobInfo) error) error
+}
+
+// BlobInfo is a blob found in the storage, Path is the same
+// url the storage returned when the blob was written
+type BlobInfo struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
 }
 
 type LocalFS struct {
 	dirPath string
 }
 
-var ErrNotDirectory = errors.New("not_a_directory")
+var (
+	ErrNotDirectory = errors.New("not_a_directory")
+	ErrOutsideStore = errors.New("path_outside_store")
+	ErrInvalidHash  = errors.New("invalid_blob_hash")
+	ErrBlobNotFound = errors.New("blob_not_found")
+
+	ErrDigestMismatch = errors.New("chunk_digest_mismatch")
+)
+
+const (
+	BlobsDir    = "blobs"
+	LocksDir    = ".locks"
+	LocalScheme = BackendLocal + "://"
+)
+
+var blobHashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
 
 func NewLocalFS(dirPath string) (*LocalFS, error) {
 	resolvedPath, err := filepath.Abs(dirPath)
 	return &LocalFS{dirPath: resolvedPath}, err
 }
 
+// URI is the blob uri of a path in the store, local://<path from the store>,
+// so the uris stay valid when the store is moved
+func (slf *LocalFS) URI(path string) (string, error) {
+	rel, err := slf.relative(path)
+	if err != nil {
+		return "", err
+	}
+
+	return LocalScheme + filepath.ToSlash(rel), nil
+}
+
+// resolve is the path of a blob uri. Absolute paths in the store, stored
+// before the uris, still resolve until they are migrated.
+func (slf *LocalFS) resolve(uri string) (string, error) {
+	var path string
+
+	switch {
+	case strings.HasPrefix(uri, LocalScheme):
+		path = filepath.Join(slf.dirPath, filepath.FromSlash(strings.TrimPrefix(uri, LocalScheme)))
+	case filepath.IsAbs(uri):
+		path = filepath.Clean(uri)
+	default:
+		return "", ErrInvalidURI
+	}
+
+	if _, err := slf.relative(path); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+func (slf *LocalFS) relative(path string) (string, error) {
+	rel, err := filepath.Rel(slf.dirPath, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", ErrOutsideStore
+	}
+
+	return rel, nil
+}
+
 func EnsureDir(resolvedPath string) error {
 	err := os.MkdirAll(resolvedPath, os.ModePerm)
 	if err == nil {
@@ -84,43 +246,174 @@ func EnsureDir(resolvedPath string) error {
 	return err
 }
 
+// lock takes the lock of the path, across processes. Paths share 256 lock
+// files by the hash of their name, a path always gets the same one.
+func (slf *LocalFS) lock(path string) (func(), error) {
+	sum := sha256.Sum256([]byte(path))
+
+	dir := filepath.Join(slf.dirPath, LocksDir)
+	if err := EnsureDir(dir); err != nil {
+		return nil, err
+	}
+
+	unlock, err := lockedfile.MutexAt(filepath.Join(dir, hex.EncodeToString(sum[:1]))).Lock()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to lock " + path)
+		return nil, err
+	}
+
+	return unlock, nil
+}
+
+// syncDir makes the entries of the directory durable,
+// a rename isn't until its directory is synced
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
+
+// write puts the chunk at path, with the lock of the path held. The chunk
+// is written to a temporary file which is synced and renamed over path, so
+// path only ever holds a whole chunk, even after a crash. The directory
+// is synced after, and its parent too, in case the directory is new.
+func (slf *LocalFS) write(path string, chunk *ChunkedFile) (int64, error) {
+	dir := filepath.Dir(path)
+
+	if err := EnsureDir(dir); err != nil {
+		return 0, err
+	}
+
+	file, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		log.Error().Err(err).Msg("failed to create chunk in " + dir)
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+
+	written, err := slf.copyChunk(file, chunk)
+	if err != nil {
+		file.Close()
+		log.Error().Err(err).Str("path", path).Msg("failed to write chunk")
+		return 0, err
+	}
+
+	if err := file.Close(); err != nil {
+		return 0, err
+	}
+
+	if err := os.Rename(file.Name(), path); err != nil {
+		log.Error().Err(err).Msg("failed to move chunk to " + path)
+		return 0, err
+	}
+
+	if err := syncDir(dir); err != nil {
+		return 0, err
+	}
+
+	if dir != slf.dirPath {
+		if err := syncDir(filepath.Dir(dir)); err != nil {
+			return 0, err
+		}
+	}
+
+	return written, nil
+}
+
+// copyChunk writes the data of the chunk to the file and syncs it,
+// the bytes written are checked against the digest of the chunk
+func (slf *LocalFS) copyChunk(file *os.File, chunk *ChunkedFile) (int64, error) {
+	if _, err := chunk.data.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	hasher := sha256.New()
+
+	written, err := io.Copy(io.MultiWriter(file, hasher), chunk.data)
+	if err != nil {
+		return written, err
+	}
+
+	if chunk.digest != "" && hex.EncodeToString(hasher.Sum(nil)) != chunk.digest {
+		return written, ErrDigestMismatch
+	}
+
+	return written, file.Sync()
+}
+
 func (slf *LocalFS) UpdateChunk(ctx context.Context, fileID string, chunk *ChunkedFile) (string, error) {
-	err := EnsureDir(filepath.Join(slf.dirPath, fileID))
+	path := filepath.Join(slf.dirPath, fileID, fmt.Sprintf("%d", chunk.chunkID))
+
+	uri, err := slf.URI(path)
 	if err != nil {
 		return "", err
 	}
 
-	path := filepath.Join(slf.dirPath, fileID, fmt.Sprintf("%d", chunk.chunkID))
+	unlock, err := slf.lock(path)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
 
-	tracker := utils.Bench2("file create")
-	file, err := os.Create(path)
+	tracker := utils.Bench2("write chunk")
+	written, err := slf.write(path, chunk)
 	if err != nil {
-		log.Error().Err(err).Msg("failed to create file at " + path)
 		return "", err
 	}
 	tracker()
 
-	chunk.data.Seek(0, io.SeekStart)
+	log.Info().
+		Int("written data", int(written)).
+		Str("path", path).
+		Msg("written to path")
+
+	return uri, nil
+}
 
-	var byt bytes.Buffer
-	byt.ReadFrom(chunk.data)
+// StoreBlob stores the chunk by the sha256 of its content, under
+// blobs/<first two chars>/<hash>, so identical chunks of any file share
+// one blob. When the blob is already there, it is not written again.
+func (slf *LocalFS) StoreBlob(ctx context.Context, hash string, chunk *ChunkedFile) (string, error) {
+	if !blobHashPattern.MatchString(hash) {
+		return "", ErrInvalidHash
+	}
 
-	chunk.data.Seek(0, io.SeekStart)
+	path := filepath.Join(slf.dirPath, BlobsDir, hash[:2], hash)
 
-	tracker = utils.Bench2("copy file")
-	written, err := io.Copy(file, chunk.data)
+	unlock, err := slf.lock(path)
 	if err != nil {
-		log.Error().Err(err).Msg("failed to write to dile")
-		return "", nil
+		return "", err
+	}
+	defer unlock()
+
+	// Reusing a blob restarts its grace period, so that
+	// the garbage collector doesn't take it from under us
+	if _, err := os.Stat(path); err == nil {
+		now := time.Now()
+		if err := os.Chtimes(path, now, now); err != nil {
+			return "", err
+		}
+
+		return slf.URI(path)
+	}
+
+	// A blob is only visible once fully written, a half written one
+	// would be shared by every later chunk with the same hash
+	written, err := slf.write(path, chunk)
+	if err != nil {
+		return "", err
 	}
-	tracker()
 
 	log.Info().
 		Int("written data", int(written)).
 		Str("path", path).
-		Msg("written to path")
+		Msg("written blob to path")
 
-	return path, nil
+	return slf.URI(path)
 }
 
 var ErrFileUpload = errors.New("file_upload_failed")
@@ -131,10 +424,9 @@ func (slf *LocalFS) BatchCreateChunk(
 	chunks []*ChunkedFile,
 ) ([]*ChunkedFile, error) {
 
-	chunksRevceiver := make(chan ChunkedFile, len(chunks))
+	created := make([]*ChunkedFile, len(chunks))
+	errs := make([]error, len(chunks))
 
-	// Oh, because the channel closing doesn't happen?
-	// Hm
 	var wg sync.WaitGroup
 
 	for index, chunk := range chunks {
@@ -147,10 +439,11 @@ func (slf *LocalFS) BatchCreateChunk(
 			filePath, err := slf.UpdateChunk(ctx, fileID, &_chunk)
 			if err != nil {
 				log.Error().Err(err).Msg("failed to update chunk")
+				errs[i] = err
 				return
 			}
 
-			chunksRevceiver <- ChunkedFile{
+			created[i] = &ChunkedFile{
 				chunkID:   i,
 				chunkPath: filePath,
 				data:      _chunk.data,
@@ -159,26 +452,162 @@ func (slf *LocalFS) BatchCreateChunk(
 	}
 
 	wg.Wait()
-	close(chunksRevceiver)
 
-	chunkData := []*ChunkedFile{}
+	for _, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrFileUpload, err)
+		}
+	}
+
+	return created, nil
+}
+
+func (slf *LocalFS) FetchChunks(ctx context.Context, chunkPaths []string) ([]*ChunkedFile, error) {
+	chunks := make([]*ChunkedFile, len(chunkPaths))
 
-	// Pray that this completes
-	for chunk := range chunksRevceiver {
-		chunkData = append(chunkData, &chunk)
+	for i := len(chunkPaths) - 1; i >= 0; i-- {
+		path, err := slf.resolve(chunkPaths[i])
+		if err != nil {
+			return nil, err
+		}
+
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s", ErrBlobNotFound, chunkPaths[i])
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		chunks[i] = &ChunkedFile{
+			chunkID:   int64(i),
+			fileDir:   filepath.Dir(path),
+			chunkPath: chunkPaths[i],
+			size:      info.Size(),
+		}
+
+		if i+1 < len(chunks) {
+			chunks[i].next = chunks[i+1]
+		}
 	}
 
-	if len(chunkData) != len(chunks) {
-		return nil, ErrFileUpload
+	return chunks, nil
+}
+
+// BuildFile reads the chunks one after the other, as one file
+func (slf *LocalFS) BuildFile(ctx context.Context, chunks []*ChunkedFile) (io.ReadSeekCloser, error) {
+	return NewChunkChain(ctx, chunks, slf.OpenChunk), nil
+}
+
+// OpenChunk opens the chunk for reading, it is up to the caller to close it
+func (slf *LocalFS) OpenChunk(ctx context.Context, chunkPath string) (io.ReadCloser, error) {
+	path, err := slf.resolve(chunkPath)
+	if err != nil {
+		return nil, err
 	}
 
-	return chunkData, nil
+	file, err := os.Open(path)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to open chunk at " + chunkPath)
+		return nil, err
+	}
+
+	return file, nil
 }
 
-func (slf *LocalFS) FetchChunks(ctx context.Context, fileID string, chunkIDs []int64) ([]*ChunkedFile, error) {
-	return nil, nil
+// ReplaceChunk writes the chunk over the blob at chunkPath, the new
+// content only takes the place of the old one once fully written
+func (slf *LocalFS) ReplaceChunk(ctx context.Context, chunkPath string, chunk *ChunkedFile) error {
+	path, err := slf.resolve(chunkPath)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := slf.lock(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	_, err = slf.write(path, chunk)
+	return err
+}
+
+// DeleteChunk removes the chunk, and the directory of the file once it
+// has no chunks left. Deleting a chunk which is already gone is not an error.
+func (slf *LocalFS) DeleteChunk(ctx context.Context, chunkPath string) error {
+	path, err := slf.resolve(chunkPath)
+	if err != nil {
+		log.Error().Str("path", chunkPath).Msg("refusing to delete outside the store")
+		return err
+	}
+
+	unlock, err := slf.lock(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Error().Err(err).Msg("failed to delete chunk at " + path)
+		return err
+	}
+
+	// The directory of a file goes with its last chunk, it fails while
+	// other chunks are left, which is fine. The prefix directories of the
+	// blobs are shared by every hash under them and stay, a blob of
+	// another hash could be written to one right now.
+	dir := filepath.Dir(path)
+	if dir != slf.dirPath && filepath.Dir(dir) != filepath.Join(slf.dirPath, BlobsDir) {
+		os.Remove(dir)
+	}
+
+	return nil
 }
 
-func (slf *LocalFS) BuildFile(ctx context.Context, chunkIDs []*ChunkedFile) (io.ReadCloser, error) {
-	return nil, nil
+// ListBlobs walks every file in the store, the blobs are listed by uri
+func (slf *LocalFS) ListBlobs(ctx context.Context, fn func(*BlobInfo) error) error {
+	return filepath.WalkDir(slf.dirPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// The store hasn't been written to yet
+			if path == slf.dirPath && os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if entry.IsDir() && path == filepath.Join(slf.dirPath, LocksDir) {
+			return filepath.SkipDir
+		}
+
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		uri, err := slf.URI(path)
+		if err != nil {
+			return err
+		}
+
+		return fn(&BlobInfo{
+			Path:    uri,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	})
 }
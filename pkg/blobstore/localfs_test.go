@@ -2,8 +2,17 @@ package blobstore
 
 import (
 	"arbokcore/pkg/utils"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -97,3 +106,460 @@ func Test_WriteFileChunks(t *testing.T) {
 	})
 
 }
+
+func Test_DeleteChunk(t *testing.T) {
+	ctx := context.Background()
+
+	fs, err := NewLocalFS(t.TempDir())
+	require.NoError(t, err)
+
+	chunkPath := filepath.Join(fs.dirPath, "file1", "0")
+	require.NoError(t, EnsureDir(filepath.Dir(chunkPath)))
+	require.NoError(t, os.WriteFile(chunkPath, []byte("chunk"), 0o644))
+
+	t.Run("removes the chunk and the empty file directory", func(t *testing.T) {
+		require.NoError(t, fs.DeleteChunk(ctx, chunkPath))
+
+		_, err := os.Stat(filepath.Dir(chunkPath))
+		require.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("deleting a missing chunk is not an error", func(t *testing.T) {
+		require.NoError(t, fs.DeleteChunk(ctx, chunkPath))
+	})
+
+	t.Run("keeps the prefix directory of a blob", func(t *testing.T) {
+		hash := strings.Repeat("cd", 32)
+
+		uri, err := fs.StoreBlob(ctx, hash, NewChunkedFile(NewBytesBlob([]byte("blob")), 0, nil))
+		require.NoError(t, err)
+
+		require.NoError(t, fs.DeleteChunk(ctx, uri))
+
+		_, err = os.Stat(filepath.Join(fs.dirPath, BlobsDir, hash[:2], hash))
+		require.True(t, os.IsNotExist(err))
+
+		stat, err := os.Stat(filepath.Join(fs.dirPath, BlobsDir, hash[:2]))
+		require.NoError(t, err)
+		require.True(t, stat.IsDir())
+	})
+
+	t.Run("refuses paths outside the store", func(t *testing.T) {
+		outside := filepath.Join(filepath.Dir(fs.dirPath), "outside")
+
+		require.ErrorIs(t, fs.DeleteChunk(ctx, outside), ErrOutsideStore)
+		require.ErrorIs(t, fs.DeleteChunk(ctx, fs.dirPath), ErrOutsideStore)
+		require.ErrorIs(t, fs.DeleteChunk(ctx, filepath.Join(fs.dirPath, "..", "x")), ErrOutsideStore)
+	})
+}
+
+// failingBlob fails its reads after the first bytes, like a full disk
+// or a dropped upload would
+type failingBlob struct {
+	data    *bytes.Reader
+	seekErr error
+}
+
+var errBrokenRead = errors.New("broken read")
+
+func newFailingBlob(data string) *failingBlob {
+	return &failingBlob{data: bytes.NewReader([]byte(data))}
+}
+
+func (slf *failingBlob) Read(p []byte) (int, error) {
+	n, _ := slf.data.Read(p[:min(len(p), 2)])
+	if n == 0 {
+		return 0, errBrokenRead
+	}
+
+	return n, nil
+}
+
+func (slf *failingBlob) Seek(offset int64, whence int) (int64, error) {
+	if slf.seekErr != nil {
+		return 0, slf.seekErr
+	}
+
+	return slf.data.Seek(offset, whence)
+}
+
+func (slf *failingBlob) Close() error { return nil }
+
+func Test_UpdateChunk(t *testing.T) {
+	ctx := context.Background()
+
+	fs, err := NewLocalFS(t.TempDir())
+	require.NoError(t, err)
+
+	path := filepath.Join(fs.dirPath, "File1", "0")
+
+	newChunk := func(data string) *ChunkedFile {
+		return NewChunkedFile(NewBytesBlob([]byte(data)), 0, nil)
+	}
+
+	digest := func(data string) string {
+		sum := sha256.Sum256([]byte(data))
+		return hex.EncodeToString(sum[:])
+	}
+
+	// Only the chunk is left in the directory, no temporary files
+	requireStored := func(t *testing.T, data string) {
+		stored, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, data, string(stored))
+
+		entries, err := os.ReadDir(filepath.Dir(path))
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+	}
+
+	uri, err := fs.UpdateChunk(ctx, "File1", newChunk("first").WithDigest(digest("first")))
+	require.NoError(t, err)
+	require.Equal(t, "local://File1/0", uri)
+	requireStored(t, "first")
+
+	t.Run("a chunk which doesn't match its digest isn't written", func(t *testing.T) {
+		_, err := fs.UpdateChunk(ctx, "File1", newChunk("second").WithDigest(digest("other")))
+		require.ErrorIs(t, err, ErrDigestMismatch)
+
+		requireStored(t, "first")
+	})
+
+	t.Run("a failed write keeps the chunk as it was", func(t *testing.T) {
+		broken := newFailingBlob("second")
+
+		_, err := fs.UpdateChunk(ctx, "File1", NewChunkedFile(broken, 0, nil))
+		require.ErrorIs(t, err, errBrokenRead)
+
+		requireStored(t, "first")
+	})
+
+	t.Run("a failed seek is an error", func(t *testing.T) {
+		broken := newFailingBlob("second")
+		broken.seekErr = ErrInvalidSeek
+
+		_, err := fs.UpdateChunk(ctx, "File1", NewChunkedFile(broken, 0, nil))
+		require.ErrorIs(t, err, ErrInvalidSeek)
+
+		requireStored(t, "first")
+	})
+
+	t.Run("concurrent writes leave one whole chunk", func(t *testing.T) {
+		var wg sync.WaitGroup
+
+		contents := []string{strings.Repeat("a", 1<<16), strings.Repeat("b", 1<<16)}
+
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+
+			go func(data string) {
+				defer wg.Done()
+
+				_, err := fs.UpdateChunk(ctx, "File1", newChunk(data))
+				require.NoError(t, err)
+			}(contents[i%2])
+		}
+
+		wg.Wait()
+
+		stored, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Contains(t, contents, string(stored))
+	})
+
+	t.Run("batches report the failed chunk", func(t *testing.T) {
+		broken := newFailingBlob("second")
+
+		_, err := fs.BatchCreateChunk(ctx, "File2", []*ChunkedFile{
+			newChunk("fine"),
+			NewChunkedFile(broken, 1, nil),
+		})
+		require.ErrorIs(t, err, ErrFileUpload)
+		require.ErrorIs(t, err, errBrokenRead)
+	})
+}
+
+func Test_StoreBlob(t *testing.T) {
+	ctx := context.Background()
+
+	fs, err := NewLocalFS(t.TempDir())
+	require.NoError(t, err)
+
+	data := []byte("same chunk in two files")
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	newChunk := func(data []byte) *ChunkedFile {
+		return NewChunkedFile(NewBytesBlob(data), 0, nil)
+	}
+
+	path := filepath.Join(fs.dirPath, BlobsDir, hash[:2], hash)
+
+	t.Run("stores the chunk under its hash", func(t *testing.T) {
+		uri, err := fs.StoreBlob(ctx, hash, newChunk(data))
+		require.NoError(t, err)
+
+		require.Equal(t, "local://blobs/"+hash[:2]+"/"+hash, uri)
+
+		stored, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, data, stored)
+	})
+
+	t.Run("an existing blob is reused", func(t *testing.T) {
+		_, err := fs.StoreBlob(ctx, hash, newChunk(data))
+		require.NoError(t, err)
+
+		entries, err := os.ReadDir(filepath.Dir(path))
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+	})
+
+	t.Run("refuses hashes which aren't sha256", func(t *testing.T) {
+		_, err := fs.StoreBlob(ctx, "../../etc/passwd", newChunk(data))
+		require.ErrorIs(t, err, ErrInvalidHash)
+	})
+
+	t.Run("refuses data which isn't the digest", func(t *testing.T) {
+		other := []byte("not the same chunk")
+		sum := sha256.Sum256(other)
+		otherHash := hex.EncodeToString(sum[:])
+
+		_, err := fs.StoreBlob(ctx, otherHash, newChunk(data).WithDigest(otherHash))
+		require.ErrorIs(t, err, ErrDigestMismatch)
+
+		entries, err := os.ReadDir(filepath.Join(fs.dirPath, BlobsDir, otherHash[:2]))
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	})
+}
+
+func Test_ListBlobs(t *testing.T) {
+	ctx := context.Background()
+
+	fs, err := NewLocalFS(t.TempDir())
+	require.NoError(t, err)
+
+	listAll := func() map[string]int64 {
+		found := map[string]int64{}
+
+		err := fs.ListBlobs(ctx, func(blob *BlobInfo) error {
+			found[blob.Path] = blob.Size
+			return nil
+		})
+		require.NoError(t, err)
+
+		return found
+	}
+
+	t.Run("empty store", func(t *testing.T) {
+		require.Empty(t, listAll())
+	})
+
+	t.Run("lists files of every directory", func(t *testing.T) {
+		chunkPath := filepath.Join(fs.dirPath, "file1", "0")
+		require.NoError(t, EnsureDir(filepath.Dir(chunkPath)))
+		require.NoError(t, os.WriteFile(chunkPath, []byte("chunk"), 0o644))
+
+		data := []byte("blob")
+		sum := sha256.Sum256(data)
+
+		blobURI, err := fs.StoreBlob(ctx, hex.EncodeToString(sum[:]), NewChunkedFile(NewBytesBlob(data), 0, nil))
+		require.NoError(t, err)
+
+		require.Equal(t, map[string]int64{"local://file1/0": 5, blobURI: 4}, listAll())
+	})
+
+	t.Run("missing store is empty", func(t *testing.T) {
+		missing, err := NewLocalFS(filepath.Join(t.TempDir(), "missing"))
+		require.NoError(t, err)
+
+		require.NoError(t, missing.ListBlobs(ctx, func(*BlobInfo) error {
+			t.Fatal("no blobs expected")
+			return nil
+		}))
+	})
+}
+
+func Test_FetchChunks(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	storage, err := NewLocalFS(dir)
+	require.NoError(t, err)
+
+	chunkPaths := []string{}
+	for i, data := range []string{"first ", "second ", "third"} {
+		path := filepath.Join(dir, "File1", fmt.Sprintf("%d", i))
+		require.NoError(t, EnsureDir(filepath.Dir(path)))
+		require.NoError(t, os.WriteFile(path, []byte(data), 0o644))
+
+		chunkPaths = append(chunkPaths, fmt.Sprintf("local://File1/%d", i))
+	}
+
+	t.Run("links the chunks in order", func(t *testing.T) {
+		chunks, err := storage.FetchChunks(ctx, chunkPaths)
+		require.NoError(t, err)
+		require.Len(t, chunks, 3)
+
+		for i, chunk := range chunks {
+			require.Equal(t, int64(i), chunk.ChunkID())
+			require.Equal(t, chunkPaths[i], chunk.Path())
+		}
+
+		require.Equal(t, int64(7), chunks[1].Size())
+		require.Equal(t, chunks[1], chunks[0].next)
+		require.Nil(t, chunks[2].next)
+	})
+
+	t.Run("missing chunk", func(t *testing.T) {
+		_, err := storage.FetchChunks(ctx, []string{chunkPaths[0], "local://File1/9"})
+		require.ErrorIs(t, err, ErrBlobNotFound)
+	})
+
+	t.Run("absolute paths from before the uris", func(t *testing.T) {
+		chunks, err := storage.FetchChunks(ctx, []string{filepath.Join(dir, "File1", "0")})
+		require.NoError(t, err)
+		require.Equal(t, int64(6), chunks[0].Size())
+	})
+
+	t.Run("uris outside the store", func(t *testing.T) {
+		_, err := storage.FetchChunks(ctx, []string{"local://../File1/0"})
+		require.ErrorIs(t, err, ErrOutsideStore)
+
+		_, err = storage.FetchChunks(ctx, []string{filepath.Join(filepath.Dir(dir), "File1", "0")})
+		require.ErrorIs(t, err, ErrOutsideStore)
+
+		_, err = storage.FetchChunks(ctx, []string{"File1/0"})
+		require.ErrorIs(t, err, ErrInvalidURI)
+	})
+}
+
+func Test_LocalURI(t *testing.T) {
+	dir := t.TempDir()
+
+	storage, err := NewLocalFS(dir)
+	require.NoError(t, err)
+
+	uri, err := storage.URI(filepath.Join(dir, "blobs", "ab", "abcd"))
+	require.NoError(t, err)
+	require.Equal(t, "local://blobs/ab/abcd", uri)
+
+	_, err = storage.URI(filepath.Join(filepath.Dir(dir), "elsewhere", "0"))
+	require.ErrorIs(t, err, ErrOutsideStore)
+
+	t.Run("uris survive moving the store", func(t *testing.T) {
+		ctx := context.Background()
+
+		chunk := NewChunkedFile(NewBytesBlob([]byte("chunk")), 0, nil)
+
+		uri, err := storage.UpdateChunk(ctx, "File1", chunk)
+		require.NoError(t, err)
+		require.Equal(t, "local://File1/0", uri)
+
+		moved := filepath.Join(t.TempDir(), "moved")
+		require.NoError(t, os.Rename(dir, moved))
+
+		movedStorage, err := NewLocalFS(moved)
+		require.NoError(t, err)
+
+		reader, err := movedStorage.OpenChunk(ctx, uri)
+		require.NoError(t, err)
+		defer reader.Close()
+
+		data, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, "chunk", string(data))
+	})
+}
+
+func Test_BuildFile(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	storage, err := NewLocalFS(dir)
+	require.NoError(t, err)
+
+	chunkPaths := []string{}
+	for i, data := range []string{"first ", "second ", "third"} {
+		path := filepath.Join(dir, "File1", fmt.Sprintf("%d", i))
+		require.NoError(t, EnsureDir(filepath.Dir(path)))
+		require.NoError(t, os.WriteFile(path, []byte(data), 0o644))
+
+		chunkPaths = append(chunkPaths, fmt.Sprintf("local://File1/%d", i))
+	}
+
+	chunks, err := storage.FetchChunks(ctx, chunkPaths)
+	require.NoError(t, err)
+
+	opened := 0
+	open := func(ctx context.Context, chunkPath string) (io.ReadCloser, error) {
+		opened += 1
+		return storage.OpenChunk(ctx, chunkPath)
+	}
+
+	t.Run("reads the chunks in order", func(t *testing.T) {
+		file, err := storage.BuildFile(ctx, chunks)
+		require.NoError(t, err)
+		defer file.Close()
+
+		data, err := io.ReadAll(file)
+		require.NoError(t, err)
+		require.Equal(t, "first second third", string(data))
+	})
+
+	t.Run("a range only opens the chunks it covers", func(t *testing.T) {
+		opened = 0
+		chain := NewChunkChain(ctx, chunks, open)
+		defer chain.Close()
+
+		require.Equal(t, int64(18), chain.Size())
+
+		_, err := chain.Seek(8, io.SeekStart)
+		require.NoError(t, err)
+
+		data := make([]byte, 4)
+		_, err = io.ReadFull(chain, data)
+		require.NoError(t, err)
+
+		require.Equal(t, "cond", string(data))
+		require.Equal(t, 1, opened)
+
+		_, err = chain.Seek(-3, io.SeekEnd)
+		require.NoError(t, err)
+
+		data, err = io.ReadAll(chain)
+		require.NoError(t, err)
+		require.Equal(t, "ird", string(data))
+	})
+
+	t.Run("a range across chunks", func(t *testing.T) {
+		chain := NewChunkChain(ctx, chunks, open)
+		defer chain.Close()
+
+		_, err := chain.Seek(4, io.SeekStart)
+		require.NoError(t, err)
+
+		data, err := io.ReadAll(io.LimitReader(chain, 12))
+		require.NoError(t, err)
+		require.Equal(t, "t second thi", string(data))
+	})
+
+	t.Run("a chunk shorter than recorded", func(t *testing.T) {
+		short := []*ChunkedFile{{chunkPath: chunkPaths[0], size: 10}}
+
+		chain := NewChunkChain(ctx, short, open)
+		defer chain.Close()
+
+		_, err := io.ReadAll(chain)
+		require.ErrorIs(t, err, ErrChunkTooShort)
+	})
+
+	t.Run("seek before the start", func(t *testing.T) {
+		chain := NewChunkChain(ctx, chunks, open)
+		defer chain.Close()
+
+		_, err := chain.Seek(-1, io.SeekStart)
+		require.ErrorIs(t, err, ErrInvalidSeek)
+	})
+}
@@ -1 +1,528 @@
 package blobstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/rs/zerolog/log"
+)
+
+// S3 keeps the chunks in a bucket of any S3 compatible store. The urls
+// it hands out are s3://bucket/key uris, and it only ever touches the
+// keys under its own bucket and prefix.
+
+const S3Scheme = BackendS3 + "://"
+
+var (
+	ErrMissingBucket = errors.New("missing_s3_bucket")
+	ErrInvalidURI    = errors.New("invalid_blob_uri")
+)
+
+const (
+	DefaultS3Region = "us-east-1"
+
+	// Chunks larger than a part are uploaded in parts. S3
+	// doesn't take parts smaller than 5MB, but the last one.
+	DefaultS3PartSize = manager.MinUploadPartSize
+
+	// Chunks looked up at once by FetchChunks
+	s3FetchConcurrency = 8
+)
+
+type S3Config struct {
+	Bucket string
+	Prefix string
+	Region string
+
+	// For minio and the like, it switches to path style urls
+	Endpoint string
+
+	// The default credential chain is used without them
+	AccessKey string
+	SecretKey string
+
+	PartSize int64
+}
+
+type S3 struct {
+	client   *s3.Client
+	uploader *manager.Uploader
+
+	bucket string
+	prefix string
+}
+
+func NewS3(cfg S3Config) (*S3, error) {
+	if cfg.Bucket == "" {
+		return nil, ErrMissingBucket
+	}
+
+	// Without keys, the credentials come from the environment, the shared
+	// config files or the instance role, like any other AWS client
+	loadOpts := []func(*awsconfig.LoadOptions) error{}
+
+	if cfg.Region != "" {
+		loadOpts = append(loadOpts, awsconfig.WithRegion(cfg.Region))
+	}
+
+	if cfg.AccessKey != "" {
+		loadOpts = append(loadOpts, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(cfg.AccessKey, cfg.SecretKey, ""),
+		))
+	}
+
+	awsCfg, err := awsconfig.LoadDefaultConfig(context.Background(), loadOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if awsCfg.Region == "" {
+		awsCfg.Region = DefaultS3Region
+	}
+
+	partSize := cfg.PartSize
+	if partSize < manager.MinUploadPartSize {
+		partSize = DefaultS3PartSize
+	}
+
+	client := s3.NewFromConfig(awsCfg, func(options *s3.Options) {
+		if cfg.Endpoint != "" {
+			options.BaseEndpoint = aws.String(cfg.Endpoint)
+			options.UsePathStyle = true
+		}
+	})
+	uploader := manager.NewUploader(client, func(u *manager.Uploader) {
+		u.PartSize = partSize
+	})
+
+	return &S3{
+		client:   client,
+		uploader: uploader,
+		bucket:   cfg.Bucket,
+		prefix:   strings.Trim(cfg.Prefix, "/"),
+	}, nil
+}
+
+func (slf *S3) key(parts ...string) string {
+	return path.Join(append([]string{slf.prefix}, parts...)...)
+}
+
+func (slf *S3) uri(key string) string {
+	return S3Scheme + slf.bucket + "/" + key
+}
+
+// keyOf is the key of an uri handed out by this store
+func (slf *S3) keyOf(uri string) (string, error) {
+	if !strings.HasPrefix(uri, S3Scheme) {
+		return "", ErrInvalidURI
+	}
+
+	bucket, key, ok := strings.Cut(strings.TrimPrefix(uri, S3Scheme), "/")
+	if !ok || key == "" {
+		return "", ErrInvalidURI
+	}
+
+	if bucket != slf.bucket || (slf.prefix != "" && !strings.HasPrefix(key, slf.prefix+"/")) {
+		return "", ErrOutsideStore
+	}
+
+	return key, nil
+}
+
+func isNotFound(err error) bool {
+	var notFound *types.NotFound
+	var noSuchKey *types.NoSuchKey
+
+	if errors.As(err, &notFound) || errors.As(err, &noSuchKey) {
+		return true
+	}
+
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "NotFound"
+}
+
+// checkDigest reads the chunk through sha256 before it is sent, an
+// object can't be taken back once uploaded, and a blob is reused by
+// every later chunk with its hash
+func checkDigest(chunk *ChunkedFile) error {
+	if chunk.digest == "" {
+		return nil
+	}
+
+	if _, err := chunk.data.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	hasher := sha256.New()
+
+	if _, err := io.Copy(hasher, chunk.data); err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(hasher.Sum(nil)) != chunk.digest {
+		return ErrDigestMismatch
+	}
+
+	return nil
+}
+
+func (slf *S3) put(ctx context.Context, key string, chunk *ChunkedFile) error {
+	if err := checkDigest(chunk); err != nil {
+		log.Error().Err(err).Str("key", key).Msg("chunk doesn't match its digest")
+		return err
+	}
+
+	if _, err := chunk.data.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	_, err := slf.uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(slf.bucket),
+		Key:    aws.String(key),
+		Body:   chunk.data,
+	})
+	if err != nil {
+		log.Error().Err(err).Str("key", key).Msg("failed to upload chunk")
+		return err
+	}
+
+	return nil
+}
+
+func (slf *S3) UpdateChunk(ctx context.Context, fileID string, chunk *ChunkedFile) (string, error) {
+	key := slf.key(fileID, fmt.Sprintf("%d", chunk.chunkID))
+
+	if err := slf.put(ctx, key, chunk); err != nil {
+		return "", err
+	}
+
+	log.Info().Str("key", key).Msg("uploaded chunk")
+
+	return slf.uri(key), nil
+}
+
+// StoreBlob stores the chunk by the sha256 of its content, under
+// blobs/<first two chars>/<hash>. When the blob is already there it is
+// copied onto itself instead, which restarts its grace period for the
+// garbage collector, like LocalFS does with the mtime.
+func (slf *S3) StoreBlob(ctx context.Context, hash string, chunk *ChunkedFile) (string, error) {
+	if !blobHashPattern.MatchString(hash) {
+		return "", ErrInvalidHash
+	}
+
+	key := slf.key(BlobsDir, hash[:2], hash)
+
+	_, err := slf.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(slf.bucket),
+		Key:    aws.String(key),
+	})
+
+	if err == nil {
+		slf.touch(ctx, key)
+		return slf.uri(key), nil
+	}
+
+	if !isNotFound(err) {
+		log.Error().Err(err).Str("key", key).Msg("failed to look up blob")
+		return "", err
+	}
+
+	// An object is only visible once the upload completes,
+	// so no one sees a half written blob
+	if err := slf.put(ctx, key, chunk); err != nil {
+		return "", err
+	}
+
+	log.Info().Str("key", key).Msg("uploaded blob")
+
+	return slf.uri(key), nil
+}
+
+func (slf *S3) touch(ctx context.Context, key string) {
+	_, err := slf.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(slf.bucket),
+		Key:               aws.String(key),
+		CopySource:        aws.String(slf.bucket + "/" + key),
+		MetadataDirective: types.MetadataDirectiveReplace,
+	})
+	if err != nil {
+		log.Error().Err(err).Str("key", key).Msg("failed to touch blob")
+	}
+}
+
+// BatchCreateChunk uploads the chunks concurrently, if any of them
+// fails the batch fails
+func (slf *S3) BatchCreateChunk(
+	ctx context.Context,
+	fileID string,
+	chunks []*ChunkedFile,
+) ([]*ChunkedFile, error) {
+
+	created := make([]*ChunkedFile, len(chunks))
+	errs := make([]error, len(chunks))
+
+	var wg sync.WaitGroup
+
+	for index, chunk := range chunks {
+		wg.Add(1)
+
+		go func(_chunk ChunkedFile, i int64) {
+			defer wg.Done()
+
+			uri, err := slf.UpdateChunk(ctx, fileID, &_chunk)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+
+			created[i] = &ChunkedFile{
+				chunkID:   _chunk.chunkID,
+				chunkPath: uri,
+				data:      _chunk.data,
+			}
+		}(*chunk, int64(index))
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrFileUpload, err)
+		}
+	}
+
+	return created, nil
+}
+
+// FetchChunks looks the chunks up with a HEAD each, a few at a time
+func (slf *S3) FetchChunks(ctx context.Context, chunkPaths []string) ([]*ChunkedFile, error) {
+	chunks := make([]*ChunkedFile, len(chunkPaths))
+	errs := make([]error, len(chunkPaths))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, s3FetchConcurrency)
+
+	for i, uri := range chunkPaths {
+		wg.Add(1)
+
+		go func(i int, uri string) {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			chunks[i], errs[i] = slf.head(ctx, uri)
+		}(i, uri)
+	}
+
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	for i := range chunks {
+		chunks[i].chunkID = int64(i)
+
+		if i+1 < len(chunks) {
+			chunks[i].next = chunks[i+1]
+		}
+	}
+
+	return chunks, nil
+}
+
+func (slf *S3) head(ctx context.Context, uri string) (*ChunkedFile, error) {
+	key, err := slf.keyOf(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := slf.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(slf.bucket),
+		Key:    aws.String(key),
+	})
+	if isNotFound(err) {
+		return nil, fmt.Errorf("%w: %s", ErrBlobNotFound, uri)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &ChunkedFile{
+		fileDir:   slf.uri(path.Dir(key)),
+		chunkPath: uri,
+		size:      aws.ToInt64(out.ContentLength),
+	}, nil
+}
+
+// BuildFile reads the chunks one after the other, as one file. A range
+// of the file only downloads the bytes of the chunks it covers.
+func (slf *S3) BuildFile(ctx context.Context, chunks []*ChunkedFile) (io.ReadSeekCloser, error) {
+	return NewChunkChain(ctx, chunks, slf.OpenChunk), nil
+}
+
+// OpenChunk doesn't send the GET until the first read, so a Seek
+// before it turns into a range request
+func (slf *S3) OpenChunk(ctx context.Context, chunkPath string) (io.ReadCloser, error) {
+	key, err := slf.keyOf(chunkPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Object{ctx: ctx, client: slf.client, bucket: slf.bucket, key: key}, nil
+}
+
+// ReplaceChunk uploads the chunk over the object, S3
+// only shows the new one once the upload completes
+func (slf *S3) ReplaceChunk(ctx context.Context, chunkPath string, chunk *ChunkedFile) error {
+	key, err := slf.keyOf(chunkPath)
+	if err != nil {
+		return err
+	}
+
+	return slf.put(ctx, key, chunk)
+}
+
+func (slf *S3) DeleteChunk(ctx context.Context, chunkPath string) error {
+	key, err := slf.keyOf(chunkPath)
+	if err != nil {
+		log.Error().Str("path", chunkPath).Msg("refusing to delete outside the store")
+		return err
+	}
+
+	// Deleting a missing key succeeds
+	_, err = slf.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(slf.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to delete chunk at " + chunkPath)
+		return err
+	}
+
+	return nil
+}
+
+// ListBlobs lists every key under the prefix, a page at a time
+func (slf *S3) ListBlobs(ctx context.Context, fn func(*BlobInfo) error) error {
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(slf.bucket)}
+	if slf.prefix != "" {
+		input.Prefix = aws.String(slf.prefix + "/")
+	}
+
+	pages := s3.NewListObjectsV2Paginator(slf.client, input)
+
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, object := range page.Contents {
+			err := fn(&BlobInfo{
+				Path:    slf.uri(aws.ToString(object.Key)),
+				Size:    aws.ToInt64(object.Size),
+				ModTime: aws.ToTime(object.LastModified),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+type s3Object struct {
+	ctx    context.Context
+	client *s3.Client
+	bucket string
+	key    string
+
+	offset int64
+	body   io.ReadCloser
+}
+
+func (slf *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += slf.offset
+	default:
+		// The size isn't known without a HEAD
+		return 0, ErrInvalidSeek
+	}
+
+	if offset < 0 {
+		return 0, ErrInvalidSeek
+	}
+
+	if offset != slf.offset {
+		slf.Close()
+		slf.offset = offset
+	}
+
+	return offset, nil
+}
+
+func (slf *s3Object) Read(p []byte) (int, error) {
+	if slf.body == nil {
+		input := &s3.GetObjectInput{
+			Bucket: aws.String(slf.bucket),
+			Key:    aws.String(slf.key),
+		}
+
+		if slf.offset > 0 {
+			input.Range = aws.String(fmt.Sprintf("bytes=%d-", slf.offset))
+		}
+
+		out, err := slf.client.GetObject(slf.ctx, input)
+		if isNotFound(err) {
+			return 0, fmt.Errorf("%w: %s", ErrBlobNotFound, slf.key)
+		}
+
+		var respErr interface{ HTTPStatusCode() int }
+		if errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusRequestedRangeNotSatisfiable {
+			return 0, io.EOF
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		slf.body = out.Body
+	}
+
+	n, err := slf.body.Read(p)
+	slf.offset += int64(n)
+
+	return n, err
+}
+
+func (slf *s3Object) Close() error {
+	if slf.body == nil {
+		return nil
+	}
+
+	err := slf.body.Close()
+	slf.body = nil
+
+	return err
+}
@@ -0,0 +1,479 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 is an in memory S3, with just enough of the api for the S3
+// store: objects, ranges, copies, multipart uploads and listing.
+type fakeS3 struct {
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+	uploads map[string]map[int][]byte
+
+	puts   int
+	parts  int
+	ranges []string
+
+	// Keys per page of a listing
+	pageSize int
+}
+
+type fakeObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newFakeS3(t *testing.T, bucket string) (*fakeS3, *httptest.Server) {
+	fake := &fakeS3{
+		bucket:   bucket,
+		objects:  map[string]*fakeObject{},
+		uploads:  map[string]map[int][]byte{},
+		pageSize: 1000,
+	}
+
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	return fake, server
+}
+
+func (slf *fakeS3) put(key string, data []byte, modTime time.Time) {
+	slf.mu.Lock()
+	defer slf.mu.Unlock()
+
+	slf.objects[key] = &fakeObject{data: data, modTime: modTime}
+}
+
+func (slf *fakeS3) get(key string) (*fakeObject, bool) {
+	slf.mu.Lock()
+	defer slf.mu.Unlock()
+
+	object, ok := slf.objects[key]
+	return object, ok
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+func (slf *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != slf.bucket {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	query := r.URL.Query()
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		slf.list(w, query.Get("prefix"), query.Get("continuation-token"))
+
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		slf.mu.Lock()
+		uploadID := strconv.Itoa(len(slf.uploads) + 1)
+		slf.uploads[uploadID] = map[int][]byte{}
+		slf.mu.Unlock()
+
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: uploadID})
+
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		data, _ := io.ReadAll(r.Body)
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+
+		slf.mu.Lock()
+		slf.uploads[query.Get("uploadId")][number] = data
+		slf.parts += 1
+		slf.mu.Unlock()
+
+		w.Header().Set("ETag", strconv.Quote(strconv.Itoa(number)))
+
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		slf.mu.Lock()
+		parts := slf.uploads[query.Get("uploadId")]
+		delete(slf.uploads, query.Get("uploadId"))
+		slf.mu.Unlock()
+
+		numbers := []int{}
+		for number := range parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+
+		var data bytes.Buffer
+		for _, number := range numbers {
+			data.Write(parts[number])
+		}
+
+		slf.put(key, data.Bytes(), time.Now())
+
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+		}{Bucket: bucket, Key: key})
+
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		slf.mu.Lock()
+		delete(slf.uploads, query.Get("uploadId"))
+		slf.mu.Unlock()
+
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		object, ok := slf.get(key)
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+
+		slf.put(key, object.data, time.Now())
+
+		writeXML(w, struct {
+			XMLName      xml.Name `xml:"CopyObjectResult"`
+			LastModified string
+		}{LastModified: time.Now().UTC().Format(time.RFC3339)})
+
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		slf.put(key, data, time.Now())
+
+		slf.mu.Lock()
+		slf.puts += 1
+		slf.mu.Unlock()
+
+	case r.Method == http.MethodDelete:
+		slf.mu.Lock()
+		delete(slf.objects, key)
+		slf.mu.Unlock()
+
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodHead, r.Method == http.MethodGet:
+		object, ok := slf.get(key)
+		if !ok && r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+
+		if ranged := r.Header.Get("Range"); ranged != "" {
+			slf.mu.Lock()
+			slf.ranges = append(slf.ranges, ranged)
+			slf.mu.Unlock()
+		}
+
+		http.ServeContent(w, r, key, object.modTime, bytes.NewReader(object.data))
+
+	default:
+		writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+type fakeListEntry struct {
+	Key          string
+	Size         int64
+	LastModified string
+}
+
+func (slf *fakeS3) list(w http.ResponseWriter, prefix string, after string) {
+	slf.mu.Lock()
+
+	keys := []string{}
+	for key := range slf.objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	truncated := len(keys) > slf.pageSize
+	if truncated {
+		keys = keys[:slf.pageSize]
+	}
+
+	contents := []fakeListEntry{}
+	for _, key := range keys {
+		contents = append(contents, fakeListEntry{
+			Key:          key,
+			Size:         int64(len(slf.objects[key].data)),
+			LastModified: slf.objects[key].modTime.UTC().Format(time.RFC3339),
+		})
+	}
+
+	slf.mu.Unlock()
+
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		Prefix                string
+		KeyCount              int
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []fakeListEntry
+	}{Name: slf.bucket, Prefix: prefix, KeyCount: len(contents), IsTruncated: truncated, Contents: contents}
+
+	if truncated {
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+
+	writeXML(w, result)
+}
+
+func newTestS3(t *testing.T, prefix string) (*S3, *fakeS3) {
+	fake, server := newFakeS3(t, "arbok")
+
+	storage, err := NewS3(S3Config{
+		Bucket:    "arbok",
+		Prefix:    prefix,
+		Endpoint:  server.URL,
+		AccessKey: "key",
+		SecretKey: "secret",
+	})
+	require.NoError(t, err)
+
+	return storage, fake
+}
+
+func Test_NewS3(t *testing.T) {
+	_, err := NewS3(S3Config{})
+	require.ErrorIs(t, err, ErrMissingBucket)
+}
+
+func Test_S3StoreBlob(t *testing.T) {
+	ctx := context.Background()
+	storage, fake := newTestS3(t, "store")
+
+	data := []byte("chunk of a file")
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	chunk := NewChunkedFile(NewBytesBlob(data), 0, nil)
+
+	uri, err := storage.StoreBlob(ctx, hash, chunk)
+	require.NoError(t, err)
+	require.Equal(t, "s3://arbok/store/blobs/"+hash[:2]+"/"+hash, uri)
+
+	object, ok := fake.get("store/blobs/" + hash[:2] + "/" + hash)
+	require.True(t, ok)
+	require.Equal(t, data, object.data)
+
+	t.Run("the same content is not uploaded again", func(t *testing.T) {
+		old := time.Now().Add(-48 * time.Hour)
+		fake.put("store/blobs/"+hash[:2]+"/"+hash, data, old)
+
+		again, err := storage.StoreBlob(ctx, hash, chunk)
+		require.NoError(t, err)
+		require.Equal(t, uri, again)
+		require.Equal(t, 1, fake.puts)
+
+		object, _ := fake.get("store/blobs/" + hash[:2] + "/" + hash)
+		require.True(t, object.modTime.After(old), "reuse restarts the grace period")
+	})
+
+	t.Run("invalid hash", func(t *testing.T) {
+		_, err := storage.StoreBlob(ctx, "../../etc", chunk)
+		require.ErrorIs(t, err, ErrInvalidHash)
+	})
+
+	t.Run("a chunk which doesn't match its digest isn't stored", func(t *testing.T) {
+		other := strings.Repeat("ab", 32)
+		truncated := NewChunkedFile(NewBytesBlob(data[:5]), 0, nil).WithDigest(other)
+
+		_, err := storage.StoreBlob(ctx, other, truncated)
+		require.ErrorIs(t, err, ErrDigestMismatch)
+
+		_, ok := fake.get("store/blobs/ab/" + other)
+		require.False(t, ok)
+	})
+}
+
+// unseekable fails to rewind, as a chunk read off a closed request would
+type unseekable struct {
+	io.ReadSeekCloser
+}
+
+var errSeek = errors.New("seek failed")
+
+func (unseekable) Seek(int64, int) (int64, error) {
+	return 0, errSeek
+}
+
+func Test_S3BatchCreateChunkFails(t *testing.T) {
+	ctx := context.Background()
+	storage, fake := newTestS3(t, "")
+
+	chunks := []*ChunkedFile{
+		NewChunkedFile(NewBytesBlob([]byte("first ")), 0, nil),
+		NewChunkedFile(unseekable{NewBytesBlob([]byte("second "))}, 1, nil),
+	}
+
+	_, err := storage.BatchCreateChunk(ctx, "File1", chunks)
+	require.ErrorIs(t, err, ErrFileUpload)
+	require.ErrorIs(t, err, errSeek)
+
+	_, ok := fake.get("File1/1")
+	require.False(t, ok, "nothing is sent for a chunk which can't be rewound")
+}
+
+func Test_S3Chunks(t *testing.T) {
+	ctx := context.Background()
+	storage, fake := newTestS3(t, "")
+
+	chunks := []*ChunkedFile{}
+	for i, data := range []string{"first ", "second ", "third"} {
+		chunks = append(chunks, NewChunkedFile(NewBytesBlob([]byte(data)), int64(i), nil))
+	}
+
+	created, err := storage.BatchCreateChunk(ctx, "File1", chunks)
+	require.NoError(t, err)
+	require.Len(t, created, 3)
+
+	chunkPaths := []string{}
+	for i, chunk := range created {
+		require.Equal(t, fmt.Sprintf("s3://arbok/File1/%d", i), chunk.Path())
+		chunkPaths = append(chunkPaths, chunk.Path())
+	}
+
+	fetched, err := storage.FetchChunks(ctx, chunkPaths)
+	require.NoError(t, err)
+	require.Equal(t, int64(7), fetched[1].Size())
+
+	t.Run("reads the chunks in order", func(t *testing.T) {
+		file, err := storage.BuildFile(ctx, fetched)
+		require.NoError(t, err)
+		defer file.Close()
+
+		data, err := io.ReadAll(file)
+		require.NoError(t, err)
+		require.Equal(t, "first second third", string(data))
+	})
+
+	t.Run("a range only downloads the bytes it covers", func(t *testing.T) {
+		fake.ranges = nil
+
+		file, err := storage.BuildFile(ctx, fetched)
+		require.NoError(t, err)
+		defer file.Close()
+
+		_, err = file.Seek(8, io.SeekStart)
+		require.NoError(t, err)
+
+		data := make([]byte, 4)
+		_, err = io.ReadFull(file, data)
+		require.NoError(t, err)
+
+		require.Equal(t, "cond", string(data))
+		require.Equal(t, []string{"bytes=2-"}, fake.ranges)
+	})
+
+	t.Run("missing chunk", func(t *testing.T) {
+		_, err := storage.FetchChunks(ctx, []string{chunkPaths[0], "s3://arbok/File1/9"})
+		require.ErrorIs(t, err, ErrBlobNotFound)
+	})
+
+	t.Run("uris of another store", func(t *testing.T) {
+		_, err := storage.FetchChunks(ctx, []string{"s3://other/File1/0"})
+		require.ErrorIs(t, err, ErrOutsideStore)
+
+		_, err = storage.OpenChunk(ctx, "/tmp/arbokdata/File1/0")
+		require.ErrorIs(t, err, ErrInvalidURI)
+
+		require.ErrorIs(t, storage.DeleteChunk(ctx, "s3://other/File1/0"), ErrOutsideStore)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		require.NoError(t, storage.DeleteChunk(ctx, chunkPaths[2]))
+
+		_, ok := fake.get("File1/2")
+		require.False(t, ok)
+
+		// Already gone
+		require.NoError(t, storage.DeleteChunk(ctx, chunkPaths[2]))
+	})
+}
+
+func Test_S3Multipart(t *testing.T) {
+	ctx := context.Background()
+	storage, fake := newTestS3(t, "")
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), (11<<20)/16)
+	chunk := NewChunkedFile(NewBytesBlob(data), 0, nil)
+
+	uri, err := storage.UpdateChunk(ctx, "Large", chunk)
+	require.NoError(t, err)
+
+	require.Equal(t, 0, fake.puts)
+	require.Equal(t, 3, fake.parts)
+
+	object, ok := fake.get("Large/0")
+	require.True(t, ok)
+	require.Equal(t, data, object.data)
+
+	fetched, err := storage.FetchChunks(ctx, []string{uri})
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), fetched[0].Size())
+}
+
+func Test_S3ListBlobs(t *testing.T) {
+	ctx := context.Background()
+	storage, fake := newTestS3(t, "store")
+	fake.pageSize = 2
+
+	now := time.Now().Truncate(time.Second)
+
+	fake.put("store/File1/0", []byte("aaa"), now)
+	fake.put("store/File1/1", []byte("bb"), now)
+	fake.put("store/blobs/ab/abcd", []byte("c"), now)
+	fake.put("other/File2/0", []byte("dddd"), now)
+
+	blobs := []*BlobInfo{}
+	err := storage.ListBlobs(ctx, func(blob *BlobInfo) error {
+		blobs = append(blobs, blob)
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Len(t, blobs, 3)
+	require.Equal(t, "s3://arbok/store/File1/0", blobs[0].Path)
+	require.Equal(t, int64(3), blobs[0].Size)
+	require.True(t, blobs[0].ModTime.Equal(now))
+	require.Equal(t, "s3://arbok/store/blobs/ab/abcd", blobs[2].Path)
+}
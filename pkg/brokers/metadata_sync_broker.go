@@ -38,8 +38,13 @@ func NewFileUpdateSyncBroker(
 	}
 }
 
+type DeviceLister interface {
+	ListDeviceIDs(ctx context.Context, userID string) ([]string, error)
+}
+
 type SSEConsumer struct {
-	Dst *SSEBroker
+	Dst     *SSEBroker
+	Devices DeviceLister
 }
 
 func (r *SSEConsumer) Execute(ctx context.Context, payloads []*queuer.Payload) error {
@@ -62,30 +67,26 @@ func (r *SSEConsumer) Execute(ctx context.Context, payloads []*queuer.Payload) e
 		fmt.Println("cache data, receiver")
 		utils.Dump(cachedData)
 
-		str := "fileID:" + cachedData.FileID
+		str := cachedData.Content()
 		fmt.Println(str)
 
-		// TODO: get all devices for user
-
-		r.Dst.SendMessage(ctx, Message{
-			UserID:   cachedData.UserID,
-			DeviceID: cachedData.DeviceID,
-			Content:  []byte(str),
-		})
+		deviceIDs, err := r.Devices.ListDeviceIDs(ctx, cachedData.UserID)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get devices for user")
+			return err
+		}
 
-		// Now I don't have multiple devices yet.
-		// So what I will do is, set another message.
+		for _, deviceID := range deviceIDs {
+			if !cachedData.ForDevice(deviceID) {
+				continue
+			}
 
-		anotherDevice := "2"
-		if cachedData.DeviceID == "2" {
-			anotherDevice = "1"
+			r.Dst.SendMessage(ctx, Message{
+				UserID:   cachedData.UserID,
+				DeviceID: deviceID,
+				Content:  []byte(str),
+			})
 		}
-
-		r.Dst.SendMessage(ctx, Message{
-			UserID:   cachedData.UserID,
-			DeviceID: anotherDevice,
-			Content:  []byte(str),
-		})
 	}
 
 	return nil
@@ -0,0 +1,103 @@
+package brokers
+
+import (
+	"arbokcore/core/notifiers"
+	"arbokcore/pkg/queuer"
+	"bytes"
+	"context"
+	"encoding/gob"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeDevices map[string][]string
+
+func (f fakeDevices) ListDeviceIDs(ctx context.Context, userID string) ([]string, error) {
+	return f[userID], nil
+}
+
+func Test_SSEConsumerFanOut(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := NewSSEBroker("test_fanout")
+	broker.Start(ctx)
+
+	origin := broker.Subscribe(ctx, "user1_laptop")
+	phone := broker.Subscribe(ctx, "user1_phone")
+	tablet := broker.Subscribe(ctx, "user1_tablet")
+
+	consumer := &SSEConsumer{
+		Dst:     broker,
+		Devices: fakeDevices{"user1": {"laptop", "phone", "tablet"}},
+	}
+
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(&notifiers.MetadataUpdateStatusEvent{
+		FileID:   "F1",
+		UserID:   "user1",
+		DeviceID: "laptop",
+	})
+	require.NoError(t, err)
+
+	err = consumer.Execute(ctx, []*queuer.Payload{{Message: buf.Bytes()}})
+	require.NoError(t, err)
+
+	for _, receiver := range []chan *Message{phone, tablet} {
+		select {
+		case msg := <-receiver:
+			require.Equal(t, "fileID:F1", string(msg.Content))
+		case <-time.After(2 * time.Second):
+			t.Fatal("device did not receive the update")
+		}
+	}
+
+	select {
+	case <-origin:
+		t.Fatal("originating device should not be notified")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func Test_SSEConsumerFailedUpload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := NewSSEBroker("test_failed")
+	broker.Start(ctx)
+
+	origin := broker.Subscribe(ctx, "user1_laptop")
+	phone := broker.Subscribe(ctx, "user1_phone")
+
+	consumer := &SSEConsumer{
+		Dst:     broker,
+		Devices: fakeDevices{"user1": {"laptop", "phone"}},
+	}
+
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(&notifiers.MetadataUpdateStatusEvent{
+		FileID:   "F1",
+		UserID:   "user1",
+		DeviceID: "laptop",
+		Action:   notifiers.ActionFailed,
+	})
+	require.NoError(t, err)
+
+	err = consumer.Execute(ctx, []*queuer.Payload{{Message: buf.Bytes()}})
+	require.NoError(t, err)
+
+	select {
+	case msg := <-origin:
+		require.Equal(t, "failed:F1", string(msg.Content))
+	case <-time.After(2 * time.Second):
+		t.Fatal("uploading device did not receive the failure")
+	}
+
+	select {
+	case <-phone:
+		t.Fatal("other devices should not be notified")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,196 @@
+package chunker
+
+import (
+	"errors"
+	"io"
+	"math/bits"
+)
+
+// Content defined chunking, FastCDC style. A gear rolling hash runs over
+// the bytes and a chunk ends where the hash matches a mask, so an insert
+// at the start of a file only moves the boundaries around it and the
+// rest of the chunks keep their content and hashes.
+//
+// The boundaries are normalized around the average size, a stricter mask
+// is used before the average and a looser one after it.
+//
+// Clients and the server must agree on the gear table and the options,
+// any change to either changes every chunk of every file.
+
+type Options struct {
+	MinSize int
+	AvgSize int
+	MaxSize int
+}
+
+var DefaultOptions = Options{
+	MinSize: 1 * 1024 * 1024,
+	AvgSize: 4 * 1024 * 1024,
+	MaxSize: 16 * 1024 * 1024,
+}
+
+var ErrInvalidOptions = errors.New("invalid_chunker_options")
+
+func (opts Options) Validate() error {
+	if opts.MinSize <= 0 || opts.MinSize > opts.AvgSize || opts.AvgSize > opts.MaxSize {
+		return ErrInvalidOptions
+	}
+
+	// The masks are derived from the average size
+	if opts.AvgSize&(opts.AvgSize-1) != 0 || opts.AvgSize < 64 {
+		return ErrInvalidOptions
+	}
+
+	return nil
+}
+
+// Masks on the high bits, those depend on the last 64 bytes seen
+func (opts Options) masks() (small, large uint64) {
+	avgBits := bits.Len(uint(opts.AvgSize)) - 1
+
+	return highBits(avgBits + 2), highBits(avgBits - 2)
+}
+
+func highBits(n int) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+var gear = buildGear()
+
+// buildGear fills the table with splitmix64 from a fixed seed, so
+// that every client can rebuild the same table
+func buildGear() [256]uint64 {
+	table := [256]uint64{}
+	state := uint64(0x6172626f6b636463)
+
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+
+	return table
+}
+
+// Boundary returns the length of the first chunk of the data. The data is
+// expected to hold at least MaxSize bytes, unless it is the end of the file.
+func Boundary(data []byte, opts Options) int {
+	n := len(data)
+	if n <= opts.MinSize {
+		return n
+	}
+
+	if n > opts.MaxSize {
+		n = opts.MaxSize
+	}
+
+	normal := opts.AvgSize
+	if normal > n {
+		normal = n
+	}
+
+	maskSmall, maskLarge := opts.masks()
+
+	var fingerprint uint64
+	i := opts.MinSize
+
+	for ; i < normal; i++ {
+		fingerprint = (fingerprint << 1) + gear[data[i]]
+		if fingerprint&maskSmall == 0 {
+			return i + 1
+		}
+	}
+
+	for ; i < n; i++ {
+		fingerprint = (fingerprint << 1) + gear[data[i]]
+		if fingerprint&maskLarge == 0 {
+			return i + 1
+		}
+	}
+
+	return n
+}
+
+type Chunk struct {
+	Offset int64
+	Length int
+	// Only valid until the next call to Next
+	Data []byte
+}
+
+type Chunker struct {
+	reader io.Reader
+	opts   Options
+
+	buf    []byte
+	start  int
+	end    int
+	offset int64
+	eof    bool
+}
+
+func New(reader io.Reader, opts Options) (*Chunker, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &Chunker{
+		reader: reader,
+		opts:   opts,
+		buf:    make([]byte, 2*opts.MaxSize),
+	}, nil
+}
+
+// fill keeps at least MaxSize bytes buffered, until the reader runs out
+func (slf *Chunker) fill() error {
+	if slf.eof || slf.end-slf.start >= slf.opts.MaxSize {
+		return nil
+	}
+
+	copy(slf.buf, slf.buf[slf.start:slf.end])
+	slf.end -= slf.start
+	slf.start = 0
+
+	for slf.end < slf.opts.MaxSize {
+		n, err := slf.reader.Read(slf.buf[slf.end:])
+		slf.end += n
+
+		if errors.Is(err, io.EOF) {
+			slf.eof = true
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Next returns the next chunk of the reader, and io.EOF after the last one
+func (slf *Chunker) Next() (*Chunk, error) {
+	if err := slf.fill(); err != nil {
+		return nil, err
+	}
+
+	if slf.start == slf.end {
+		return nil, io.EOF
+	}
+
+	length := Boundary(slf.buf[slf.start:slf.end], slf.opts)
+
+	chunk := &Chunk{
+		Offset: slf.offset,
+		Length: length,
+		Data:   slf.buf[slf.start : slf.start+length],
+	}
+
+	slf.start += length
+	slf.offset += int64(length)
+
+	return chunk, nil
+}
@@ -0,0 +1,108 @@
+package chunker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testOpts = Options{MinSize: 256, AvgSize: 1024, MaxSize: 4096}
+
+func chunkAll(t *testing.T, data []byte, opts Options) []*Chunk {
+	t.Helper()
+
+	chunker, err := New(bytes.NewReader(data), opts)
+	require.NoError(t, err)
+
+	chunks := []*Chunk{}
+
+	for {
+		chunk, err := chunker.Next()
+		if errors.Is(err, io.EOF) {
+			return chunks
+		}
+
+		require.NoError(t, err)
+
+		chunk.Data = bytes.Clone(chunk.Data)
+		chunks = append(chunks, chunk)
+	}
+}
+
+func hashes(chunks []*Chunk) map[[32]byte]bool {
+	seen := map[[32]byte]bool{}
+
+	for _, chunk := range chunks {
+		seen[sha256.Sum256(chunk.Data)] = true
+	}
+
+	return seen
+}
+
+func Test_Chunker(t *testing.T) {
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(42)).Read(data)
+
+	t.Run("chunks cover the data within the size bounds", func(t *testing.T) {
+		chunks := chunkAll(t, data, testOpts)
+
+		var assembled bytes.Buffer
+		for i, chunk := range chunks {
+			require.Equal(t, int64(assembled.Len()), chunk.Offset)
+			require.LessOrEqual(t, chunk.Length, testOpts.MaxSize)
+
+			if i < len(chunks)-1 {
+				require.GreaterOrEqual(t, chunk.Length, testOpts.MinSize)
+			}
+
+			assembled.Write(chunk.Data)
+		}
+
+		require.Equal(t, data, assembled.Bytes())
+	})
+
+	t.Run("same data gives same chunks", func(t *testing.T) {
+		require.Equal(t, chunkAll(t, data, testOpts), chunkAll(t, data, testOpts))
+	})
+
+	t.Run("an insert at the start only changes the chunks around it", func(t *testing.T) {
+		before := chunkAll(t, data, testOpts)
+		after := chunkAll(t, append([]byte("one more line\n"), data...), testOpts)
+
+		seen := hashes(before)
+		changed := 0
+
+		for _, chunk := range after {
+			if !seen[sha256.Sum256(chunk.Data)] {
+				changed += 1
+			}
+		}
+
+		require.LessOrEqual(t, changed, 2)
+	})
+
+	t.Run("empty reader", func(t *testing.T) {
+		require.Empty(t, chunkAll(t, nil, testOpts))
+	})
+
+	t.Run("small file is one chunk", func(t *testing.T) {
+		chunks := chunkAll(t, data[:100], testOpts)
+
+		require.Len(t, chunks, 1)
+		require.Equal(t, 100, chunks[0].Length)
+	})
+}
+
+func Test_OptionsValidate(t *testing.T) {
+	require.NoError(t, DefaultOptions.Validate())
+	require.NoError(t, testOpts.Validate())
+
+	require.ErrorIs(t, Options{MinSize: 0, AvgSize: 1024, MaxSize: 4096}.Validate(), ErrInvalidOptions)
+	require.ErrorIs(t, Options{MinSize: 2048, AvgSize: 1024, MaxSize: 4096}.Validate(), ErrInvalidOptions)
+	require.ErrorIs(t, Options{MinSize: 256, AvgSize: 1000, MaxSize: 4096}.Validate(), ErrInvalidOptions)
+}
@@ -2,6 +2,8 @@ package config
 
 import (
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/go-batteries/diaper"
 	"github.com/rs/zerolog/log"
@@ -13,8 +15,58 @@ type AppConfig struct {
 	Dsn         string
 	DbName      string
 	RedisURL    string
+
+	// Only honored in the dev environment. Lets the stub
+	// tokens in core/tokens/stubs.go authorize requests.
+	AuthTestMode bool
+
+	// Where the blobs are kept, "local" under BlobDir or "s3"
+	BlobBackend string
+	BlobDir     string
+
+	// Endpoint is only set for S3 compatible stores like minio
+	S3Bucket    string
+	S3Prefix    string
+	S3Region    string
+	S3Endpoint  string
+	S3AccessKey string
+	S3SecretKey string
+
+	// How long trashed files are kept before they are purged
+	TrashRetention time.Duration
+
+	// Unreferenced blobs younger than this are kept by the garbage
+	// collector, in a dry run it only reports what it would delete
+	BlobGCGrace  time.Duration
+	BlobGCDryRun bool
+
+	// Chunks are encrypted with the master key of BlobKeyID when it is
+	// set. BlobMasterKeys lists every master key, "<id>:<base64 key>,..",
+	// the older ones stay until the chunks are rewrapped.
+	BlobKeyID      string
+	BlobMasterKeys string
+
+	// Codecs tried on every chunk, "zstd,gzip", the smallest result is
+	// kept. Chunks aren't compressed when it is empty.
+	BlobCompression string
+
+	// Key for the signed chunk urls of download manifests. Every
+	// server has to share it, for a url to work on any of them.
+	BlobURLSecret string
+
+	// Deprecated: lets file downloads take the access token from the url,
+	// where it leaks to logs and history. Off unless set, clients use
+	// the signed chunk urls of manifests instead.
+	URLTokenDownloads bool
 }
 
+const (
+	DefaultBlobBackend        = "local"
+	DefaultBlobDir            = "./tmp/arbokdata"
+	DefaultTrashRetentionDays = 30
+	DefaultBlobGCGraceHours   = 24
+)
+
 func Load(envFile string) AppConfig {
 	providers := diaper.BuildProviders(diaper.EnvProvider{})
 	loader := diaper.DiaperConfig{
@@ -32,11 +84,83 @@ func Load(envFile string) AppConfig {
 		log.Fatal().Err(err).Msg("failed to load config from " + envFile)
 	}
 
+	authTestMode := env == "dev" && getBool(cfgMap, "auth_test_mode")
+
 	return AppConfig{
-		Environment: env,
-		ServerID:    cfgMap.MustGet("server_id").(string),
-		Dsn:         cfgMap.MustGet("dsn").(string),
-		DbName:      cfgMap.MustGet("db_name").(string),
-		RedisURL:    cfgMap.MustGet("redis_url").(string),
+		Environment:  env,
+		ServerID:     cfgMap.MustGet("server_id").(string),
+		Dsn:          cfgMap.MustGet("dsn").(string),
+		DbName:       cfgMap.MustGet("db_name").(string),
+		RedisURL:     cfgMap.MustGet("redis_url").(string),
+		AuthTestMode: authTestMode,
+
+		BlobBackend:    getString(cfgMap, "blob_backend", DefaultBlobBackend),
+		BlobDir:        getString(cfgMap, "blob_dir", DefaultBlobDir),
+		TrashRetention: getDays(cfgMap, "trash_retention_days", DefaultTrashRetentionDays),
+		BlobGCGrace:    getHours(cfgMap, "blob_gc_grace_hours", DefaultBlobGCGraceHours),
+		BlobGCDryRun:   getBool(cfgMap, "blob_gc_dry_run"),
+		BlobURLSecret:  getString(cfgMap, "blob_url_secret", ""),
+		BlobKeyID:      getString(cfgMap, "blob_key_id", ""),
+		BlobMasterKeys: getString(cfgMap, "blob_master_keys", ""),
+
+		BlobCompression: getString(cfgMap, "blob_compression", ""),
+
+		URLTokenDownloads: getBool(cfgMap, "url_token_downloads"),
+
+		S3Bucket:    getString(cfgMap, "s3_bucket", ""),
+		S3Prefix:    getString(cfgMap, "s3_prefix", ""),
+		S3Region:    getString(cfgMap, "s3_region", ""),
+		S3Endpoint:  getString(cfgMap, "s3_endpoint", ""),
+		S3AccessKey: getString(cfgMap, "s3_access_key", ""),
+		S3SecretKey: getString(cfgMap, "s3_secret_key", ""),
+	}
+}
+
+func getString(cfgMap diaper.ConfigMap, key string, fallback string) string {
+	value, ok := cfgMap.Get(key)
+	if !ok {
+		return fallback
+	}
+
+	v, ok := value.(string)
+	if !ok || v == "" {
+		return fallback
+	}
+
+	return v
+}
+
+func getDays(cfgMap diaper.ConfigMap, key string, fallback int) time.Duration {
+	days, err := strconv.Atoi(getString(cfgMap, key, ""))
+	if err != nil || days <= 0 {
+		days = fallback
+	}
+
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func getHours(cfgMap diaper.ConfigMap, key string, fallback int) time.Duration {
+	hours, err := strconv.Atoi(getString(cfgMap, key, ""))
+	if err != nil || hours <= 0 {
+		hours = fallback
 	}
+
+	return time.Duration(hours) * time.Hour
+}
+
+func getBool(cfgMap diaper.ConfigMap, key string) bool {
+	value, ok := cfgMap.Get(key)
+	if !ok {
+		return false
+	}
+
+	switch v := value.(type) {
+	case bool:
+		return v
+	case string:
+		b, err := strconv.ParseBool(v)
+		return err == nil && b
+	}
+
+	return false
 }
@@ -11,7 +11,7 @@ import (
 func Test_QueryStoreLoadAll(t *testing.T) {
 	cfg := LoadAll("../../config/querystore.yaml")
 
-	require.Equal(t, len(cfg), 3)
+	require.Equal(t, len(cfg), 7)
 }
 
 func Test_HydrateQueryStore(t *testing.T) {
@@ -0,0 +1,80 @@
+package urlsigner
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Signed urls let a client fetch a resource without its token. The path and
+// the expiry are signed with HMAC-SHA256, so neither can be changed without
+// the key, and the url stops working once it expires.
+
+const (
+	ExpiresParam   = "expires"
+	SignatureParam = "signature"
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid_signature")
+	ErrExpired          = errors.New("signature_expired")
+)
+
+type Signer struct {
+	key []byte
+	now func() time.Time
+}
+
+func New(key []byte) *Signer {
+	return &Signer{key: key, now: time.Now}
+}
+
+func (slf *Signer) signature(path string, expires int64) string {
+	mac := hmac.New(sha256.New, slf.key)
+	mac.Write([]byte(path))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(strconv.FormatInt(expires, 10)))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign returns the path with the expiry and the signature as query params
+func (slf *Signer) Sign(path string, ttl time.Duration) (string, time.Time) {
+	expiresAt := slf.now().Add(ttl).Truncate(time.Second)
+	expires := expiresAt.Unix()
+
+	query := url.Values{}
+	query.Set(ExpiresParam, strconv.FormatInt(expires, 10))
+	query.Set(SignatureParam, slf.signature(path, expires))
+
+	return path + "?" + query.Encode(), expiresAt
+}
+
+// Verify checks the signature of the path, with the
+// expiry and signature from the query of the signed url
+func (slf *Signer) Verify(path string, query url.Values) error {
+	expires, err := strconv.ParseInt(query.Get(ExpiresParam), 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	signature, err := hex.DecodeString(query.Get(SignatureParam))
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	expected, _ := hex.DecodeString(slf.signature(path, expires))
+	if !hmac.Equal(signature, expected) {
+		return ErrInvalidSignature
+	}
+
+	if slf.now().Unix() > expires {
+		return ErrExpired
+	}
+
+	return nil
+}
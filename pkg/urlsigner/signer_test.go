@@ -0,0 +1,69 @@
+package urlsigner
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func splitSigned(t *testing.T, signed string) (string, url.Values) {
+	t.Helper()
+
+	path, rawQuery, ok := strings.Cut(signed, "?")
+	require.True(t, ok)
+
+	query, err := url.ParseQuery(rawQuery)
+	require.NoError(t, err)
+
+	return path, query
+}
+
+func Test_Signer(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	signer := New([]byte("secret"))
+	signer.now = func() time.Time { return now }
+
+	signed, expiresAt := signer.Sign("/blobs/chunks/F1/0", time.Minute)
+	require.Equal(t, now.Add(time.Minute), expiresAt)
+
+	path, query := splitSigned(t, signed)
+	require.Equal(t, "/blobs/chunks/F1/0", path)
+
+	t.Run("valid signature", func(t *testing.T) {
+		require.NoError(t, signer.Verify(path, query))
+	})
+
+	t.Run("another path", func(t *testing.T) {
+		require.ErrorIs(t, signer.Verify("/blobs/chunks/F1/1", query), ErrInvalidSignature)
+	})
+
+	t.Run("changed expiry", func(t *testing.T) {
+		changed := url.Values{}
+		changed.Set(ExpiresParam, "1900000000")
+		changed.Set(SignatureParam, query.Get(SignatureParam))
+
+		require.ErrorIs(t, signer.Verify(path, changed), ErrInvalidSignature)
+	})
+
+	t.Run("another key", func(t *testing.T) {
+		other := New([]byte("other"))
+		other.now = signer.now
+
+		require.ErrorIs(t, other.Verify(path, query), ErrInvalidSignature)
+	})
+
+	t.Run("missing params", func(t *testing.T) {
+		require.ErrorIs(t, signer.Verify(path, url.Values{}), ErrInvalidSignature)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		later := New([]byte("secret"))
+		later.now = func() time.Time { return now.Add(2 * time.Minute) }
+
+		require.ErrorIs(t, later.Verify(path, query), ErrExpired)
+	})
+}
@@ -2,6 +2,7 @@ package middlewares
 
 import (
 	"arbokcore/core/tokens"
+	"context"
 	"fmt"
 	"net/http"
 	"strings"
@@ -21,11 +22,18 @@ const (
 )
 
 type AuthMidllewareService struct {
-	repo tokens.Repository
+	repo     tokens.Repository
+	testMode bool
 }
 
-func NewAuthMiddleWareService(repo tokens.Repository) *AuthMidllewareService {
-	return &AuthMidllewareService{repo: repo}
+// testMode lets the stub tokens through, it should only
+// ever be enabled for local development.
+func NewAuthMiddleWareService(repo tokens.Repository, testMode bool) *AuthMidllewareService {
+	if testMode {
+		log.Warn().Msg("auth middleware running in test mode")
+	}
+
+	return &AuthMidllewareService{repo: repo, testMode: testMode}
 }
 
 func getBearerToken(token string) (string, bool) {
@@ -61,12 +69,7 @@ func (slf *AuthMidllewareService) ValidateAccessToken(next echo.HandlerFunc) ech
 
 		ctx := c.Request().Context()
 
-		token, err := slf.repo.FindByAccessToken(ctx, tokens.FindByClause{
-			ResourceType: "user",
-			AccessToken:  accessToken,
-			TestMode:     true,
-		})
-
+		token, err := slf.findUserToken(ctx, accessToken)
 		if err != nil {
 			log.Error().Err(err).Msg("failed to validate access token")
 			return c.NoContent(http.StatusUnauthorized)
@@ -81,23 +84,41 @@ func (slf *AuthMidllewareService) ValidateAccessToken(next echo.HandlerFunc) ech
 	}
 }
 
+func (slf *AuthMidllewareService) findUserToken(ctx context.Context, accessToken string) (*tokens.Token, error) {
+	return slf.repo.FindByAccessToken(ctx, tokens.FindByClause{
+		ResourceType: tokens.ResourceTypeUser,
+		AccessToken:  accessToken,
+		TestMode:     slf.testMode,
+	})
+}
+
 // TODO: this is to be used only for download tokens
 const (
 	DownloadTokenHeaderAuthKey = StreamTokenHeaderKey
 	DownloadTokenHeader        = "Bearer %s"
 )
 
+// AddTokenFromUrlToHeader lets a download link carry its tokens in the
+// url, as X-Sig-Token=<stream token>:<access token>. Links without it
+// are left to the headers.
+//
+// Deprecated: the access token leaks with the url. Only mounted while
+// url_token_downloads is set, clients use the signed chunk urls of
+// manifests instead.
 func (slf *AuthMidllewareService) AddTokenFromUrlToHeader(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		downloadSignatureToken := c.QueryParam("X-Sig-Token")
 
-		fmt.Println(downloadSignatureToken)
 		splits := strings.Split(downloadSignatureToken, ":")
+		if downloadSignatureToken != "" && len(splits) == 2 {
+			c.Response().Header().Set("Deprecation", "true")
+			c.Response().Header().Set("Link", fmt.Sprintf(
+				"</my/files/%s/manifest>; rel=\"alternate\"", c.Param("fileID"),
+			))
 
-		toBearerToken := fmt.Sprintf(DownloadTokenHeader, splits[0])
-		toBearerAccessToken := fmt.Sprintf(DownloadTokenHeader, splits[1])
+			toBearerToken := fmt.Sprintf(DownloadTokenHeader, splits[0])
+			toBearerAccessToken := fmt.Sprintf(DownloadTokenHeader, splits[1])
 
-		if downloadSignatureToken != "" {
 			c.Request().Header.Add(AccessTokenHeaderKey, toBearerAccessToken)
 			c.Request().Header.Add(DownloadTokenHeaderAuthKey, toBearerToken)
 		}
@@ -140,26 +161,27 @@ func (slf *AuthMidllewareService) ValidateStreamToken(next echo.HandlerFunc) ech
 
 		ctx := c.Request().Context()
 
-		deviceID := "1"
-		if accessToken == tokens.AnotherToken.AccessToken {
-			deviceID = "2"
+		userToken, err := slf.findUserToken(ctx, accessToken)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to validate access token for stream")
+			return c.NoContent(http.StatusUnauthorized)
 		}
 
 		token, err := slf.repo.FindByStreamToken(ctx, tokens.FindByClause{
-			ResourceType: "stream",
+			ResourceType: tokens.ResourceTypeStream,
 			ResourceID:   fileID,
 			AccessToken:  accessToken,
-			TestMode:     true,
 			StreamToken:  streamToken,
-			UserID:       &tokens.AdminToken.ResourceID, // TODO: get userID from access token
+			UserID:       &userToken.ResourceID,
 		})
 		if err != nil {
 			log.Error().Err(err).Msg("failed to validate stream token")
 			return c.NoContent(http.StatusUnauthorized)
 		}
 
-		//TODO: remove
-		token.DeviceID = deviceID
+		// The stream token is bound to the file, the device
+		// is whichever device the user session belongs to
+		token.DeviceID = userToken.DeviceID
 
 		c.Set(TokenContextKey, token)
 
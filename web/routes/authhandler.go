@@ -0,0 +1,133 @@
+package routes
+
+import (
+	"arbokcore/core/api"
+	"arbokcore/core/tokens"
+	"arbokcore/core/users"
+	"arbokcore/web/middlewares"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+type AuthHandler struct {
+	UserSvc users.Service
+}
+
+const (
+	RouteSignup  = "/auth/signup"
+	RouteLogin   = "/auth/login"
+	RouteRefresh = "/auth/refresh"
+	RouteLogout  = "/auth/logout"
+)
+
+const (
+	MinPasswordLen = 8
+	// bcrypt only looks at the first 72 bytes
+	MaxPasswordLen = 72
+	MaxEmailLen    = 320
+)
+
+func validateAuthRequest(req *api.AuthRequest) bool {
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+
+	if req.Email == "" || len(req.Email) > MaxEmailLen {
+		return false
+	}
+
+	if !strings.Contains(req.Email, "@") {
+		return false
+	}
+
+	return len(req.Password) >= MinPasswordLen && len(req.Password) <= MaxPasswordLen
+}
+
+func (handler *AuthHandler) Signup(c echo.Context) error {
+	req := &api.AuthRequest{}
+
+	if err := c.Bind(req); err != nil {
+		log.Error().Err(err).Msg("bad request")
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	if !validateAuthRequest(req) {
+		log.Error().Msg("invalid signup request")
+		return c.NoContent(http.StatusUnprocessableEntity)
+	}
+
+	ctx := c.Request().Context()
+
+	session, err := handler.UserSvc.Create(ctx, req.Email, req.Password)
+	resp := api.BuildResponse(err, session)
+	if err != nil {
+		return c.JSON(resp.Error.HttpStatus, resp)
+	}
+
+	return c.JSON(http.StatusCreated, resp)
+}
+
+func (handler *AuthHandler) Login(c echo.Context) error {
+	req := &api.AuthRequest{}
+
+	if err := c.Bind(req); err != nil {
+		log.Error().Err(err).Msg("bad request")
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	if !validateAuthRequest(req) {
+		return c.NoContent(http.StatusUnauthorized)
+	}
+
+	ctx := c.Request().Context()
+
+	session, err := handler.UserSvc.Login(ctx, req.Email, req.Password, req.DeviceID)
+	resp := api.BuildResponse(err, session)
+	if err != nil {
+		return c.JSON(resp.Error.HttpStatus, resp)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (handler *AuthHandler) Refresh(c echo.Context) error {
+	req := &api.RefreshRequest{}
+
+	if err := c.Bind(req); err != nil {
+		log.Error().Err(err).Msg("bad request")
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	if req.RefreshToken == "" {
+		return c.NoContent(http.StatusUnauthorized)
+	}
+
+	ctx := c.Request().Context()
+
+	session, err := handler.UserSvc.Refresh(ctx, req.RefreshToken)
+	resp := api.BuildResponse(err, session)
+	if err != nil {
+		return c.JSON(resp.Error.HttpStatus, resp)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (handler *AuthHandler) Logout(c echo.Context) error {
+	token, ok := c.Get(middlewares.TokenContextKey).(*tokens.Token)
+	if !ok {
+		log.Error().Msg("current token is not set")
+		return c.NoContent(http.StatusUnauthorized)
+	}
+
+	ctx := c.Request().Context()
+
+	err := handler.UserSvc.Logout(ctx, token)
+	if err != nil {
+		resp := api.BuildResponse(err, nil)
+		return c.JSON(resp.Error.HttpStatus, resp)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -5,6 +5,7 @@ import (
 	"arbokcore/core/files"
 	"arbokcore/core/tokens"
 	"arbokcore/web/middlewares"
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -14,10 +15,12 @@ import (
 
 type ChunkHandler struct {
 	ChunkSvc *files.FileChunkService
+	Uploads  *files.UploadService
 }
 
 const (
-	RouteChunkUpdate = "/my/files/:fileID/chunks"
+	RouteChunkUpdate  = "/my/files/:fileID/chunks"
+	RouteUploadStatus = "/my/files/:fileID/upload"
 )
 
 func (handler *ChunkHandler) UpsertChunks(c echo.Context) error {
@@ -42,21 +45,28 @@ func (handler *ChunkHandler) UpsertChunks(c echo.Context) error {
 	}
 
 	fh, err := c.FormFile("data")
-	if err != nil {
+
+	switch {
+	// A content defined chunk the previous version already has
+	case errors.Is(err, http.ErrMissingFile):
+
+	case err != nil:
 		log.Error().Err(err).Msg("failed to read chunk from form")
 		return c.NoContent(http.StatusBadRequest)
-	}
 
-	file, err := fh.Open()
-	if err != nil {
-		log.Error().Err(err).Msg("failed to open file chunk")
-		return c.NoContent(http.StatusInternalServerError)
-	}
-	defer file.Close()
+	default:
+		file, err := fh.Open()
+		if err != nil {
+			log.Error().Err(err).Msg("failed to open file chunk")
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		defer file.Close()
+
+		fmt.Printf("chunk %+v, size %d\n", req, fh.Size)
 
-	fmt.Printf("chunk %+v, size %d\n", req, fh.Size)
+		req.Data = file
+	}
 
-	req.Data = file
 	req.FileID = token.ResourceID
 	req.UserID = *token.UserID
 
@@ -70,3 +80,61 @@ func (handler *ChunkHandler) UpsertChunks(c echo.Context) error {
 
 	return c.JSON(resp.Error.HttpStatus, resp)
 }
+
+// UploadStatus tells the client which chunks it still
+// has to send, to resume an interrupted upload
+func (handler *ChunkHandler) UploadStatus(c echo.Context) error {
+	token, ok := c.Get(middlewares.TokenContextKey).(*tokens.Token)
+	if !ok {
+		log.Error().Msg("current token is not set")
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	if token.ResourceID != c.Param("fileID") {
+		log.Error().
+			Str("resource_id", token.ResourceID).
+			Str("fileID", c.Param("fileID")).
+			Msg("fileID for the stream token invalid")
+
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	ctx := c.Request().Context()
+
+	progress, err := handler.Uploads.Progress(ctx, token.ResourceID)
+	resp := api.BuildResponse(err, progress)
+	if err != nil {
+		return c.JSON(resp.Error.HttpStatus, resp)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+// AbortUpload gives up on an upload in progress, the chunks
+// sent so far are discarded and the stream token is revoked
+func (handler *ChunkHandler) AbortUpload(c echo.Context) error {
+	token, ok := c.Get(middlewares.TokenContextKey).(*tokens.Token)
+	if !ok {
+		log.Error().Msg("current token is not set")
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	if token.ResourceID != c.Param("fileID") {
+		log.Error().
+			Str("resource_id", token.ResourceID).
+			Str("fileID", c.Param("fileID")).
+			Msg("fileID for the stream token invalid")
+
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	ctx := c.Request().Context()
+
+	err := handler.Uploads.Abort(ctx, token.ResourceID)
+	if err != nil {
+		resp := api.BuildResponse(err, nil)
+		return c.JSON(resp.Error.HttpStatus, resp)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
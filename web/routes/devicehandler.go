@@ -0,0 +1,100 @@
+package routes
+
+import (
+	"arbokcore/core/api"
+	"arbokcore/core/devices"
+	"arbokcore/core/tokens"
+	"arbokcore/web/middlewares"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+type DeviceHandler struct {
+	DeviceSvc *devices.DeviceService
+}
+
+const (
+	RouteDevices = "/my/devices"
+	RouteDevice  = "/my/devices/:deviceID"
+)
+
+func (handler *DeviceHandler) RegisterDevice(c echo.Context) error {
+	req := &api.DeviceRequest{}
+
+	if err := c.Bind(req); err != nil {
+		log.Error().Err(err).Msg("bad request")
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	req.DeviceName = strings.TrimSpace(req.DeviceName)
+
+	if req.DeviceName == "" ||
+		len(req.DeviceName) > devices.MaxDeviceNameLen ||
+		len(req.Platform) > devices.MaxPlatformLen {
+
+		return c.NoContent(http.StatusUnprocessableEntity)
+	}
+
+	token, ok := c.Get(middlewares.TokenContextKey).(*tokens.Token)
+	if !ok {
+		log.Error().Msg("current token is not set")
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	ctx := c.Request().Context()
+
+	device, err := handler.DeviceSvc.Register(ctx, token, req.DeviceName, req.Platform)
+	resp := api.BuildResponse(err, device)
+	if err != nil {
+		return c.JSON(resp.Error.HttpStatus, resp)
+	}
+
+	return c.JSON(http.StatusCreated, resp)
+}
+
+func (handler *DeviceHandler) ListDevices(c echo.Context) error {
+	token, ok := c.Get(middlewares.TokenContextKey).(*tokens.Token)
+	if !ok {
+		log.Error().Msg("current token is not set")
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	ctx := c.Request().Context()
+
+	devices, err := handler.DeviceSvc.List(ctx, token.ResourceID)
+	resp := api.BuildResponse(err, map[string]any{
+		"devices":       devices,
+		"currentDevice": token.DeviceID,
+	})
+	if err != nil {
+		return c.JSON(resp.Error.HttpStatus, resp)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (handler *DeviceHandler) RemoveDevice(c echo.Context) error {
+	token, ok := c.Get(middlewares.TokenContextKey).(*tokens.Token)
+	if !ok {
+		log.Error().Msg("current token is not set")
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	deviceID := c.Param("deviceID")
+	if deviceID == "" {
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	ctx := c.Request().Context()
+
+	err := handler.DeviceSvc.Remove(ctx, token.ResourceID, deviceID)
+	if err != nil {
+		resp := api.BuildResponse(err, nil)
+		return c.JSON(resp.Error.HttpStatus, resp)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -3,14 +3,14 @@ package routes
 import (
 	"arbokcore/core/api"
 	"arbokcore/core/files"
+	"arbokcore/core/shares"
 	"arbokcore/core/tokens"
+	"arbokcore/pkg/urlsigner"
 	"arbokcore/web/middlewares"
-	"bytes"
-	"fmt"
-	"io"
+	"mime"
 	"net/http"
-	"os"
 	"strconv"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/rs/zerolog/log"
@@ -19,15 +19,51 @@ import (
 type MetadataHandler struct {
 	FileSvc    *files.MetadataService
 	Downloader *files.DownloadHandler
+	Shares     *shares.ShareService
+	Links      *shares.LinkService
+	Versions   *files.VersionService
+	Signer     *urlsigner.Signer
+}
+
+// authorize checks if the user of the token has the needed permission on the
+// file, and writes the error response if not.
+func (handler *MetadataHandler) authorize(
+	c echo.Context,
+	token *tokens.Token,
+	fileID string,
+	needed string,
+) (*shares.FileAccess, error) {
+
+	ctx := c.Request().Context()
+
+	access, err := handler.Shares.Authorize(ctx, token.ResourceID, fileID, needed)
+	if err != nil {
+		log.Error().Err(err).Str("fileID", fileID).Msg("file access denied")
+
+		resp := api.BuildResponse(err, nil)
+		return nil, c.JSON(resp.Error.HttpStatus, resp)
+	}
+
+	return access, nil
 }
 
 const (
-	RouteMetadataGet    = "/my/files"
-	RouteMetadataPost   = "/my/files"
-	RouteMetadataPatch  = "/my/files/:fileID"
-	RouteFileUploadDone = "/my/files/:fileID/eof"
+	RouteMetadataGet     = "/my/files"
+	RouteMetadataPost    = "/my/files"
+	RouteMetadataPatch   = "/my/files/:fileID"
+	RouteFileUploadDone  = "/my/files/:fileID/eof"
+	RouteSharedLink      = "/links/:linkToken/download"
+	RouteFileVersions    = "/my/files/:fileID/versions"
+	RouteVersionDownload = "/my/files/:fileID/versions/:versionID/download"
+	RouteVersionRestore  = "/my/files/:fileID/versions/:versionID/restore"
+	RouteStorageUsage    = "/my/storage"
+	RouteFileManifest    = "/my/files/:fileID/manifest"
+	RouteFileCompression = "/my/files/:fileID/compression"
+	RouteChunkBlob       = "/blobs/chunks/:fileID/:chunkID"
 )
 
+const LinkPasswordHeaderKey = "X-Link-Password"
+
 func (handler *MetadataHandler) MarkUploadComplete(c echo.Context) error {
 	token, ok := c.Get(middlewares.TokenContextKey).(*tokens.Token)
 	if !ok {
@@ -65,101 +101,307 @@ func (handler *MetadataHandler) DownloadFileV2(c echo.Context) error {
 		return c.NoContent(http.StatusUnauthorized)
 	}
 
-	ctx := c.Request().Context()
+	fileID := c.Param("fileID")
+
+	access, err := handler.authorize(c, token, fileID, shares.PermissionRead)
+	if access == nil {
+		return err
+	}
+
+	return handler.streamFile(c, access, handler.Downloader.OpenCached)
+}
+
+func (handler *MetadataHandler) DownloadFile(c echo.Context) error {
+	token, ok := c.Get(middlewares.TokenContextKey).(*tokens.Token)
+	if !ok {
+		log.Error().Msg("token validation not done")
+		return c.NoContent(http.StatusUnauthorized)
+	}
 
 	fileID := c.Param("fileID")
-	downloadUrls, infoResp, err := handler.FileSvc.ListOrderedFileChunks(ctx, fileID, token.ResourceID)
 
+	access, err := handler.authorize(c, token, fileID, shares.PermissionRead)
+	if access == nil {
+		return err
+	}
+
+	return handler.sendFile(c, access)
+}
+
+// DownloadSharedLink serves the current version of the file behind a public
+// share link. The password of a protected link is sent in a header, so it
+// doesn't end up in access logs.
+func (handler *MetadataHandler) DownloadSharedLink(c echo.Context) error {
+	linkToken := c.Param("linkToken")
+	if linkToken == "" {
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	ctx := c.Request().Context()
+
+	password := c.Request().Header.Get(LinkPasswordHeaderKey)
+
+	access, err := handler.Links.Resolve(ctx, linkToken, password)
 	if err != nil {
-		log.Error().Err(err).Msg("failed to get files chunks")
+		log.Error().Err(err).Msg("share link rejected")
 		resp := api.BuildResponse(err, nil)
 		return c.JSON(resp.Error.HttpStatus, resp)
 	}
 
-	buffer, err := handler.Downloader.Download(ctx, infoResp.Size, downloadUrls)
-	if err != nil {
-		log.Error().Err(err).Msg("failed to download file")
-		return c.NoContent(http.StatusInternalServerError)
+	return handler.sendFile(c, access)
+}
+
+func (handler *MetadataHandler) ListVersions(c echo.Context) error {
+	token, ok := c.Get(middlewares.TokenContextKey).(*tokens.Token)
+	if !ok {
+		log.Error().Msg("current token is not set")
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	fileID := c.Param("fileID")
+
+	access, err := handler.authorize(c, token, fileID, shares.PermissionRead)
+	if access == nil {
+		return err
 	}
 
-	log.Info().Int("buffer len", buffer.Len()).Msg("total size of buffer")
+	ctx := c.Request().Context()
 
-	outputFilePath := fmt.Sprintf("./tmp/outdir/%s", infoResp.Name)
-	outputFile, err := os.Create(outputFilePath)
+	versions, err := handler.FileSvc.ListVersions(ctx, fileID)
+	resp := api.BuildResponse(err, map[string]any{"versions": versions})
 	if err != nil {
-		log.Error().Err(err).Msg("failed to create output file")
-		return c.NoContent(http.StatusInternalServerError)
+		return c.JSON(resp.Error.HttpStatus, resp)
 	}
 
-	defer outputFile.Close()
-	defer os.Remove(outputFilePath)
+	return c.JSON(http.StatusOK, resp)
+}
 
-	_, err = io.Copy(outputFile, buffer)
+// StorageUsage compares the logical size of the files of the user with the
+// space their deduplicated chunks take up
+func (handler *MetadataHandler) StorageUsage(c echo.Context) error {
+	token, ok := c.Get(middlewares.TokenContextKey).(*tokens.Token)
+	if !ok {
+		log.Error().Msg("current token is not set")
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	ctx := c.Request().Context()
+
+	usage, err := handler.FileSvc.StorageUsage(ctx, token.ResourceID)
+	resp := api.BuildResponse(err, usage)
 	if err != nil {
-		log.Error().Err(err).Msg("failed to write to output file")
-		return c.NoContent(http.StatusInternalServerError)
+		return c.JSON(resp.Error.HttpStatus, resp)
 	}
 
-	return c.Attachment(outputFilePath, infoResp.Name)
+	return c.JSON(http.StatusOK, resp)
 }
 
-func (handler *MetadataHandler) DownloadFile(c echo.Context) error {
+// DownloadVersion serves an older version of the file. Only versions
+// which finished uploading have all their chunks to download.
+func (handler *MetadataHandler) DownloadVersion(c echo.Context) error {
 	token, ok := c.Get(middlewares.TokenContextKey).(*tokens.Token)
 	if !ok {
 		log.Error().Msg("token validation not done")
 		return c.NoContent(http.StatusUnauthorized)
 	}
 
+	fileID := c.Param("fileID")
+
+	access, err := handler.authorize(c, token, fileID, shares.PermissionRead)
+	if access == nil {
+		return err
+	}
+
 	ctx := c.Request().Context()
 
+	version, err := handler.FileSvc.FindVersion(ctx, fileID, c.Param("versionID"))
+	if err == nil && version.UploadStatus != files.StatusCompleted {
+		err = files.ErrVersionUnavailable
+	}
+
+	if err != nil {
+		resp := api.BuildResponse(err, nil)
+		return c.JSON(resp.Error.HttpStatus, resp)
+	}
+
+	return handler.sendFile(c, &shares.FileAccess{
+		FileID:     version.ID,
+		LineageID:  access.LineageID,
+		OwnerID:    access.OwnerID,
+		Permission: access.Permission,
+	})
+}
+
+// RestoreVersion needs write access, since it changes
+// the current version for everyone the file is shared with
+func (handler *MetadataHandler) RestoreVersion(c echo.Context) error {
+	token, ok := c.Get(middlewares.TokenContextKey).(*tokens.Token)
+	if !ok {
+		log.Error().Msg("current token is not set")
+		return c.NoContent(http.StatusForbidden)
+	}
+
 	fileID := c.Param("fileID")
-	downloadUrls, infoResp, err := handler.FileSvc.ListOrderedFileChunks(ctx, fileID, token.ResourceID)
 
+	access, err := handler.authorize(c, token, fileID, shares.PermissionReadWrite)
+	if access == nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+
+	version, err := handler.Versions.Restore(ctx, &files.RestoreRequest{
+		FileID:    fileID,
+		VersionID: c.Param("versionID"),
+		OwnerID:   access.OwnerID,
+		DeviceID:  token.DeviceID,
+	})
+	resp := api.BuildResponse(err, version)
+	if err != nil {
+		return c.JSON(resp.Error.HttpStatus, resp)
+	}
+
+	return c.JSON(http.StatusCreated, resp)
+}
+
+func (handler *MetadataHandler) sendFile(c echo.Context, access *shares.FileAccess) error {
+	return handler.streamFile(c, access, handler.Downloader.Open)
+}
+
+// FileManifest lists the chunks of the file with signed urls,
+// for clients which download the chunks in parallel
+func (handler *MetadataHandler) FileManifest(c echo.Context) error {
+	token, ok := c.Get(middlewares.TokenContextKey).(*tokens.Token)
+	if !ok {
+		log.Error().Msg("token validation not done")
+		return c.NoContent(http.StatusUnauthorized)
+	}
+
+	fileID := c.Param("fileID")
+
+	access, err := handler.authorize(c, token, fileID, shares.PermissionRead)
+	if access == nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+
+	spans, infoResp, err := handler.FileSvc.ListFileSpans(ctx, access.FileID, access.OwnerID)
 	if err != nil {
-		log.Error().Err(err).Msg("failed to get files chunks")
 		resp := api.BuildResponse(err, nil)
 		return c.JSON(resp.Error.HttpStatus, resp)
 	}
 
-	var buffer = bytes.NewBuffer(make([]byte, 0, infoResp.Size))
+	manifest := files.BuildDownloadManifest(infoResp, spans, handler.Signer, files.ChunkURLExpiry)
+	return c.JSON(http.StatusOK, api.BuildResponse(nil, manifest))
+}
+
+// FileCompression reports the size the chunks of the file are stored in
+func (handler *MetadataHandler) FileCompression(c echo.Context) error {
+	token, ok := c.Get(middlewares.TokenContextKey).(*tokens.Token)
+	if !ok {
+		log.Error().Msg("token validation not done")
+		return c.NoContent(http.StatusUnauthorized)
+	}
 
-	for _, filePath := range downloadUrls {
-		file, err := os.Open(filePath)
-		if err != nil {
-			log.Error().Err(err).Msg("failed to find file in url")
-			return c.NoContent(http.StatusInternalServerError)
-		}
+	fileID := c.Param("fileID")
 
-		defer file.Close()
+	access, err := handler.authorize(c, token, fileID, shares.PermissionRead)
+	if access == nil {
+		return err
+	}
 
-		w, err := io.Copy(buffer, file)
-		if err != nil {
-			log.Error().Err(err).Msg("failed to copy file chunk into buffer")
-			return c.NoContent(http.StatusInternalServerError)
-		}
+	ctx := c.Request().Context()
 
-		log.Info().Int64("bytes", w).Msg("written chunks")
+	report, err := handler.FileSvc.FileCompression(ctx, access.FileID, access.OwnerID)
+	resp := api.BuildResponse(err, report)
+	if err != nil {
+		return c.JSON(resp.Error.HttpStatus, resp)
 	}
 
-	log.Info().Int("buffer len", buffer.Len()).Msg("total size of buffer")
+	return c.JSON(http.StatusOK, resp)
+}
+
+// DownloadChunk serves one chunk of a manifest. The signed url is the
+// only credential, Range requests let a client resume a chunk.
+func (handler *MetadataHandler) DownloadChunk(c echo.Context) error {
+	fileID := c.Param("fileID")
 
-	outputFilePath := fmt.Sprintf("./tmp/outdir/%s", infoResp.Name)
-	outputFile, err := os.Create(outputFilePath)
+	chunkID, err := strconv.ParseInt(c.Param("chunkID"), 10, 64)
 	if err != nil {
-		log.Error().Err(err).Msg("failed to create output file")
-		return c.NoContent(http.StatusInternalServerError)
+		return c.NoContent(http.StatusNotFound)
 	}
 
-	defer outputFile.Close()
-	defer os.Remove(outputFilePath)
+	err = files.VerifyChunkURL(handler.Signer, files.ChunkURLPath(fileID, chunkID), c.QueryParams())
+	if err != nil {
+		resp := api.BuildResponse(err, nil)
+		return c.JSON(resp.Error.HttpStatus, resp)
+	}
+
+	ctx := c.Request().Context()
+
+	span, err := handler.FileSvc.FindChunkSpan(ctx, fileID, chunkID)
+	if err != nil {
+		resp := api.BuildResponse(err, nil)
+		return c.JSON(resp.Error.HttpStatus, resp)
+	}
+
+	reader, err := handler.Downloader.Open(ctx, []*files.ChunkSpan{span})
+	if err != nil {
+		resp := api.BuildResponse(err, nil)
+		return c.JSON(resp.Error.HttpStatus, resp)
+	}
+	defer reader.Close()
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, echo.MIMEOctetStream)
+	header.Set(echo.HeaderCacheControl, "private")
+
+	if span.Hash != "" {
+		header.Set("ETag", strconv.Quote(span.Hash))
+	}
+
+	http.ServeContent(c.Response(), c.Request(), "", time.Time{}, reader)
+	return nil
+}
+
+// streamFile serves the file over its chunks. Range and If-Range requests
+// are answered with the chunks covering the ranges, the ETag is the hash of
+// the file. Once the headers are out an error can't be reported anymore,
+// the client sees the body end short of the Content-Length.
+func (handler *MetadataHandler) streamFile(c echo.Context, access *shares.FileAccess, open files.FileOpener) error {
+	ctx := c.Request().Context()
+
+	spans, infoResp, err := handler.FileSvc.ListFileSpans(ctx, access.FileID, access.OwnerID)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to get files chunks")
+		resp := api.BuildResponse(err, nil)
+		return c.JSON(resp.Error.HttpStatus, resp)
+	}
 
-	_, err = io.Copy(outputFile, buffer)
+	reader, err := open(ctx, spans)
 	if err != nil {
-		log.Error().Err(err).Msg("failed to write to output file")
-		return c.NoContent(http.StatusInternalServerError)
+		resp := api.BuildResponse(err, nil)
+		return c.JSON(resp.Error.HttpStatus, resp)
+	}
+	defer reader.Close()
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentDisposition, mime.FormatMediaType("attachment", map[string]string{
+		"filename": infoResp.Name,
+	}))
+
+	// Without a type, it is guessed from the name
+	if infoResp.Type != "" {
+		header.Set(echo.HeaderContentType, infoResp.Type)
+	}
+
+	if infoResp.Hash != "" {
+		header.Set("ETag", strconv.Quote(infoResp.Hash))
 	}
 
-	return c.Attachment(outputFilePath, infoResp.Name)
+	http.ServeContent(c.Response(), c.Request(), infoResp.Name, time.Time{}, reader)
+	return nil
 }
 
 func (handler *MetadataHandler) PostFileMetadata(c echo.Context) error {
@@ -186,7 +428,9 @@ func (handler *MetadataHandler) PostFileMetadata(c echo.Context) error {
 		FileSize:     req.FileSize,
 		Digest:       req.Digest,
 		Chunks:       req.Chunks,
+		Chunking:     req.Chunking,
 		UploadStatus: files.StatusUploading,
+		DeviceID:     token.DeviceID,
 	})
 
 	if resp.Success {
@@ -230,8 +474,10 @@ func (handler *MetadataHandler) GetFileChunks(c echo.Context) error {
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	// Check if user has access to file
-	_ = token
+	access, err := handler.authorize(c, token, fileID, shares.PermissionRead)
+	if access == nil {
+		return err
+	}
 
 	fileWithChunks, err := handler.FileSvc.GetFileChunks(ctx, fileID)
 	resp := api.BuildResponse(err, fileWithChunks)
@@ -285,7 +531,6 @@ func (handler *MetadataHandler) UpdateFileMetadata(c echo.Context) error {
 
 	ctx := c.Request().Context()
 
-	//TODO: validate if user has file access
 	//TODO: validate request struct
 	token, ok := c.Get(middlewares.TokenContextKey).(*tokens.Token)
 	if !ok {
@@ -293,7 +538,15 @@ func (handler *MetadataHandler) UpdateFileMetadata(c echo.Context) error {
 		return c.NoContent(http.StatusForbidden)
 	}
 
+	req.FileID = c.Param("fileID")
+
+	access, err := handler.authorize(c, token, req.FileID, shares.PermissionReadWrite)
+	if access == nil {
+		return err
+	}
+
 	req.UserID = token.ResourceID
+	req.DeviceID = token.DeviceID
 
 	resp := handler.FileSvc.UpdateFileMetadata(ctx, req)
 	if resp.Success {
@@ -1,14 +1,197 @@
 package routes
 
 import (
+	"arbokcore/core/api"
+	"arbokcore/core/shares"
+	"arbokcore/core/tokens"
+	"arbokcore/web/middlewares"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
 )
 
 type ShareHandler struct {
+	ShareSvc *shares.ShareService
+	LinkSvc  *shares.LinkService
 }
 
+const (
+	RouteFileShare   = "/my/files/:fileID/share"
+	RouteFileShares  = "/my/files/:fileID/shares"
+	RouteFileShareOf = "/my/files/:fileID/shares/:userID"
+	RouteSharedFiles = "/my/shared"
+	RouteFileLinks   = "/my/files/:fileID/links"
+	RouteFileLink    = "/my/files/:fileID/links/:linkID"
+)
+
 func (sh *ShareHandler) ShareFile(c echo.Context) error {
-	return c.NoContent(http.StatusForbidden)
+	req := &api.ShareRequest{}
+
+	if err := c.Bind(req); err != nil {
+		log.Error().Err(err).Msg("bad request")
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+	if req.Email == "" || len(req.Email) > MaxEmailLen {
+		return c.NoContent(http.StatusUnprocessableEntity)
+	}
+
+	if req.Permission == "" {
+		req.Permission = shares.PermissionRead
+	}
+
+	token, ok := c.Get(middlewares.TokenContextKey).(*tokens.Token)
+	if !ok {
+		log.Error().Msg("current token is not set")
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	ctx := c.Request().Context()
+
+	share, err := sh.ShareSvc.ShareFile(
+		ctx,
+		token.ResourceID,
+		c.Param("fileID"),
+		req.Email,
+		req.Permission,
+	)
+	resp := api.BuildResponse(err, share)
+	if err != nil {
+		return c.JSON(resp.Error.HttpStatus, resp)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (sh *ShareHandler) ListShares(c echo.Context) error {
+	token, ok := c.Get(middlewares.TokenContextKey).(*tokens.Token)
+	if !ok {
+		log.Error().Msg("current token is not set")
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	ctx := c.Request().Context()
+
+	fileShares, err := sh.ShareSvc.ListShares(ctx, token.ResourceID, c.Param("fileID"))
+	resp := api.BuildResponse(err, map[string]any{"shares": fileShares})
+	if err != nil {
+		return c.JSON(resp.Error.HttpStatus, resp)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (sh *ShareHandler) RevokeShare(c echo.Context) error {
+	token, ok := c.Get(middlewares.TokenContextKey).(*tokens.Token)
+	if !ok {
+		log.Error().Msg("current token is not set")
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	userID := c.Param("userID")
+	if userID == "" {
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	ctx := c.Request().Context()
+
+	err := sh.ShareSvc.RevokeShare(ctx, token.ResourceID, c.Param("fileID"), userID)
+	if err != nil {
+		resp := api.BuildResponse(err, nil)
+		return c.JSON(resp.Error.HttpStatus, resp)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (sh *ShareHandler) ListSharedWithMe(c echo.Context) error {
+	token, ok := c.Get(middlewares.TokenContextKey).(*tokens.Token)
+	if !ok {
+		log.Error().Msg("current token is not set")
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	ctx := c.Request().Context()
+
+	sharedFiles, err := sh.ShareSvc.ListSharedWithMe(ctx, token.ResourceID)
+	resp := api.BuildResponse(err, map[string]any{"files": sharedFiles})
+	if err != nil {
+		return c.JSON(resp.Error.HttpStatus, resp)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (sh *ShareHandler) CreateLink(c echo.Context) error {
+	req := &api.ShareLinkRequest{}
+
+	if err := c.Bind(req); err != nil {
+		log.Error().Err(err).Msg("bad request")
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	token, ok := c.Get(middlewares.TokenContextKey).(*tokens.Token)
+	if !ok {
+		log.Error().Msg("current token is not set")
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	ctx := c.Request().Context()
+
+	link, err := sh.LinkSvc.CreateLink(ctx, token.ResourceID, c.Param("fileID"), shares.LinkOpts{
+		Password:     req.Password,
+		ExpiresIn:    time.Duration(req.ExpiresIn) * time.Second,
+		MaxDownloads: req.MaxDownloads,
+	})
+	resp := api.BuildResponse(err, link)
+	if err != nil {
+		return c.JSON(resp.Error.HttpStatus, resp)
+	}
+
+	return c.JSON(http.StatusCreated, resp)
+}
+
+func (sh *ShareHandler) ListLinks(c echo.Context) error {
+	token, ok := c.Get(middlewares.TokenContextKey).(*tokens.Token)
+	if !ok {
+		log.Error().Msg("current token is not set")
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	ctx := c.Request().Context()
+
+	links, err := sh.LinkSvc.ListLinks(ctx, token.ResourceID, c.Param("fileID"))
+	resp := api.BuildResponse(err, map[string]any{"links": links})
+	if err != nil {
+		return c.JSON(resp.Error.HttpStatus, resp)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (sh *ShareHandler) RevokeLink(c echo.Context) error {
+	token, ok := c.Get(middlewares.TokenContextKey).(*tokens.Token)
+	if !ok {
+		log.Error().Msg("current token is not set")
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	linkID := c.Param("linkID")
+	if linkID == "" {
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	ctx := c.Request().Context()
+
+	err := sh.LinkSvc.RevokeLink(ctx, token.ResourceID, c.Param("fileID"), linkID)
+	if err != nil {
+		resp := api.BuildResponse(err, nil)
+		return c.JSON(resp.Error.HttpStatus, resp)
+	}
+
+	return c.NoContent(http.StatusNoContent)
 }
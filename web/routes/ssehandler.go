@@ -30,7 +30,7 @@ type SSEHandler struct {
 	syncer     *brokers.FileUpdateSyncBroker
 }
 
-func NewSSEHandler(cfg config.AppConfig) *SSEHandler {
+func NewSSEHandler(cfg config.AppConfig, devices brokers.DeviceLister) *SSEHandler {
 	subscriber := brokers.NewSSEBroker("file_events")
 	subscriber.Start(context.Background())
 
@@ -42,7 +42,7 @@ func NewSSEHandler(cfg config.AppConfig) *SSEHandler {
 	syncer := brokers.NewFileUpdateSyncBroker(
 		"update_syncer",
 		metadataProducer,
-		&brokers.SSEConsumer{Dst: subscriber},
+		&brokers.SSEConsumer{Dst: subscriber, Devices: devices},
 	)
 	syncer.Start(context.Background())
 
@@ -61,7 +61,12 @@ func (slf *SSEHandler) EstablishConnection(c echo.Context) error {
 
 	ctx := c.Request().Context()
 	userID := token.ResourceID
-	deviceID := c.QueryParam("deviceID")
+	deviceID := token.DeviceID
+
+	if deviceID == "" {
+		log.Error().Msg("session is not bound to a registered device")
+		return c.NoContent(http.StatusPreconditionRequired)
+	}
 
 	w := SetupSSEeventResponse(c)
 
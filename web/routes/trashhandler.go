@@ -0,0 +1,124 @@
+package routes
+
+import (
+	"arbokcore/core/api"
+	"arbokcore/core/files"
+	"arbokcore/core/shares"
+	"arbokcore/core/tokens"
+	"arbokcore/web/middlewares"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+type TrashHandler struct {
+	TrashSvc *files.TrashService
+	Shares   *shares.ShareService
+}
+
+const (
+	RouteFileTrash    = "/my/files/:fileID"
+	RouteTrash        = "/my/trash"
+	RouteTrashRestore = "/my/trash/:fileID/restore"
+	RouteTrashPurge   = "/my/trash/:fileID"
+)
+
+func trashRequest(token *tokens.Token, fileID string, access *shares.FileAccess) *files.TrashRequest {
+	return &files.TrashRequest{
+		FileID:    fileID,
+		LineageID: access.LineageID,
+		OwnerID:   access.OwnerID,
+		DeviceID:  token.DeviceID,
+	}
+}
+
+// TrashFile moves every version of the file to the trash.
+// Only the owner can delete a file.
+func (handler *TrashHandler) TrashFile(c echo.Context) error {
+	token, ok := c.Get(middlewares.TokenContextKey).(*tokens.Token)
+	if !ok {
+		log.Error().Msg("current token is not set")
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	ctx := c.Request().Context()
+	fileID := c.Param("fileID")
+
+	access, err := handler.Shares.Authorize(ctx, token.ResourceID, fileID, shares.PermissionOwner)
+	if err == nil {
+		err = handler.TrashSvc.Trash(ctx, trashRequest(token, fileID, access))
+	}
+
+	if err != nil {
+		resp := api.BuildResponse(err, nil)
+		return c.JSON(resp.Error.HttpStatus, resp)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (handler *TrashHandler) ListTrash(c echo.Context) error {
+	token, ok := c.Get(middlewares.TokenContextKey).(*tokens.Token)
+	if !ok {
+		log.Error().Msg("current token is not set")
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	ctx := c.Request().Context()
+
+	trashed, err := handler.TrashSvc.ListTrash(ctx, token.ResourceID)
+	resp := api.BuildResponse(err, map[string]any{"files": trashed})
+	if err != nil {
+		return c.JSON(resp.Error.HttpStatus, resp)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (handler *TrashHandler) RestoreFile(c echo.Context) error {
+	token, ok := c.Get(middlewares.TokenContextKey).(*tokens.Token)
+	if !ok {
+		log.Error().Msg("current token is not set")
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	ctx := c.Request().Context()
+	fileID := c.Param("fileID")
+
+	access, err := handler.Shares.AuthorizeTrashed(ctx, token.ResourceID, fileID)
+	if err == nil {
+		err = handler.TrashSvc.Restore(ctx, trashRequest(token, fileID, access))
+	}
+
+	if err != nil {
+		resp := api.BuildResponse(err, nil)
+		return c.JSON(resp.Error.HttpStatus, resp)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// PurgeFile deletes a trashed file permanently
+func (handler *TrashHandler) PurgeFile(c echo.Context) error {
+	token, ok := c.Get(middlewares.TokenContextKey).(*tokens.Token)
+	if !ok {
+		log.Error().Msg("current token is not set")
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	ctx := c.Request().Context()
+	fileID := c.Param("fileID")
+
+	access, err := handler.Shares.AuthorizeTrashed(ctx, token.ResourceID, fileID)
+	if err == nil {
+		err = handler.TrashSvc.Purge(ctx, trashRequest(token, fileID, access))
+	}
+
+	if err != nil {
+		resp := api.BuildResponse(err, nil)
+		return c.JSON(resp.Error.HttpStatus, resp)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}